@@ -3,10 +3,39 @@ package main
 import (
 	"bytes"
 	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"log"
+	"math"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // This script shows how to build a basic video encoder. In the real world, video encoders
@@ -25,174 +54,5991 @@ import (
 //   cat video.rgb24 | go run main.go
 
 func main() {
-	var width, height int
+	var width, height, maxFrames, loop, temporalFactor, previewScale, deadlineMS, checkpointInterval, lumaQuant, keyframeInterval, refDistance, compareFrame, jpegQuality, maxMemory, maxFrameSize, threads, tileSize, blockSize, level, targetSize int
+	var cpuProfile, memProfile, input, inputGlob, output, outputGlob, inputFormat, mode, logFormat, psnrCSV, pixelAspect, compareOut, dumpDeltas, compression, colorRangeName, cropList, framerate, predictor, reference, segmentList, renditionList, dumpPlanesDir, psnrWeightList, layout, subsampling, decodeFormat string
+	var dither, linearDownsample, lumaOnly, skipCorrupt, tolerant, alpha, rleEscape, rleVarint, skipRLEStats, gzipYUV, autoTuneLevel, deterministic, resume, interlaced, detectBars, zigzag, storeOnExpand, compareJPEG, compareGIF, blockSkip, repeatFrames, exploitSymmetry, verify, histogram, selftest, twoPass bool
+	var minPSNR, readRate, autoLevelSlack float64
+	flag.StringVar(&input, "input", "", "file to read the video from instead of stdin, with its dimensions in an optional FILE.meta, or tcp://HOST:PORT to read it from a TCP connection")
+	flag.StringVar(&inputGlob, "input-glob", "", "read the video from the PNG files matching this pattern in sorted order, e.g. 'frames/*.png', with the dimensions of the first one")
+	flag.Float64Var(&readRate, "read-rate", 0, "read at most this many frames per second, or 0 to read as fast as possible")
+	flag.StringVar(&inputFormat, "input-format", "rgb24", "format of the input: rgb24, or yuv420p to skip converting it to YUV")
 	flag.IntVar(&width, "width", 384, "width of the video")
 	flag.IntVar(&height, "height", 216, "height of the video")
+	flag.IntVar(&maxFrames, "frames", 0, "maximum number of frames to read, or 0 to read all of them")
+	flag.IntVar(&loop, "loop", 1, "encode the input this many times over, one after the other")
+	flag.IntVar(&temporalFactor, "temporal-factor", 1, "only keep every Nth frame, dividing the framerate by N")
+	flag.IntVar(&keyframeInterval, "keyframe-interval", 0, "insert a keyframe every N frames, or 0 to only make the first frame a keyframe")
+	flag.StringVar(&mode, "mode", "fixed", "how to choose between keyframes and P-frames: fixed to only make keyframes where the options above say, or adaptive to also try each frame both ways and keep the smaller")
+	flag.IntVar(&deadlineMS, "deadline-ms", 0, "for live video, lower the effort whenever encoding falls more than this many milliseconds per frame behind, or 0 to take as long as it takes")
+	flag.IntVar(&checkpointInterval, "checkpoint", 0, "start a new segment every N frames and record after each one how far the encode got, so that it can be picked up again with -resume, or 0 to not")
+	flag.BoolVar(&resume, "resume", false, "with -checkpoint, pick up an interrupted encode where its last checkpoint left off instead of starting over")
+	flag.BoolVar(&twoPass, "two-pass", false, "look at every frame before encoding to decide where to put keyframes")
+	flag.IntVar(&targetSize, "target-size", 0, "with -two-pass, the size in bytes to fit the video in by quantizing Y as little as possible, starting from -luma-quant")
+	flag.StringVar(&framerate, "framerate", "25", "framerate of the video, either N or N/D (e.g. 30000/1001)")
+	flag.StringVar(&pixelAspect, "par", "1:1", "pixel aspect ratio of the video, the width of a pixel to its height, e.g. 10:11 for NTSC DV")
+	flag.StringVar(&predictor, "predictor", "none", "spatial predictor for keyframes: none or median")
+	flag.IntVar(&refDistance, "ref-distance", 1, "with -reference prev, make each P-frame a delta against the frame this many frames back")
+	flag.StringVar(&reference, "reference", "prev", "what P-frames are a delta against: prev for the previous frame, or avg for a running average of recent frames")
+	flag.IntVar(&previewScale, "preview-scale", 1, "shrink each frame by this factor in each direction before encoding, for a quick preview of a large video")
+	flag.StringVar(&cropList, "crop", "", "only encode the region x,y,w,h of each frame, e.g. 100,50,64,64")
+	flag.StringVar(&segmentList, "segments", "", "dimensions and frame counts of spliced clips, e.g. 384x216:100,192x108:50")
+	flag.StringVar(&layout, "yuv-layout", "planar", "layout of the YUV frames: planar, packed, or nv12 for hardware decoders")
+	flag.StringVar(&subsampling, "subsampling", "420", "chroma subsampling: 420 or 411")
+	flag.StringVar(&colorRangeName, "range", "full", "range of the YUV values: full for 0-255, or limited for 16-235 (Y) and 16-240 (U and V)")
+	flag.BoolVar(&alpha, "alpha", false, "read rgba input and keep the alpha channel")
+	flag.BoolVar(&interlaced, "interlaced", false, "split each frame into its two fields and encode them one after the other, for interlaced video")
+	flag.BoolVar(&detectBars, "detect-letterbox", false, "store solid bars at the edges of the frames, like a letterbox, as their size and color instead of coding them in every frame")
+	flag.BoolVar(&dither, "dither", false, "dither the downsampled chroma to reduce banding")
+	flag.IntVar(&lumaQuant, "luma-quant", 1, "divide Y by this step and round before storing it, trading banding for size, or 1 to keep it lossless")
+	flag.BoolVar(&linearDownsample, "linear-downsample", false, "average the chroma in linear light instead of gamma-encoded sRGB")
+	flag.BoolVar(&rleEscape, "rle-escape", false, "use an escaped run length encoding that doesn't expand noisy data")
+	flag.BoolVar(&rleVarint, "rle-varint", false, "store run lengths as variable-length integers so runs can be longer than 255")
+	flag.BoolVar(&gzipYUV, "gzip-yuv", false, "write the YUV frames we encode to encoded.yuv.gz instead of encoded.yuv, which is much smaller for a long video")
+	flag.BoolVar(&skipRLEStats, "skip-rle-stats", false, "don't run length encode the video just to report its size")
+	flag.BoolVar(&zigzag, "zigzag", false, "store deltas as zig-zag encoded signed values")
+	flag.StringVar(&compression, "compression", "flate", "general-purpose compressor for the frames: flate, gzip or zlib")
+	flag.IntVar(&level, "level", flate.BestCompression, "DEFLATE level to compress the frames at, from 1 (fastest) to 9 (smallest)")
+	flag.BoolVar(&autoTuneLevel, "auto-level", false, "instead of -level, time every level on the first GOP and use the fastest one within -auto-level-slack of the smallest")
+	flag.Float64Var(&autoLevelSlack, "auto-level-slack", 1, "with -auto-level, how much bigger than the smallest, in percent, the chosen level may come out")
+	flag.StringVar(&renditionList, "renditions", "", "also encode the video at other settings, each to its own encoded-NAME.bin, e.g. 'hi:level=9 lo:luma-quant=8,subsampling=411'")
+	flag.BoolVar(&storeOnExpand, "store-on-expand", false, "store segments uncompressed if compressing them makes them bigger")
+	flag.IntVar(&tileSize, "tile-size", 0, "split frames into tiles of this size, a multiple of 16, that are coded independently, or 0 to not")
+	flag.BoolVar(&blockSkip, "block-skip", false, "only store the blocks of P-frames that changed")
+	flag.IntVar(&blockSize, "block-size", defaultBlockSize, "width and height in pixels of the blocks for -block-skip, a power of two from 4 to 128")
+	flag.BoolVar(&repeatFrames, "repeat-frames", false, "store each run of frames that are the same as the one before them as a single repeat with a count")
+	flag.BoolVar(&exploitSymmetry, "exploit-symmetry", false, "only store half of the planes of keyframes that are mirror images of themselves")
+	flag.BoolVar(&compareJPEG, "compare-jpeg", false, "also JPEG encode every frame on its own and compare the sizes")
+	flag.BoolVar(&compareGIF, "compare-gif", false, "also encode the video as an animated GIF and compare the sizes")
+	flag.StringVar(&compareOut, "compare-out", "", "write a PNG of a frame of the input next to the decoded frame and their difference to this file")
+	flag.IntVar(&compareFrame, "compare-frame", 0, "index of the frame to write to -compare-out and -dump-planes")
+	flag.StringVar(&dumpPlanesDir, "dump-planes", "", "write the Y, U and V planes of the -compare-frame to grayscale PNGs in this directory")
+	flag.IntVar(&jpegQuality, "jpeg-quality", jpeg.DefaultQuality, "JPEG quality for -compare-jpeg, from 1 to 100")
+	flag.StringVar(&decodeFormat, "decode-format", "rgb", "format of the decoded video: rgb, or yuv to skip converting it back to RGB")
+	flag.StringVar(&output, "output", "", "also stream the decoded frames to the first viewer to connect to tcp://HOST:PORT, e.g. tcp://:9000")
+	flag.StringVar(&outputGlob, "output-glob", "", "also write each decoded frame to a numbered PNG file, with a pattern like 'out/frame_%04d.png'")
+	flag.BoolVar(&lumaOnly, "luma-only", false, "only decode the Y plane of each frame and write it to decoded.gray, skipping the conversion to RGB")
+	flag.IntVar(&threads, "threads", runtime.NumCPU(), "number of frames to convert between RGB and YUV at once, or 1 to convert them one at a time")
+	flag.BoolVar(&deterministic, "deterministic", false, "convert to YUV with integer math and one frame at a time, so the same input encodes to the same bytes on any machine")
+	flag.IntVar(&maxFrameSize, "max-frame-size", 256, "refuse to read frames bigger than this many MiB, which is most likely a typo in -width or -height, or 0 for no limit")
+	flag.IntVar(&maxMemory, "max-memory", 4096, "refuse to decode videos that need more than this many MiB of memory, or 0 for no limit")
+	flag.BoolVar(&skipCorrupt, "skip-corrupt", false, "replace corrupt frames with the previous frame instead of failing")
+	flag.BoolVar(&tolerant, "tolerant", false, "if an encoded video ends partway through a frame, like when the encoder was killed, keep the frames before it instead of failing")
+	flag.StringVar(&logFormat, "log-format", "text", "format of the stats: text to log them as we go, or json to print them to stdout as a single JSON object at the end")
+	flag.StringVar(&dumpDeltas, "dump-deltas", "", "also write the uncompressed delta of every P-frame to this file")
+	flag.BoolVar(&histogram, "histogram", false, "print a histogram of the P-frame deltas instead of encoding")
+	flag.BoolVar(&verify, "verify", false, "compare the decoded video to the input and exit with status 1 if the PSNR is below -min-psnr")
+	flag.StringVar(&psnrCSV, "psnr-csv", "", "write the type, PSNR and SSIM of each decoded frame to this CSV file")
+	flag.StringVar(&psnrWeightList, "psnr-weights", "", "measure the PSNR for -verify and -psnr-csv in YUV instead of RGB, with these weights for Y, U and V, e.g. 6,1,1")
+	flag.Float64Var(&minPSNR, "min-psnr", 25, "minimum PSNR in dB for -verify and -selftest to pass")
+	flag.BoolVar(&selftest, "selftest", false, "encode and decode a generated clip instead of reading one, and check its PSNR")
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "write a CPU profile to this file, to be viewed with go tool pprof")
+	flag.StringVar(&memProfile, "memprofile", "", "write a heap profile to this file when done, to be viewed with go tool pprof")
 	flag.Parse()
 
-	frames := make([][]byte, 0)
+	// codec version prints what this build of the codec can decode, instead of encoding.
+	if flag.Arg(0) == "version" {
+		writeVersion(os.Stdout)
+		return
+	}
+
+	// The stats and what the decoder has to say about damaged streams go to logger, which the
+	// decoding functions take in their options rather than logging on their own.
+	logger := log.Default()
+
+	// codec diff a.bin b.bin decodes two encoded videos and compares them, instead of encoding.
+	if flag.Arg(0) == "diff" {
+		if flag.NArg() != 3 {
+			log.Fatal("usage: diff A B")
+		}
+		if err := diffFiles(os.Stdout, flag.Arg(1), flag.Arg(2), decodeOptions{tolerant: tolerant, logger: logger}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// To see where the time goes on your own footage, run with -cpuprofile cpu.prof and then
+	//
+	//   go tool pprof -http=:8080 cpu.prof
+	//
+	// -memprofile mem.prof does the same for allocations, with go tool pprof -sample_index=alloc_space.
+	stopProfiles, err := startProfiles(cpuProfile, memProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := stopProfiles(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if selftest {
+		quality, err := selfTest()
+		if err != nil {
+			log.Fatalf("self-test failed: %v", err)
+		}
+		if quality < minPSNR {
+			log.Fatalf("self-test failed: PSNR %0.2f dB is below -min-psnr %0.2f dB", quality, minPSNR)
+		}
+		log.Printf("self-test passed: PSNR %0.2f dB", quality)
+		return
+	}
+
+	// Getting the dimensions wrong turns the video into garbage, so rather than having to remember
+	// them, a video read with -input can keep them in a file next to it. Flags still win, in case
+	// the file is wrong.
+	var in io.Reader = os.Stdin
+	if strings.HasPrefix(input, "tcp://") {
+		// For live video, like from a capture card on another machine, the frames come in over
+		// the network instead. They're the same raw frames as on stdin, so the connection just
+		// takes its place. There's no file to keep the dimensions next to, so they're up to the
+		// flags.
+		addr := strings.TrimPrefix(input, "tcp://")
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Fatalf("can't read the video from %s: %v", input, err)
+		}
+		defer conn.Close()
+		in = conn
+	} else if input != "" {
+		f, err := os.Open(input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+
+		metaPath := input + ".meta"
+		meta, err := readSidecar(metaPath)
+		if err != nil {
+			log.Fatalf("invalid %s: %v", metaPath, err)
+		}
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		for _, key := range sidecarKeys {
+			value, ok := meta[key]
+			if !ok {
+				continue
+			}
+			if set[key] {
+				log.Printf("Warning: -%s overrides %s=%s in %s", key, key, value, metaPath)
+				continue
+			}
+			if err := flag.Set(key, value); err != nil {
+				log.Fatalf("invalid %s in %s: %v", key, metaPath, err)
+			}
+		}
+	}
+
+	// Most people have their frames as a folder of images rather than a raw video. With
+	// -input-glob, we read them one at a time as if they were one.
+	if inputGlob != "" {
+		if input != "" || segmentList != "" || inputFormat != "rgb24" {
+			log.Fatal("-input-glob can't be used with -input, -segments or -input-format")
+		}
+		seq, err := newImageSequence(inputGlob, alpha)
+		if err != nil {
+			log.Fatalf("invalid -input-glob: %v", err)
+		}
+		width, height = seq.width, seq.height
+		in = seq
+	}
+
+	// The framerate doesn't affect encoding at all, but we store it in the header so whoever
+	// plays the video back knows how fast to play it.
+	framerateNum, framerateDen, err := parseRatio(framerate)
+	if err != nil {
+		log.Fatalf("invalid -framerate: %v", err)
+	}
+
+	// Not every video has square pixels. DV and DVDs store widescreen video in the same number
+	// of pixels as 4:3 video, and rely on the player to stretch each pixel to the right shape.
+	// Like the framerate, we store the shape in the header for the player and leave the pixels
+	// alone.
+	parNum, parDen, err := parseRatio(pixelAspect)
+	if err != nil {
+		log.Fatalf("invalid -par: %v", err)
+	}
+
+	// With -temporal-factor N, we drop all but every Nth frame. That's the same as sampling the
+	// video N times less often, so it plays back at 1/N the framerate and takes just as long.
+	// It's the bluntest way to cut the bitrate, and you'll see motion get jerky pretty quickly.
+	if temporalFactor < 1 || temporalFactor > math.MaxUint16 {
+		log.Fatalf("invalid -temporal-factor %d: must be between 1 and %d", temporalFactor, math.MaxUint16)
+	}
+	switch {
+	case int(framerateNum)%temporalFactor == 0:
+		framerateNum /= uint16(temporalFactor)
+	case int(framerateDen)*temporalFactor <= math.MaxUint16:
+		framerateDen *= uint16(temporalFactor)
+	default:
+		log.Fatalf("invalid -temporal-factor %d: the framerate %d/%d divided by it doesn't fit in the header", temporalFactor, framerateNum, framerateDen)
+	}
+
+	if loop < 1 {
+		log.Fatalf("invalid -loop %d: must be at least 1", loop)
+	}
+	if deadlineMS < 0 {
+		log.Fatalf("invalid -deadline-ms %d: must not be negative", deadlineMS)
+	}
+	deadline := time.Duration(deadlineMS) * time.Millisecond
+	if checkpointInterval < 0 {
+		log.Fatalf("invalid -checkpoint %d: must not be negative", checkpointInterval)
+	}
+	if resume && checkpointInterval == 0 {
+		log.Fatal("-resume requires -checkpoint")
+	}
+	if checkpointInterval > 0 && (segmentList != "" || loop > 1 || twoPass || autoTuneLevel || deadline > 0) {
+		// These all decide how to encode a frame from frames before the checkpoint, or from how
+		// long it took, so resuming wouldn't come out the same.
+		log.Fatal("-checkpoint can't be used with -segments, -loop, -two-pass, -auto-level or -deadline-ms")
+	}
+	if resume && (verify || psnrCSV != "" || compareOut != "" || renditionList != "") {
+		// We only read the frames after the checkpoint, so these would only cover those.
+		log.Fatal("-resume can't be used with -verify, -psnr-csv, -compare-out or -renditions")
+	}
+	psnrWeights, err := parsePSNRWeights(psnrWeightList)
+	if err != nil {
+		log.Fatalf("invalid -psnr-weights: %v", err)
+	}
+	if psnrWeightList != "" && !verify && psnrCSV == "" {
+		log.Fatal("-psnr-weights requires -verify or -psnr-csv")
+	}
+	if previewScale < 1 {
+		log.Fatalf("invalid -preview-scale %d: must be at least 1", previewScale)
+	}
+
+	var keyframePredictor uint8
+	switch predictor {
+	case "none":
+		keyframePredictor = predictorNone
+	case "median":
+		keyframePredictor = predictorMedian
+	default:
+		log.Fatalf("invalid -predictor %q: must be none or median", predictor)
+	}
+
+	var temporalReference uint8
+	switch reference {
+	case "prev":
+		temporalReference = referencePrev
+	case "avg":
+		temporalReference = referenceAverage
+	default:
+		log.Fatalf("invalid -reference %q: must be prev or avg", reference)
+	}
+	if refDistance < 1 || refDistance > math.MaxUint8 {
+		log.Fatalf("invalid -ref-distance %d: must be between 1 and %d", refDistance, math.MaxUint8)
+	}
+	if refDistance > 1 && temporalReference != referencePrev {
+		log.Fatal("-ref-distance requires -reference prev")
+	}
+
+	frameCompression, ok := compressionIDs[compression]
+	if !ok {
+		log.Fatalf("invalid -compression %q: must be flate, gzip or zlib", compression)
+	}
+
+	var colorRange uint8
+	switch colorRangeName {
+	case "full":
+		colorRange = rangeFull
+	case "limited":
+		colorRange = rangeLimited
+	default:
+		log.Fatalf("invalid -range %q: must be full or limited", colorRangeName)
+	}
+
+	var yuvLayout uint8
+	switch layout {
+	case "planar":
+		yuvLayout = layoutPlanar
+	case "packed":
+		yuvLayout = layoutPacked
+	case "nv12":
+		yuvLayout = layoutNV12
+	default:
+		log.Fatalf("invalid -yuv-layout %q: must be planar, packed or nv12", layout)
+	}
+	if yuvLayout != layoutPlanar && keyframePredictor != predictorNone {
+		// The predictor works one plane at a time, so it needs the planes to be separate.
+		log.Fatal("-predictor requires -yuv-layout planar")
+	}
+	if yuvLayout != layoutPlanar && alpha {
+		log.Fatal("-alpha requires -yuv-layout planar")
+	}
+	if yuvLayout != layoutPlanar && interlaced {
+		log.Fatal("-interlaced requires -yuv-layout planar")
+	}
+	if yuvLayout != layoutPlanar && detectBars {
+		log.Fatal("-detect-letterbox requires -yuv-layout planar")
+	}
+	if detectBars && (alpha || interlaced) {
+		log.Fatal("-detect-letterbox can't be used with -alpha or -interlaced")
+	}
+
+	if level < flate.BestSpeed || level > flate.BestCompression {
+		log.Fatalf("invalid -level %d: must be from %d to %d", level, flate.BestSpeed, flate.BestCompression)
+	}
+	if autoLevelSlack < 0 {
+		log.Fatalf("invalid -auto-level-slack %g: must not be negative", autoLevelSlack)
+	}
+	if !validBlockSize(blockSize) {
+		log.Fatalf("invalid -block-size %d: must be a power of two from 4 to 128", blockSize)
+	}
+
+	if tileSize < 0 || tileSize%16 != 0 || tileSize > maxDimension {
+		log.Fatalf("invalid -tile-size %d: must be a multiple of 16 up to %d", tileSize, maxDimension)
+	}
+	if yuvLayout != layoutPlanar && tileSize > 0 {
+		log.Fatal("-tile-size requires -yuv-layout planar")
+	}
+	if dumpDeltas != "" && tileSize > 0 {
+		// Each tile has its own deltas, so there's no whole delta frame to write.
+		log.Fatal("-dump-deltas can't be used with -tile-size")
+	}
+	if inputFormat != "rgb24" && inputFormat != "yuv420p" {
+		log.Fatalf("invalid -input-format %q: must be rgb24 or yuv420p", inputFormat)
+	}
+	if inputFormat == "yuv420p" && (alpha || dither || linearDownsample || verify || psnrCSV != "" || compareJPEG || compareGIF || compareOut != "" || cropList != "" || previewScale > 1 || subsampling != "420") {
+		// These all need the RGB frames, or a different YUV format.
+		log.Fatal("-input-format yuv420p can't be used with -alpha, -dither, -linear-downsample, -verify, -psnr-csv, -compare-jpeg, -compare-gif, -compare-out, -crop, -preview-scale or -subsampling")
+	}
+	if rleEscape && rleVarint {
+		// The escaped encoding has counts of its own.
+		log.Fatal("-rle-escape can't be used with -rle-varint")
+	}
+	if readRate < 0 {
+		log.Fatalf("invalid -read-rate %v: must not be negative", readRate)
+	}
+	if threads < 1 {
+		log.Fatalf("invalid -threads %d: must be at least 1", threads)
+	}
+	if deterministic && (dither || linearDownsample || autoTuneLevel) {
+		// Dithering and linear light need floating point, and -auto-level picks a level by how
+		// fast it was.
+		log.Fatal("-deterministic can't be used with -dither, -linear-downsample or -auto-level")
+	}
+	if deterministic {
+		// Each frame already goes back where it came from however many threads there are, so
+		// this shouldn't change anything, but one at a time leaves no doubt.
+		threads = 1
+	}
+	if decodeFormat != "rgb" && decodeFormat != "yuv" {
+		log.Fatalf("invalid -decode-format %q: must be rgb or yuv", decodeFormat)
+	}
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatalf("invalid -log-format %q: must be text or json", logFormat)
+	}
+	if logFormat == "json" && histogram {
+		log.Fatal("-log-format json can't be used with -histogram")
+	}
+	if decodeFormat != "rgb" && (verify || psnrCSV != "" || compareOut != "") {
+		// We compare against the RGB input, so we need RGB output to compare.
+		log.Fatal("-verify, -psnr-csv and -compare-out require -decode-format rgb")
+	}
+	if lumaOnly && (verify || psnrCSV != "" || compareOut != "" || outputGlob != "" || decodeFormat != "rgb") {
+		log.Fatal("-luma-only can't be used with -verify, -psnr-csv, -compare-out, -output-glob or -decode-format")
+	}
+	if output != "" && !strings.HasPrefix(output, "tcp://") {
+		log.Fatalf("invalid -output %q: must be tcp://HOST:PORT", output)
+	}
+	if output != "" && (lumaOnly || decodeFormat != "rgb") {
+		// The viewer is sent the same frames as decoded.rgb24, which those don't make.
+		log.Fatal("-output can't be used with -luma-only or -decode-format yuv")
+	}
+	if outputGlob != "" && decodeFormat != "rgb" {
+		log.Fatal("-output-glob requires -decode-format rgb")
+	}
+	if outputGlob != "" && !strings.Contains(outputGlob, "%") {
+		log.Fatalf("invalid -output-glob %q: must have a verb like %%04d for the frame number", outputGlob)
+	}
+	if compareFrame < 0 {
+		log.Fatalf("invalid -compare-frame %d: must not be negative", compareFrame)
+	}
+
+	chromaSubsampling, ok := subsamplingIDs[subsampling]
+	if !ok {
+		log.Fatalf("invalid -subsampling %q: must be 420 or 411", subsampling)
+	}
+	if yuvLayout != layoutPlanar && chromaSubsampling != subsampling420 {
+		// YUYV has its own subsampling, which we build from the YUV420 planes.
+		log.Fatal("-subsampling 411 requires -yuv-layout planar")
+	}
+	if yuvLayout != layoutPlanar && blockSkip {
+		log.Fatal("-block-skip requires -yuv-layout planar")
+	}
+	if yuvLayout != layoutPlanar && exploitSymmetry {
+		log.Fatal("-exploit-symmetry requires -yuv-layout planar")
+	}
+	if mode != "fixed" && mode != "adaptive" {
+		log.Fatalf("invalid -mode %q: must be fixed or adaptive", mode)
+	}
+	if lumaQuant < 1 || lumaQuant > math.MaxUint8 {
+		log.Fatalf("invalid -luma-quant %d: must be between 1 and %d", lumaQuant, math.MaxUint8)
+	}
+	if yuvLayout != layoutPlanar && lumaQuant > 1 {
+		log.Fatal("-luma-quant requires -yuv-layout planar")
+	}
+	if targetSize < 0 {
+		log.Fatalf("invalid -target-size %d: must not be negative", targetSize)
+	}
+	if targetSize > 0 && (!twoPass || yuvLayout != layoutPlanar) {
+		// The target is hit by quantizing Y, which the first pass has to try out first.
+		log.Fatal("-target-size requires -two-pass and -yuv-layout planar")
+	}
+
+	// Each of the -renditions is encoded from the same frames we read, and only converted to YUV
+	// again if it has a different subsampling, so the same rules apply to its settings as to the
+	// flags.
+	primary := rendition{lumaQuant: lumaQuant, subsampling: chromaSubsampling}
+	renditions, err := parseRenditions(renditionList, primary)
+	if err != nil {
+		log.Fatalf("invalid -renditions: %v", err)
+	}
+	for _, r := range renditions {
+		if yuvLayout != layoutPlanar && (r.lumaQuant > 1 || r.subsampling != subsampling420) {
+			log.Fatalf("invalid -renditions: %s: luma-quant and subsampling 411 require -yuv-layout planar", r.name)
+		}
+		if inputFormat == "yuv420p" && r.subsampling != subsampling420 {
+			log.Fatalf("invalid -renditions: %s: -input-format yuv420p can't be used with subsampling", r.name)
+		}
+	}
+
+	// With -alpha, each pixel has a fourth byte saying how opaque it is.
+	bytesPerPixel := 3
+	if alpha {
+		bytesPerPixel = 4
+	}
+
+	// Most of the time, the video is a single clip with the dimensions given by -width and
+	// -height. If the input is several clips of different sizes spliced together, -segments
+	// describes where each one starts and ends.
+	segments := []*segment{{width: width, height: height, frameCount: maxFrames}}
+	if segmentList != "" {
+		if segments, err = parseSegments(segmentList); err != nil {
+			log.Fatalf("invalid -segments: %v", err)
+		}
+	}
+
+	// We're about to allocate a buffer for each frame, based on nothing but the dimensions we were
+	// given. An extra zero in -width would have us try to allocate gigabytes and crash, so we
+	// check the dimensions first.
+	for _, seg := range segments {
+		if err := checkFrameSize(seg.width, seg.height, bytesPerPixel, maxFrameSize<<20); err != nil {
+			log.Fatalf("invalid frame size: %v", err)
+		}
+	}
+
+	// With -crop, we cut the region out of each frame as soon as we read it, and from then on, it's
+	// as if the video had been that size all along.
+	var crop image.Rectangle
+	if cropList != "" {
+		if crop, err = parseCrop(cropList); err != nil {
+			log.Fatalf("invalid -crop: %v", err)
+		}
+		for _, seg := range segments {
+			if !crop.In(image.Rect(0, 0, seg.width, seg.height)) {
+				log.Fatalf("invalid -crop: %v doesn't fit in a %dx%d frame", crop, seg.width, seg.height)
+			}
+		}
+	}
+
+	// A long encode that gets killed partway through has to start over from the beginning, unless
+	// it was run with -checkpoint. Then encoded.bin holds every segment up to the last checkpoint,
+	// and with -resume, we keep those, skip the frames they hold, and carry on from there. Each
+	// checkpoint starts a new segment, and the segments after it only depend on the frames after
+	// it, so the result is the same as if the encode had never stopped.
+	var resumed []byte
+	if resume {
+		cp, err := readCheckpoint(checkpointPath)
+		if err != nil {
+			log.Fatalf("can't resume: %v", err)
+		}
+		if cp.Interval != checkpointInterval {
+			log.Fatalf("can't resume: the checkpoint was made with -checkpoint %d, not %d", cp.Interval, checkpointInterval)
+		}
+		encoded, err := os.ReadFile("encoded.bin")
+		if err != nil {
+			log.Fatalf("can't resume: %v", err)
+		}
+		if int64(len(encoded)) < cp.Offset {
+			log.Fatalf("can't resume: encoded.bin is %d bytes, but the checkpoint is at byte %d", len(encoded), cp.Offset)
+		}
+		resumed = encoded[:cp.Offset]
+
+		seg := segments[0]
+		frameSize := seg.width * seg.height * bytesPerPixel
+		if inputFormat == "yuv420p" {
+			frameSize = seg.width * seg.height * 3 / 2
+		}
+		if err := skipInput(in, int64(cp.Frame)*int64(temporalFactor)*int64(frameSize)); err != nil {
+			log.Fatalf("can't resume: skip to frame %d: %v", cp.Frame, err)
+		}
+		seg.first = cp.Frame
+		log.Printf("Resuming from frame %d, %d bytes into encoded.bin", cp.Frame, cp.Offset)
+	}
+
+	// Encoding a long video takes a while. If it gets interrupted with Ctrl-C, we stop reading or
+	// encoding frames, whichever we're doing, and finish up with the frames we have so far, so the
+	// output is still a valid video, just a shorter one. Pressing Ctrl-C a second time exits
+	// immediately.
+	var interrupted atomic.Bool
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	go func() {
+		<-sigint
+		log.Printf("Interrupted, finishing up with the frames so far")
+		interrupted.Store(true)
+		signal.Stop(sigint)
+	}()
+
+	// When the input is a live source, reading it as fast as we can would starve whatever is
+	// producing it. With -read-rate, we wait for a tick before reading each frame.
+	var tick <-chan time.Time
+	if readRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / readRate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// With -output, we start listening for a viewer before we've read a single frame, so it can
+	// connect while we're still encoding. Whoever connects first gets the video. See below.
+	var viewerListener net.Listener
+	var viewers chan net.Conn
+	if output != "" {
+		ln, err := net.Listen("tcp", strings.TrimPrefix(output, "tcp://"))
+		if err != nil {
+			log.Fatalf("can't stream the video to %s: %v", output, err)
+		}
+		log.Printf("Streaming the decoded video to the first viewer to connect to %s", ln.Addr())
+		viewerListener = ln
+		viewers = make(chan net.Conn, 1)
+		go func() {
+			defer close(viewers)
+			if conn, err := ln.Accept(); err == nil {
+				viewers <- conn
+			}
+		}()
+	}
+
+	for _, seg := range segments {
+		// The frame counts are of the frames in the input, including the ones -temporal-factor drops.
+		for read := seg.first * temporalFactor; (seg.frameCount == 0 || read < seg.frameCount) && !interrupted.Load(); read++ {
+			if tick != nil {
+				<-tick
+			}
+
+			// Read raw video frames from stdin. In rgb24 format, each pixel (r, g, b) is one byte
+			// so the total size of the frame is width * height * 3.
+
+			frameSize := seg.width * seg.height * bytesPerPixel
+			if inputFormat == "yuv420p" {
+				// If the input is already YUV420, we can skip ahead a few steps. See below.
+				if seg.width%2 != 0 || seg.height%2 != 0 {
+					log.Fatalf("yuv420p input must have even dimensions, not %dx%d", seg.width, seg.height)
+				}
+				frameSize = seg.width * seg.height * 3 / 2
+			}
+			frame := make([]byte, frameSize)
+
+			// read the frame from stdin
+			//
+			// When the input is a TCP connection, the sender closing it is the end of the video,
+			// just like the end of a file. If the connection breaks instead, say because the
+			// sender crashed, the frames we already have still make a perfectly good video, so
+			// we finish up with those like we do on Ctrl-C.
+			var opErr *net.OpError
+			if _, err := io.ReadFull(in, frame); err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if errors.As(err, &opErr) {
+				log.Printf("Lost the connection to %s: %v, finishing up with the frames read so far", input, err)
+				break
+			} else if err != nil {
+				log.Fatal(err)
+			}
+			if read%temporalFactor != 0 {
+				continue
+			}
+			if cropList != "" {
+				frame = cropRegion(frame, seg.width, bytesPerPixel, crop)
+			}
+
+			// -preview-scale shrinks what's left, so the rest of the encoder has less to do.
+			if previewScale > 1 {
+				w, h := seg.width, seg.height
+				if cropList != "" {
+					w, h = crop.Dx(), crop.Dy()
+				}
+				frame = downscale(frame, w, h, bytesPerPixel, previewScale)
+			}
+
+			seg.frames = append(seg.frames, frame)
+		}
+		if cropList != "" {
+			seg.width, seg.height = crop.Dx(), crop.Dy()
+		}
+		seg.width = (seg.width + previewScale - 1) / previewScale
+		seg.height = (seg.height + previewScale - 1) / previewScale
+
+		// With -loop N, we play the clip N times over, which is handy for making a long test video
+		// out of a short one. The repeats share the frames we read rather than copying them.
+		if loop > 1 && len(seg.frames) > 0 {
+			seg.loopLength = len(seg.frames)
+			for i := 1; i < loop; i++ {
+				seg.frames = append(seg.frames, seg.frames[:seg.loopLength]...)
+			}
+		}
+
+		// With -verify, -psnr-csv or -compare-out, hold on to the original frames so we can
+		// compare the decoded video to them at the end.
+		if verify || psnrCSV != "" || compareOut != "" {
+			seg.original = append([][]byte(nil), seg.frames...)
+		}
+	}
+
+	// If we were interrupted while reading, we still encode the frames we read, but leave out the
+	// segments we never got to. Since Ctrl-C only finishes up once, encoding them can't be
+	// interrupted again, other than by exiting.
+	readInterrupted := interrupted.Load()
+	if readInterrupted {
+		for len(segments) > 1 && len(segments[len(segments)-1].frames) == 0 {
+			segments = segments[:len(segments)-1]
+		}
+	}
+
+	// Now we have our raw video, using a truly ridiculous amount of memory!
+	//
+	// As we go, we'll record the size of the video after each stage in stats. Analyze does the
+	// same thing without all the commentary if you just want the numbers.
+
+	var stats Stats
+	stats.RawSize = segmentsSize(segments)
+
+	// The sizes are easy to read in the log, but not for a script. With -log-format json, we
+	// keep them out of the log and print all of stats as JSON once we're done instead.
+	statf := logger.Printf
+	if logFormat == "json" {
+		statf = func(string, ...interface{}) {}
+		defer func() {
+			if err := json.NewEncoder(os.Stdout).Encode(stats); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	statf("Raw size: %d bytes", stats.RawSize)
+
+	// Before we throw away the RGB frames, we'll JPEG encode each one on its own if asked so we
+	// have something to compare our encoder to later.
+	var jpegSize int
+	if compareJPEG {
+		for _, seg := range segments {
+			for _, frame := range seg.frames {
+				n, err := jpegFrameSize(frame, seg.width, seg.height, bytesPerPixel, jpegQuality)
+				if err != nil {
+					log.Fatal(err)
+				}
+				jpegSize += n
+			}
+		}
+	}
+
+	// GIF is the other way to put an animation in a file that everything can play, so with
+	// -compare-gif, we see how it does too. See gifSize.
+	var gifTotal int
+	if compareGIF {
+		delay := int(math.Round(100 * float64(framerateDen) / float64(framerateNum)))
+		for _, seg := range segments {
+			n, err := gifSize(seg.frames, seg.width, seg.height, bytesPerPixel, delay)
+			if err != nil {
+				log.Fatal(err)
+			}
+			gifTotal += n
+		}
+	}
+
+	start := time.Now()
+	for _, seg := range segments {
+		// Since pixels share their U and V samples with their neighbors, the dimensions have to
+		// be even (or a multiple of 4 across, with -subsampling 411). Rather than deal with
+		// pixels that have only some of their neighbors, we pad odd sized frames by repeating
+		// the last row and column, and crop them back to size after decoding.
+		codedWidth, codedHeight := paddedSize(seg.width, seg.height, chromaSubsampling)
+
+		// -renditions with a different subsampling need frames of their own. Reading the video
+		// again would be the slow part, so we convert each frame we read to all of them at once.
+		for _, r := range renditions {
+			if r.subsampling == chromaSubsampling || seg.subsampled[r.subsampling] != nil {
+				continue
+			}
+			if seg.subsampled == nil {
+				seg.subsampled = make(map[uint8][][]byte)
+			}
+			seg.subsampled[r.subsampling] = make([][]byte, len(seg.frames))
+		}
+
+		// Each frame is converted on its own, so we can convert several of them at once.
+		parallelFor(len(seg.frames), threads, func(i int) {
+			// First, we will convert each frame to YUV420 format. Head over to convertToYUV to see
+			// how that works. If the frames are already in YUV420, there's nothing to do, and we
+			// don't lose any color to converting them either.
+			if inputFormat == "rgb24" {
+				for sub, frames := range seg.subsampled {
+					w, h := paddedSize(seg.width, seg.height, sub)
+					frame := padFrame(seg.frames[i], seg.width, seg.height, w, h, bytesPerPixel)
+					frames[i] = convertToYUV(frame, w, h, yuvOptions{dither: dither, linear: linearDownsample, alpha: alpha, subsampling: sub, colorRange: colorRange, integer: deterministic})
+				}
+				frame := padFrame(seg.frames[i], seg.width, seg.height, codedWidth, codedHeight, bytesPerPixel)
+				seg.frames[i] = convertToYUV(frame, codedWidth, codedHeight, yuvOptions{dither: dither, linear: linearDownsample, alpha: alpha, subsampling: chromaSubsampling, colorRange: colorRange, integer: deterministic})
+			}
+
+			// Some tools expect the pixels to be packed together instead, and hardware decoders
+			// and capture devices mostly use NV12. We'll see in a moment why we prefer planar, but
+			// for those, we can rearrange the frame as well.
+			seg.frames[i] = packFrame(seg.frames[i], yuvLayout, codedWidth, codedHeight)
+		})
+	}
+
+	stats.YUVTime = time.Since(start)
+
+	// Now we have our YUV-encoded video, which takes half the space!
+
+	stats.YUVSize = segmentsSize(segments)
+	stats.YUVRatio = ratio(stats.YUVSize, stats.RawSize)
+	yuvFormat := layoutNames[yuvLayout]
+	if yuvLayout == layoutPlanar {
+		yuvFormat = "YUV" + subsampling + "P"
+		if alpha {
+			yuvFormat = "YUVA" + subsampling + "P"
+		}
+	}
+	statf("%s size: %d bytes (%0.2f%% original size)", yuvFormat, stats.YUVSize, 100*stats.YUVRatio)
+
+	// A film is usually wider than the video it's delivered in, so it's letterboxed, with black
+	// bars filling the rows above and below the picture. The bars are the same in every frame, so
+	// coding them over and over is a waste, even if DEFLATE makes each one cheap. With
+	// -detect-letterbox, we look for rows and columns at the edges that are one solid color all
+	// the way through each segment. The header records how thick they are and their color, the
+	// frames only store the picture between them, and the decoder paints them back in. See
+	// detectLetterbox.
+	if detectBars {
+		for s, seg := range segments {
+			codedWidth, codedHeight := paddedSize(seg.width, seg.height, chromaSubsampling)
+			seg.letterboxes = map[uint8]letterbox{
+				chromaSubsampling: detectLetterbox(seg.frames, header{Width: uint32(codedWidth), Height: uint32(codedHeight), Subsampling: chromaSubsampling}),
+			}
+			for sub, frames := range seg.subsampled {
+				w, h := paddedSize(seg.width, seg.height, sub)
+				seg.letterboxes[sub] = detectLetterbox(frames, header{Width: uint32(w), Height: uint32(h), Subsampling: sub})
+			}
+			lb := seg.letterboxes[chromaSubsampling]
+			if lb == (letterbox{}) {
+				statf("Segment %d letterbox: no bars found", s)
+				continue
+			}
+			statf("Segment %d letterbox: %d rows top, %d bottom, %d columns left, %d right, color Y %d U %d V %d",
+				s, lb.top, lb.bottom, lb.left, lb.right, lb.y, lb.u, lb.v)
+		}
+	}
+
+	// It's one thing to read about Y and chroma, and another to see them. With -dump-planes, we
+	// write each plane of a frame to an image of its own. Y looks like a black and white photo,
+	// while U and V are smaller, blurry, and mostly gray, since most of the picture isn't very
+	// colorful. See writePlanes.
+	if dumpPlanesDir != "" {
+		var frameCount int
+		for _, seg := range segments {
+			frameCount += len(seg.frames)
+		}
+		if compareFrame >= frameCount {
+			log.Fatalf("invalid -compare-frame %d: only %d frames were read", compareFrame, frameCount)
+		}
+		i := compareFrame
+		for _, seg := range segments {
+			if i >= len(seg.frames) {
+				i -= len(seg.frames)
+				continue
+			}
+			codedWidth, codedHeight := paddedSize(seg.width, seg.height, chromaSubsampling)
+			hdr := header{Width: uint32(codedWidth), Height: uint32(codedHeight), Layout: yuvLayout, Subsampling: chromaSubsampling, Alpha: alpha}
+			if err := writePlanes(dumpPlanesDir, seg.frames[i], hdr); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+	}
+
+	// Everything so far has been lossless apart from the chroma, and the rest of the encoder is
+	// too. -luma-quant is our first taste of throwing information away on purpose, so it's
+	// worth seeing what it costs. The encoder does the quantizing, but we do it here as well to
+	// measure how far the Y values move.
+	if lumaQuant > 1 {
+		var squaredErr float64
+		var samples int
+		var seen [256]bool
+		for _, seg := range segments {
+			codedWidth, codedHeight := paddedSize(seg.width, seg.height, chromaSubsampling)
+			for _, frame := range seg.frames {
+				y := frame[:codedWidth*codedHeight]
+				quantized := append([]byte(nil), y...)
+				quantizeLuma(quantized, lumaQuant)
+				dequantizeLuma(quantized, lumaQuant)
+				squaredErr += squaredError(y, quantized)
+				samples += len(y)
+				for _, v := range quantized {
+					seen[v] = true
+				}
+			}
+		}
+		var distinct int
+		for _, ok := range seen {
+			if ok {
+				distinct++
+			}
+		}
+		statf("Luma quantization: step %d, %d distinct Y values, Y PSNR %0.2f dB", lumaQuant, distinct, psnr(squaredErr/float64(samples)))
+	}
+
+	// Before we go any further, with -histogram we can take a look at what the deltas between
+	// frames actually look like. This is what the rest of the encoder is betting on, so it's
+	// worth seeing for yourself how many of them are zero.
+	if histogram {
+		var counts [256]int
+		for _, seg := range segments {
+			deltaHistogram(&counts, seg.frames, keyframeInterval, zigzag)
+		}
+		printHistogram(os.Stderr, &counts, zigzag)
+		return
+	}
+
+	// We can also write this out to a file, which can be played with ffplay:
+	//
+	//   ffplay -f rawvideo -pixel_format yuv420p -video_size 384x216 -framerate 25 encoded.yuv
+	//
+	// or with -pixel_format yuyv422 if the frames are packed, nv12 if they're NV12, yuv411p with -subsampling 411, or
+	// yuva420p if they have alpha.
+	//
+	// On a long video, it can take up gigabytes, so with -gzip-yuv, we write encoded.yuv.gz
+	// instead. ffplay can't read that directly, but it can read it from gunzip -c encoded.yuv.gz
+	// if you pass it - instead of encoded.yuv.
+
+	var yuv [][]byte
+	for _, seg := range segments {
+		yuv = append(yuv, seg.frames...)
+	}
+	yuvName := "encoded.yuv"
+	if gzipYUV {
+		yuvName += ".gz"
+	}
+	if err := writeFrames(yuvName, yuv, gzipYUV); err != nil {
+		log.Fatal(err)
+	}
+
+	// Next, we will take advantage of the similarity between frames. runLengthEncodeFrames walks
+	// through how.
+	//
+	// The run length encoded frames are only here to show what the deltas buy us. The encoder
+	// below starts over from the YUV frames, so on a long video, -skip-rle-stats saves the time
+	// and memory of encoding them just to throw them away.
+
+	if !skipRLEStats {
+		start = time.Now()
+		for _, seg := range segments {
+			stats.RLESize += size(runLengthEncodeFrames(seg.frames, rleOptions{escape: rleEscape, zigzag: zigzag, varint: rleVarint}))
+		}
+		stats.RLETime = time.Since(start)
+		stats.RLERatio = ratio(stats.RLESize, stats.RawSize)
+		statf("RLE size: %d bytes (%0.2f%% original size)", stats.RLESize, 100*stats.RLERatio)
+	}
+
+	// This is good, we're at 1/4 the size of the original video. But we can do better.
+	// Note that most of our longest runs are runs of zeros. This is because the delta
+	// between frames is usually small. We have a bit of flexibility in choice of algorithm
+	// here, so to keep the encoder simple, we will defer to using the DEFLATE algorithm
+	// which is available in the standard library. The implementation is beyond the scope
+	// of this demonstration.
+	//
+	// Before the compressed frames, we write a small header describing the video. Without it,
+	// the decoder would have to be told the dimensions separately and would have no way of
+	// knowing how many frames to expect. Each segment gets its own header, so the decoder can
+	// simply keep reading segments until it runs out of data.
+
+	// With -two-pass, we don't just make the first frame a keyframe. We go over the whole video
+	// first to find the frames that would be cheaper to store as keyframes, like the first frame
+	// after a cut, and then encode it for real. planKeyframes walks through how.
+	keyframePlans := make([][]bool, len(segments))
+	if twoPass {
+		var planned int
+		for i, seg := range segments {
+			keyframePlans[i] = planKeyframes(seg.frames)
+			for _, keyframe := range keyframePlans[i] {
+				if keyframe {
+					planned++
+				}
+			}
+		}
+		statf("Two-pass: planned %d keyframes", planned)
+	}
+
+	// newEncoder returns an Encoder for seg with the options we were given, and the quality and
+	// subsampling of r.
+	newEncoder := func(seg *segment, zigzag bool, r rendition, stats *Stats) *Encoder {
+		codedWidth, codedHeight := paddedSize(seg.width, seg.height, r.subsampling)
+		lb := seg.letterboxes[r.subsampling]
+		enc, err := NewEncoder(header{
+			Width:        uint32(codedWidth),
+			Height:       uint32(codedHeight),
+			PadRight:     uint8(codedWidth - seg.width),
+			PadBottom:    uint8(codedHeight - seg.height),
+			FramerateNum: framerateNum,
+			FramerateDen: framerateDen,
+			ParNum:       parNum,
+			ParDen:       parDen,
+			Predictor:    keyframePredictor,
+			Layout:       yuvLayout,
+			Subsampling:  r.subsampling,
+			Alpha:        alpha,
+			BlockSkip:    blockSkip,
+			BlockSize:    uint8(blockSize),
+			Symmetry:     exploitSymmetry,
+			ZigZag:       zigzag,
+			Reference:    temporalReference,
+			RefDistance:  uint8(refDistance),
+			Range:        colorRange,
+			Compression:  frameCompression,
+			LumaStep:     uint8(r.lumaQuant),
+			TileSize:     uint16(tileSize),
+			Interlaced:   interlaced,
+			Repeats:      repeatFrames,
+			BarTop:       lb.top,
+			BarBottom:    lb.bottom,
+			BarLeft:      lb.left,
+			BarRight:     lb.right,
+			BarY:         lb.y,
+			BarU:         lb.u,
+			BarV:         lb.v,
+		}, stats)
+		if err != nil {
+			log.Fatal(err)
+		}
+		enc.StoreOnExpand = storeOnExpand
+		enc.Adaptive = mode == "adaptive"
+		enc.Threads = threads
+		enc.Level = r.level
+		return enc
+	}
+
+	// So far, only the first frame has been a keyframe. In the real world, keyframes are
+	// inserted periodically so that viewers can start watching partway through and so
+	// that errors don't carry on forever. We can do the same with -keyframe-interval.
+	//
+	// Where one loop ends and the next begins, the video jumps from the last frame back to
+	// the first. That's a cut like any other, and a delta across a cut costs about as much
+	// as a keyframe anyway, so each loop starts with one. That way, each loop can also be
+	// decoded without the ones before it.
+	wantKeyframe := func(s, i int) bool {
+		seg := segments[s]
+		return keyframeInterval > 0 && (seg.first+i)%keyframeInterval == 0 || keyframePlans[s] != nil && keyframePlans[s][i] || seg.loopLength > 0 && i%seg.loopLength == 0
+	}
+
+	// Which DEFLATE level is best depends on the video and on how long you're willing to wait.
+	// With -auto-level, we find out by encoding the first GOP at every level and timing it, and
+	// then use the fastest level that comes within -auto-level-slack of the smallest size.
+	// Higher levels search harder for matches, but past a point, they mostly find the same ones
+	// more slowly. See autoLevel.
+	if autoTuneLevel && len(segments) > 0 && len(segments[0].frames) > 0 {
+		// The first GOP runs up to the next keyframe, but without keyframes, that would be the
+		// whole segment, so we stop after a second of video.
+		seg := segments[0]
+		n := 1
+		for n < len(seg.frames) && n < int(framerateNum)/int(framerateDen) && !wantKeyframe(0, n) {
+			n++
+		}
+		var err error
+		level, err = autoLevel(func(level int) (int, error) {
+			r := primary
+			r.level = level
+			enc := newEncoder(seg, zigzag, r, &Stats{})
+			for i, frame := range seg.frames[:n] {
+				if wantKeyframe(0, i) {
+					enc.RequestKeyframe()
+				}
+				if err := enc.WriteFrame(frame); err != nil {
+					return 0, err
+				}
+			}
+			compressed, err := enc.Close()
+			return len(compressed), err
+		}, autoLevelSlack/100, statf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statf("Auto level: using level %d, measured on the first %d frames", level, n)
+	}
+
+	// encode encodes every segment as r, starting from the frames converted with its subsampling.
+	//
+	// With a budget, it also keeps an eye on the clock. For a live source, frames keep coming at
+	// the framerate whether or not we're done with the last one, so an encoder that falls behind
+	// has to start cutting corners to catch up. Whenever we're more than a frame's budget behind,
+	// we lower the effort a step: first we stop trying keyframes with -mode adaptive, which
+	// compresses every frame twice, then we lower the DEFLATE level, and as a last resort, we
+	// quantize Y more coarsely, which gives DEFLATE less to do. The level and quantization are in
+	// the header, so to change those, we end the segment and start a new one, which decodes like
+	// a spliced clip would.
+	//
+	// Past a luma step of maxDeadlineLumaQuant, the banding gets bad enough that a late video is
+	// the lesser evil.
+	//
+	// With checkpoints, it also ends the segment every -checkpoint frames and appends it to
+	// encoded.bin as it goes, so that an encode that gets killed can be resumed. See
+	// saveCheckpoint.
+	const maxDeadlineLumaQuant = 8
+	encode := func(r rendition, zigzag bool, budget time.Duration, checkpoints bool, stats *Stats, deltas io.Writer) []byte {
+		if r.level == 0 {
+			r.level = level
+		}
+		adaptive := mode == "adaptive"
+		var deflated []byte
+		var reduced, total, saved int
+		for s, seg := range segments {
+			if interrupted.Load() && !readInterrupted {
+				break
+			}
+			frames := seg.frames
+			if r.subsampling != chromaSubsampling {
+				frames = seg.subsampled[r.subsampling]
+			}
+			var enc *Encoder
+			start := func() {
+				enc = newEncoder(seg, zigzag, r, stats)
+				enc.Adaptive = adaptive
+				if deltas != nil {
+					enc.OnDelta = func(idx int, delta []byte) {
+						if _, err := deltas.Write(delta); err != nil {
+							log.Fatal(err)
+						}
+					}
+				}
+			}
+			finish := func() {
+				compressed, err := enc.Close()
+				if err != nil {
+					log.Fatal(err)
+				}
+				deflated = append(deflated, compressed...)
+			}
+			start()
+			var behind time.Duration
+			for i, frame := range frames {
+				if interrupted.Load() && !readInterrupted {
+					break
+				}
+				if checkpoints && i > 0 && (seg.first+i)%checkpointInterval == 0 {
+					finish()
+					if err := saveCheckpoint(checkpointPath, "encoded.bin", deflated[saved:], checkpoint{Interval: checkpointInterval, Frame: seg.first + i}); err != nil {
+						log.Fatal(err)
+					}
+					saved = len(deflated)
+					start()
+				}
+				if wantKeyframe(s, i) {
+					enc.RequestKeyframe()
+				}
+				began := time.Now()
+				if err := enc.WriteFrame(frame); err != nil {
+					log.Fatal(err)
+				}
+				if budget == 0 {
+					continue
+				}
+				total++
+				if adaptive != (mode == "adaptive") || r.level != level || r.lumaQuant != lumaQuant {
+					reduced++
+				}
+
+				// Finishing a frame early doesn't help with the next one, since it hasn't arrived
+				// yet, so we only keep track of how far behind we are.
+				behind += time.Since(began) - budget
+				if behind < 0 {
+					behind = 0
+				}
+				if behind <= budget {
+					continue
+				}
+				switch {
+				case adaptive:
+					adaptive = false
+					enc.Adaptive = false
+					log.Printf("Deadline: %v behind at frame %d, no longer trying each frame as a keyframe", behind.Round(time.Millisecond), i)
+				case r.level > flate.BestSpeed || yuvLayout == layoutPlanar && r.lumaQuant < maxDeadlineLumaQuant:
+					if r.level > flate.BestSpeed {
+						r.level = (r.level - 1) / 3 * 3
+						if r.level < flate.BestSpeed {
+							r.level = flate.BestSpeed
+						}
+					} else {
+						r.lumaQuant *= 2
+					}
+					log.Printf("Deadline: %v behind at frame %d, starting a new segment at level %d with a luma step of %d", behind.Round(time.Millisecond), i, r.level, r.lumaQuant)
+					finish()
+					start()
+				default:
+					log.Printf("Deadline: %v behind at frame %d, but already at the lowest effort", behind.Round(time.Millisecond), i)
+				}
+				behind = 0
+			}
+			finish()
+		}
+		if reduced > 0 {
+			log.Printf("Deadline: %d of %d frames encoded at reduced effort", reduced, total)
+		}
+		return deflated
+	}
+	// The deltas are what all of this has been about, and -dump-deltas lets us look at them. Viewed
+	// as a grayscale video, anything that didn't move is black, and moving edges light up. Small
+	// changes toward darker wrap around to bright values though, unless they're zig-zag encoded.
+	// Each plane is stacked under the one before it, so on a planar YUV420 video, the frames are
+	// half again as tall:
+	//
+	//   ffplay -f rawvideo -pixel_format gray -video_size 384x324 -framerate 25 deltas.gray
+	//
+	// Keyframes don't have a delta, so they're left out.
+	var deltas io.Writer
+	if dumpDeltas != "" {
+		f, err := os.Create(dumpDeltas)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		deltas = f
+	}
+
+	// With -checkpoint, encoded.bin is written a segment at a time as we go, after the segments we
+	// resumed from, if any.
+	if checkpointInterval > 0 {
+		if err := os.WriteFile("encoded.bin", resumed, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// With -target-size, the first pass also decides how coarsely to quantize Y. The keyframes are
+	// already planned, so we encode the video at a few luma steps to find the finest one that fits,
+	// and the second pass uses it. See fitLumaStep.
+	if twoPass && targetSize > 0 {
+		coarsest := maxTargetLumaQuant
+		if lumaQuant > coarsest {
+			coarsest = lumaQuant
+		}
+		step, err := fitLumaStep(func(step int) (int, error) {
+			r := primary
+			r.lumaQuant = step
+			return len(encode(r, zigzag, 0, false, &Stats{}, nil)), nil
+		}, targetSize, lumaQuant, coarsest, statf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		statf("Two-pass: using a luma step of %d for a target of %d bytes", step, targetSize)
+		primary.lumaQuant, lumaQuant = step, step
+	}
+
+	start = time.Now()
+	deflated := encode(primary, zigzag, deadline, checkpointInterval > 0, &stats, deltas)
+	stats.DeflateTime = time.Since(start)
+
+	stats.DeflateSize = len(deflated)
+	stats.DeflateRatio = ratio(stats.DeflateSize, stats.RawSize)
+	statf("DEFLATE size: %d bytes (%0.2f%% original size)", stats.DeflateSize, 100*stats.DeflateRatio)
+
+	// This is our encoded video. We'll decode it in a moment, but we also write it out so it can
+	// be decoded or compared later. See diffFiles.
+	//
+	// If we resumed from a checkpoint, the video starts with the segments from before it. Once
+	// the whole video is written, there's nothing left to resume, unless we were interrupted.
+	deflated = append(resumed, deflated...)
+	if err := os.WriteFile("encoded.bin", deflated, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if checkpointInterval > 0 && !interrupted.Load() {
+		if err := os.Remove(checkpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatal(err)
+		}
+	}
+	if twoPass && targetSize > 0 {
+		// The steps only go up to maxTargetLumaQuant, so a small enough target can still be
+		// missed, which is worth knowing.
+		statf("Two-pass: %d bytes vs target of %d bytes (%+0.2f%%)", stats.DeflateSize, targetSize, 100*(ratio(stats.DeflateSize, targetSize)-1))
+	}
+	if stats.DeflateSize > stats.YUVSize {
+		log.Printf("Warning: the compressed video is bigger than the %s video. Try -store-on-expand.", yuvFormat)
+	}
+
+	// Whether zig-zag encoding helps depends on the footage, so with -zigzag, we encode the video
+	// a second time without it to compare.
+	if zigzag {
+		var plain Stats
+		n := len(encode(primary, false, 0, false, &plain, nil))
+		statf("DEFLATE size without -zigzag: %d bytes (%0.2f%% original size)", n, 100*ratio(n, stats.RawSize))
+	}
+
+	// For adaptive streaming, a player switches between several versions of the same video as
+	// its bandwidth changes. With -renditions, we encode each of them from the frames we already
+	// have in memory and write it to encoded-NAME.bin, which decodes like encoded.bin does.
+	for _, r := range renditions {
+		encoded := encode(r, zigzag, 0, false, &Stats{}, nil)
+		name := "encoded-" + r.name + ".bin"
+		if err := os.WriteFile(name, encoded, 0644); err != nil {
+			log.Fatal(err)
+		}
+		if stats.RenditionSizes == nil {
+			stats.RenditionSizes = make(map[string]int)
+		}
+		stats.RenditionSizes[r.name] = len(encoded)
+		statf("Rendition %s: %d bytes (%0.2f%% original size) in %s", r.name, len(encoded), 100*ratio(len(encoded), stats.RawSize), name)
+	}
+
+	// Let's see where those bytes went. Keyframes store the whole frame, so a single keyframe
+	// costs many times more than a P-frame. This is why real encoders keep keyframes sparse.
+
+	statf("Keyframes: %d frames, %d bytes (%d bytes/frame)", stats.KeyframeCount, stats.KeyframeSize, average(stats.KeyframeSize, stats.KeyframeCount))
+	statf("P-frames: %d frames, %d bytes (%d bytes/frame)", stats.PframeCount, stats.PframeSize, average(stats.PframeSize, stats.PframeCount))
+	if stats.SolidCount > 0 {
+		statf("Solid frames: %d frames, %d bytes (%d bytes/frame)", stats.SolidCount, stats.SolidSize, average(stats.SolidSize, stats.SolidCount))
+	}
+	if stats.RepeatCount > 0 {
+		statf("Repeated frames: %d frames, %d bytes", stats.RepeatCount, stats.RepeatSize)
+	}
+	if exploitSymmetry {
+		statf("Mirrored planes: %d in %d keyframes", stats.MirroredPlanes, stats.KeyframeCount)
+	}
+	if blockSkip {
+		statf("Skipped blocks: %d of %d (%0.2f%%)", stats.SkippedBlocks, stats.Blocks, 100*ratio(stats.SkippedBlocks, stats.Blocks))
+	}
+
+	// You'll note that the DEFLATE step takes quite a while to run. In general, encoders tend to run
+	// much slower than decoders. This is true for most compression algorithms, not just video codecs.
+	// This is because the encoder needs to do a lot of work to analyze the data and make decisions
+	// about how to compress it. The decoder, on the other hand, is just a simple loop that reads the
+	// data and does the opposite of the encoder.
+	//
+	// At this point, we've achieved a 90% compression ratio!
+	//
+	// As an aside, you might be thinking that typical JPEG compression is 90%, so why not JPEG encode
+	// every frame? While true, the algorithm we have supplied above is quite a bit simpler than JPEG.
+	// We demonstrate that taking advantage of temporal locality can yield compression ratios just as
+	// high as JPEG, but with a much simpler algorithm. Run with -compare-jpeg to see for yourself.
+	// An animated GIF takes advantage of temporal locality too, but pays for it in color, which
+	// -compare-gif lets you compare as well.
+	//
+	// Additionally, the DEFLATE algorithm does not take advantage of the two dimensionality of the data
+	// and is therefore not as efficient as it could be. In the real world, video codecs are much more
+	// complex than the one we have implemented here. They take advantage of the two dimensionality of
+	// the data, they use more sophisticated algorithms, and they are optimized for the hardware they
+	// run on. For example, the H.264 codec is implemented in hardware on many modern GPUs.
+	//
+	// Now we have our encoded video. Let's decode it and see what we get. decodeSegment walks
+	// through decoding a single segment, and we keep going until we've read every segment.
+
+	if compareJPEG {
+		statf("JPEG size: %d bytes (%0.2f%% original size) vs DEFLATE size: %d bytes (%0.2f%% original size)",
+			jpegSize, 100*ratio(jpegSize, stats.RawSize), stats.DeflateSize, 100*stats.DeflateRatio)
+	}
+	if compareGIF {
+		statf("GIF size: %d bytes (%0.2f%% original size) vs DEFLATE size: %d bytes (%0.2f%% original size)",
+			gifTotal, 100*ratio(gifTotal, stats.RawSize), stats.DeflateSize, 100*stats.DeflateRatio)
+	}
+
+	// With -output, we also play the video to the viewer, the other end of -input tcp://. Each
+	// frame is sent as soon as it's converted to RGB, as raw frames just like decoded.rgb24. Like
+	// tuning in to a live stream, a viewer that connects partway through starts from there. If
+	// the viewer goes away, that's their loss, and we carry on with the rest.
+	//
+	//   ffplay -f rawvideo -pixel_format rgb24 -video_size 384x216 -framerate 25 tcp://localhost:9000
+	var viewer net.Conn
+	var viewerGone bool
+	var sent int
+	sendToViewer := func(frame []byte) {
+		if viewer == nil {
+			select {
+			case viewer = <-viewers:
+			default:
+			}
+		}
+		if viewer == nil || viewerGone {
+			return
+		}
+		if _, err := viewer.Write(frame); err != nil {
+			var opErr *net.OpError
+			if !errors.As(err, &opErr) {
+				log.Fatal(err)
+			}
+			log.Printf("The viewer at %s disconnected after %d frames: %v", viewer.RemoteAddr(), sent, err)
+			viewerGone = true
+			return
+		}
+		sent++
+	}
+
+	var decodedYUV, decodedRGB, decodedGray [][]byte
+	var decodedTypes []FrameType
+	outName := "decoded.rgb24"
+	// decodedSize keeps track of how much memory the decoded frames take up, so we can stop
+	// before going over -max-memory.
+	var decodedSize int
+	start = time.Now()
+	stream := bytes.NewReader(deflated)
+	for stream.Len() > 0 {
+		opts := decodeOptions{skipCorrupt: skipCorrupt, lumaOnly: lumaOnly, tolerant: tolerant, logger: logger}
+		if maxMemory > 0 {
+			// Each segment gets whatever memory the segments before it left over.
+			opts.maxMemory = maxMemory<<20 - decodedSize
+			if opts.maxMemory <= 0 {
+				log.Fatalf("decoding needs more than the limit of %d MiB of memory", maxMemory)
+			}
+		}
+		hdr, frames, types, err := decodeSegment(context.Background(), stream, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		decodedTypes = append(decodedTypes, types...)
+		statf("Decoded %d frames of %dx%d at %d/%d fps", len(frames), hdr.Width-uint32(hdr.PadRight), hdr.Height-uint32(hdr.PadBottom), hdr.FramerateNum, hdr.FramerateDen)
+		if hdr.ParNum != hdr.ParDen {
+			width := int(hdr.Width-uint32(hdr.PadRight)) * int(hdr.ParNum) / int(hdr.ParDen)
+			statf("Pixel aspect ratio %d:%d, to be shown at %dx%d", hdr.ParNum, hdr.ParDen, width, hdr.Height-uint32(hdr.PadBottom))
+		}
+
+		// For thumbnails, the brightness is enough, and we can skip most of the work. There's no
+		// chroma to reconstruct and nothing to convert. See reconstructor.lumaOnly.
+		if lumaOnly {
+			for _, frame := range frames {
+				decodedGray = append(decodedGray, cropFrame(frame, int(hdr.Width), int(hdr.Height),
+					int(hdr.Width)-int(hdr.PadRight), int(hdr.Height)-int(hdr.PadBottom), 1))
+			}
+			decodedSize += len(frames) * int(hdr.Width) * int(hdr.Height)
+			continue
+		}
+		decodedYUV = append(decodedYUV, frames...)
+		decodedSize += len(frames) * hdr.frameSize()
+		if decodeFormat == "yuv" {
+			continue
+		}
+
+		rgbSize := len(frames) * int(hdr.Width) * int(hdr.Height) * bytesPerPixel
+		if maxMemory > 0 && decodedSize+rgbSize > maxMemory<<20 {
+			log.Fatalf("converting %d frames to RGB needs more than the limit of %d MiB of memory", len(frames), maxMemory)
+		}
+		decodedSize += rgbSize
+
+		// Then convert each YUV frame into RGB.
+		//
+		// With -output, the viewer doesn't have to wait for the whole segment. The frames are
+		// converted in order, a few at a time, and each one is sent as soon as it and the ones
+		// before it are ready.
+		rgb := make([][]byte, len(frames))
+		var converted []chan struct{}
+		streamed := make(chan struct{})
+		if output != "" {
+			converted = make([]chan struct{}, len(frames))
+			for i := range converted {
+				converted[i] = make(chan struct{})
+			}
+			go func() {
+				defer close(streamed)
+				for i := range rgb {
+					<-converted[i]
+					sendToViewer(rgb[i])
+				}
+			}()
+		} else {
+			close(streamed)
+		}
+		parallelFor(len(frames), threads, func(i int) {
+			frame := unpackFrame(frames[i], hdr)
+			rgb[i] = cropFrame(convertToRGB(frame, hdr), int(hdr.Width), int(hdr.Height),
+				int(hdr.Width)-int(hdr.PadRight), int(hdr.Height)-int(hdr.PadBottom), bytesPerPixel)
+			if converted != nil {
+				close(converted[i])
+			}
+		})
+		<-streamed
+
+		// With -output-glob, every frame also becomes a PNG, which any image viewer can open,
+		// unlike the raw video below.
+		if outputGlob != "" {
+			for i, frame := range rgb {
+				img := frameImage(frame, int(hdr.Width)-int(hdr.PadRight), int(hdr.Height)-int(hdr.PadBottom), bytesPerPixel)
+				if err := writePNG(fmt.Sprintf(outputGlob, len(decodedRGB)+i), img); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		decodedRGB = append(decodedRGB, rgb...)
+		if hdr.Alpha {
+			outName = "decoded.rgba"
+		}
+	}
+	stats.DecodeTime = time.Since(start)
+
+	// We're done listening. If nobody connected, we don't wait around for them.
+	if output != "" {
+		viewerListener.Close()
+		if viewer == nil {
+			viewer = <-viewers
+		}
+		if viewer == nil {
+			log.Printf("No viewer connected to %s, so the video wasn't streamed", output)
+		} else {
+			viewer.Close()
+			if !viewerGone {
+				statf("Sent %d frames to the viewer at %s", sent, viewer.RemoteAddr())
+			}
+		}
+	}
+
+	// The Y plane on its own is a grayscale video, which can be played with:
+	//
+	//   ffplay -f rawvideo -pixel_format gray -video_size 384x216 -framerate 25 decoded.gray
+	if lumaOnly {
+		if err := os.WriteFile("decoded.gray", bytes.Join(decodedGray, nil), 0644); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := os.WriteFile("decoded.yuv", bytes.Join(decodedYUV, nil), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	// decoded.yuv is exactly what we encoded, so if that's what you're after, there's no need to
+	// go any further. Converting back to RGB is slow, and since RGB can represent colors that YUV
+	// can't and vice versa, it loses a little more of the original along the way.
+	if decodeFormat == "yuv" {
+		return
+	}
+
+	// Finally, write the decoded video to a file.
+	//
+	// This video can be played with ffplay:
+	//
+	//   ffplay -f rawvideo -pixel_format rgb24 -video_size 384x216 -framerate 25 decoded.rgb24
+	//
+	// or, if it has an alpha channel:
+	//
+	//   ffplay -f rawvideo -pixel_format rgba -video_size 384x216 -framerate 25 decoded.rgba
+	//
+	out, err := os.Create(outName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+
+	for i := range decodedRGB {
+		if _, err := out.Write(decodedRGB[i]); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Numbers only tell you so much. With -compare-out, we can see for ourselves what the encoder
+	// did to a frame. See comparisonImage.
+	if compareOut != "" {
+		if compareFrame >= len(decodedRGB) {
+			log.Fatalf("invalid -compare-frame %d: only %d frames were decoded", compareFrame, len(decodedRGB))
+		}
+		i := compareFrame
+		for _, seg := range segments {
+			if i >= len(seg.original) {
+				i -= len(seg.original)
+				continue
+			}
+			img := comparisonImage(seg.original[i], decodedRGB[compareFrame], seg.width, seg.height, bytesPerPixel)
+			if err := writePNG(compareOut, img); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+	}
+
+	// With -verify, we check how close the decoded video is to what we started with. Converting
+	// to YUV420 threw away some of the color information, so it won't be exact, but it should be
+	// close. If it isn't, we exit with status 1 so scripts can catch an encoder change that hurts
+	// quality. Any other failure exits with status 1 too, so 0 means it passed.
+	//
+	// An average can hide a lot though. With -psnr-csv, we also write down the quality of each
+	// frame, so it can be plotted to see where it dips, like after a cut or during fast motion.
+	//
+	// We measure the PSNR on the RGB pixels, where an error in any of R, G or B counts the same.
+	// But our eyes are much more sensitive to brightness than color, which is the whole reason
+	// for subsampling the chroma in the first place. With -psnr-weights, we measure it on Y, U
+	// and V instead and weigh each one, so that, say, with 6,1,1, switching from 420 to 411
+	// subsampling only costs as much as our eyes think it should. See weightedSquaredError.
+	if verify || psnrCSV != "" {
+		var timeline *csv.Writer
+		if psnrCSV != "" {
+			f, err := os.Create(psnrCSV)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			timeline = csv.NewWriter(f)
+			if err := timeline.Write([]string{"frame_index", "frame_type", "psnr", "ssim"}); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		var squaredErr, samples float64
+		var similarity float64
+		var i int
+		for _, seg := range segments {
+			for _, frame := range seg.original {
+				if i == len(decodedRGB) {
+					break
+				}
+				frameErr := squaredError(frame, decodedRGB[i])
+				frameSamples := float64(len(frame))
+				if psnrWeightList != "" {
+					frameErr = weightedSquaredError(frame, decodedRGB[i], bytesPerPixel, psnrWeights)
+					frameSamples = float64(len(frame)/bytesPerPixel) * (psnrWeights[0] + psnrWeights[1] + psnrWeights[2])
+				}
+				frameSimilarity := ssim(frame, decodedRGB[i], seg.width, seg.height, bytesPerPixel)
+				squaredErr += frameErr
+				samples += frameSamples
+				similarity += frameSimilarity
+				if timeline != nil {
+					record := []string{
+						strconv.Itoa(i),
+						frameTypeNames[decodedTypes[i]],
+						strconv.FormatFloat(psnr(frameErr/frameSamples), 'f', 4, 64),
+						strconv.FormatFloat(frameSimilarity, 'f', 6, 64),
+					}
+					if err := timeline.Write(record); err != nil {
+						log.Fatal(err)
+					}
+				}
+				i++
+			}
+		}
+		if timeline != nil {
+			timeline.Flush()
+			if err := timeline.Error(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		quality := psnr(squaredErr / samples)
+		log.Printf("PSNR: %0.2f dB, SSIM: %0.4f", quality, similarity/float64(i))
+		if verify && quality < minPSNR {
+			// log.Fatal skips the deferred calls, so we stop profiling ourselves to keep the
+			// profile of a failing run.
+			if err := stopProfiles(); err != nil {
+				log.Print(err)
+			}
+			log.Fatalf("verify failed: PSNR %0.2f dB is below -min-psnr %0.2f dB", quality, minPSNR)
+		}
+	}
+}
+
+// Stats records the size of the video after each stage of the encoder. Ratios are relative to
+// RawSize.
+type Stats struct {
+	RawSize     int `json:"rawSize"`
+	YUVSize     int `json:"yuvSize"`
+	RLESize     int `json:"rleSize"`
+	DeflateSize int `json:"deflateSize"`
+
+	YUVRatio     float64 `json:"yuvRatio"`
+	RLERatio     float64 `json:"rleRatio"`
+	DeflateRatio float64 `json:"deflateRatio"`
+
+	// The compressed bytes attributable to each frame type, not including the header.
+	KeyframeCount int `json:"keyframeCount"`
+	KeyframeSize  int `json:"keyframeSize"`
+	PframeCount   int `json:"pframeCount"`
+	PframeSize    int `json:"pframeSize"`
+	SolidCount    int `json:"solidCount"`
+	SolidSize     int `json:"solidSize"`
+	RepeatCount   int `json:"repeatCount"`
+	RepeatSize    int `json:"repeatSize"`
+
+	// With -block-skip, the number of blocks in P-frames and how many of them were skipped.
+	Blocks        int `json:"blocks"`
+	SkippedBlocks int `json:"skippedBlocks"`
+
+	// With -exploit-symmetry, the number of keyframe planes that were mirror images of
+	// themselves.
+	MirroredPlanes int `json:"mirroredPlanes"`
+
+	// With -renditions, the size of each rendition by name.
+	RenditionSizes map[string]int `json:"renditionSizes,omitempty"`
+
+	// How long each stage took, which JSON has in nanoseconds. DecodeTime includes converting
+	// back to RGB. Analyze leaves these at zero.
+	YUVTime     time.Duration `json:"yuvTime"`
+	RLETime     time.Duration `json:"rleTime"`
+	DeflateTime time.Duration `json:"deflateTime"`
+	DecodeTime  time.Duration `json:"decodeTime"`
+}
+
+// Encode encodes frames as a single segment described by hdr, adding to stats as it goes. It
+// checks ctx between frames, and if it's canceled, stops and returns ctx.Err(). This way, a
+// server encoding video for a request can give up as soon as the request goes away.
+func Encode(ctx context.Context, hdr header, frames [][]byte, stats *Stats) ([]byte, error) {
+	enc, err := NewEncoder(hdr, stats)
+	if err != nil {
+		return nil, err
+	}
+	for _, frame := range frames {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := enc.WriteFrame(frame); err != nil {
+			return nil, err
+		}
+	}
+	return enc.Close()
+}
+
+// Decode decodes every segment of an encoded video, returning each YUV frame along with the
+// header of the segment it's in. Like Encode, it stops and returns ctx.Err() if ctx is canceled.
+func Decode(ctx context.Context, data []byte) ([]header, [][]byte, error) {
+	return decodeAll(ctx, data, decodeOptions{})
+}
+
+// decodeAll is Decode with options.
+func decodeAll(ctx context.Context, data []byte, opts decodeOptions) ([]header, [][]byte, error) {
+	var headers []header
+	var frames [][]byte
+	stream := bytes.NewReader(data)
+	for stream.Len() > 0 {
+		hdr, segmentFrames, _, err := decodeSegment(ctx, stream, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for range segmentFrames {
+			headers = append(headers, hdr)
+		}
+		frames = append(frames, segmentFrames...)
+	}
+	return headers, frames, nil
+}
+
+// FrameWriter encodes rgb24 (or rgba, with hdr.Alpha) frames one at a time as they arrive, like
+// they would from a capture device, and writes the encoded segment to w when it's closed. It
+// converts each frame to YUV and hands it straight to an Encoder, so other than the compressed
+// output, it only holds on to the frame the next P-frame is a delta against.
+type FrameWriter struct {
+	w   io.Writer
+	enc *Encoder
+
+	width, height, codedWidth, codedHeight int
+	opts                                   yuvOptions
+	layout                                 uint8
+}
+
+// NewFrameWriter returns a FrameWriter for frames of hdr.Width by hdr.Height pixels. The frames
+// are padded to fit the chroma subsampling just like the ones main reads, so hdr.PadRight and
+// hdr.PadBottom are ignored, and so is hdr.FrameCount.
+func NewFrameWriter(w io.Writer, hdr header, stats *Stats) (*FrameWriter, error) {
+	fw := &FrameWriter{
+		w:      w,
+		width:  int(hdr.Width),
+		height: int(hdr.Height),
+		opts:   yuvOptions{alpha: hdr.Alpha, subsampling: hdr.Subsampling, colorRange: hdr.Range},
+		layout: hdr.Layout,
+	}
+	fw.codedWidth, fw.codedHeight = paddedSize(fw.width, fw.height, hdr.Subsampling)
+	hdr.Width, hdr.Height = uint32(fw.codedWidth), uint32(fw.codedHeight)
+	hdr.PadRight, hdr.PadBottom = uint8(fw.codedWidth-fw.width), uint8(fw.codedHeight-fw.height)
+	if err := hdr.validate(); err != nil {
+		return nil, fmt.Errorf("create encoder: %w", err)
+	}
+	enc, err := NewEncoder(hdr, stats)
+	if err != nil {
+		return nil, err
+	}
+	fw.enc = enc
+	return fw, nil
+}
+
+// WriteFrame converts the next frame to YUV and encodes it.
+func (fw *FrameWriter) WriteFrame(frame []byte) error {
+	bytesPerPixel := 3
+	if fw.opts.alpha {
+		bytesPerPixel = 4
+	}
+	if len(frame) != fw.width*fw.height*bytesPerPixel {
+		return fmt.Errorf("write frame %d: frame is %d bytes, expected %dx%d (%d bytes)",
+			fw.enc.hdr.FrameCount, len(frame), fw.width, fw.height, fw.width*fw.height*bytesPerPixel)
+	}
+	padded := padFrame(frame, fw.width, fw.height, fw.codedWidth, fw.codedHeight, bytesPerPixel)
+	yuv := convertToYUV(padded, fw.codedWidth, fw.codedHeight, fw.opts)
+	return fw.enc.WriteFrame(packFrame(yuv, fw.layout, fw.codedWidth, fw.codedHeight))
+}
+
+// Close finishes the segment and writes it to the underlying writer.
+func (fw *FrameWriter) Close() error {
+	segment, err := fw.enc.Close()
+	if err != nil {
+		return err
+	}
+	_, err = fw.w.Write(segment)
+	return err
+}
+
+// Analyze runs rgb24 frames through each stage of the encoder and reports the size of the
+// video after each one, without writing anything out. Like main, it pads frames with an odd
+// width or height to fit the chroma subsampling. frames is not modified.
+func Analyze(frames [][]byte, width, height int) (Stats, error) {
+	var stats Stats
+	stats.RawSize = size(frames)
+
+	codedWidth, codedHeight := paddedSize(width, height, subsampling420)
+	hdr := header{
+		Width:        uint32(codedWidth),
+		Height:       uint32(codedHeight),
+		FramerateNum: 25,
+		FramerateDen: 1,
+		PadRight:     uint8(codedWidth - width),
+		PadBottom:    uint8(codedHeight - height),
+	}
+	if err := hdr.validate(); err != nil {
+		return stats, fmt.Errorf("analyze: %w", err)
+	}
+	yuvFrames := make([][]byte, len(frames))
+	for i, frame := range frames {
+		if len(frame) != width*height*3 {
+			return stats, fmt.Errorf("analyze: frame %d is %d bytes, expected %dx%d (%d bytes)", i, len(frame), width, height, width*height*3)
+		}
+		padded := padFrame(frame, width, height, codedWidth, codedHeight, 3)
+		yuvFrames[i] = convertToYUV(padded, codedWidth, codedHeight, yuvOptions{})
+	}
+	stats.YUVSize = size(yuvFrames)
+	stats.RLESize = size(runLengthEncodeFrames(yuvFrames, rleOptions{}))
+
+	deflated, err := Encode(context.Background(), hdr, yuvFrames, &stats)
+	if err != nil {
+		return stats, fmt.Errorf("analyze: %w", err)
+	}
+	stats.DeflateSize = len(deflated)
+
+	stats.YUVRatio = ratio(stats.YUVSize, stats.RawSize)
+	stats.RLERatio = ratio(stats.RLESize, stats.RawSize)
+	stats.DeflateRatio = ratio(stats.DeflateSize, stats.RawSize)
+	return stats, nil
+}
+
+// FrameType says how a frame is stored in the encoded stream.
+type FrameType uint8
+
+const (
+	// KeyFrame is a frame stored in full, which can be decoded on its own.
+	KeyFrame FrameType = iota
+
+	// PFrame is a frame stored as the delta from the frame before it.
+	PFrame
+
+	// SolidFrame is a frame that's a single color, like the black frames between scenes or
+	// a title card's background, stored as nothing but the value of each plane. It can be
+	// decoded on its own, like a keyframe.
+	SolidFrame
+
+	// RepeatFrame is a run of frames that are all the same as the frame before them, like the
+	// still tail of a video, stored as nothing but how many there are. The decoder shows the
+	// previous frame again that many times. See header.Repeats.
+	RepeatFrame
+)
+
+var frameTypeNames = map[FrameType]string{
+	KeyFrame:    "key",
+	PFrame:      "P",
+	SolidFrame:  "solid",
+	RepeatFrame: "repeat",
+}
+
+// independent returns whether frames of type t are decoded without the frames before them.
+func (t FrameType) independent() bool {
+	return t == KeyFrame || t == SolidFrame
+}
+
+// Encoder compresses YUV frames one at a time into a segment of the encoded stream.
+type Encoder struct {
+	hdr   header
+	stats *Stats
+
+	deflated bytes.Buffer
+	w        CompressWriter
+
+	// prev is the frame the next P-frame is a delta against. Usually this is the previous
+	// frame, but with referenceAverage, it's the running average of the frames so far. With a
+	// RefDistance of N, history holds the last N frames since the last keyframe, and prev is the
+	// oldest of them.
+	prev    []byte
+	history [][]byte
+
+	keyframeRequested bool
+
+	// types is the type of each frame written so far, or of each field if it's interlaced. See
+	// FrameTypes.
+	types []FrameType
+
+	// With Repeats in the header, last is the last frame written, and repeats is how many frames
+	// since then were the same as it. They're written out as a single RepeatFrame once the run
+	// ends. See flushRepeats.
+	last    []byte
+	repeats int
+
+	// We keep track of how many compressed bytes go to keyframes versus P-frames. DEFLATE
+	// buffers its output internally, so whenever the frame type changes, we flush the writer
+	// to find out exactly how many bytes the frames of the previous type took up. run is the
+	// type of the frames written since the last flush, and runStart is where they start.
+	run      FrameType
+	runStart int
+
+	// OnYUVFrame and OnDelta, if set, are called with the intermediate data of each frame as
+	// it passes through the encoder, which is handy for poking at what each stage does without
+	// changing the encoder. OnYUVFrame gets every YUV frame as it's written, and OnDelta gets
+	// the delta each P-frame is stored as (zig-zag encoded with ZigZag, but before block
+	// skipping, if that's on). idx is the index of the frame in the segment. The slices are only
+	// valid until the hook returns.
+	OnYUVFrame func(idx int, yuv []byte)
+	OnDelta    func(idx int, delta []byte)
+
+	// delta is where P-frames are computed, reused from one frame to the next.
+	delta []byte
+
+	// StoreOnExpand makes Close store the YUV frames uncompressed if compressing them made them
+	// bigger, which can happen on pure noise. raw holds the frames until then.
+	StoreOnExpand bool
+	raw           []byte
+
+	// Adaptive makes every frame that would be a P-frame a keyframe instead if that compresses
+	// smaller, which it does after a scene cut. To find out, the encoder compresses each frame
+	// both ways on its own before compressing the winner into the stream, which about doubles
+	// the time it takes to encode.
+	Adaptive bool
+
+	// Level is the level the Codec compresses at, from flate.BestSpeed to flate.BestCompression,
+	// or 0 for flate.BestCompression. It has to be set before the first frame is written.
+	Level int
+
+	// With tiling, each tile is coded by an Encoder of its own, and tileStats collects their
+	// stats so they don't trip over each other when they run in parallel. Threads is how many
+	// tiles to encode at once. OnDelta isn't called for tiled segments.
+	tiles     []*Encoder
+	tileRects []tile
+	tileStats []Stats
+	Threads   int
+}
+
+// NewEncoder returns an Encoder for a segment described by hdr. The encoder counts the frames
+// as they're written, so hdr.FrameCount is ignored. The compressed size of each frame type is
+// added to stats.
+func NewEncoder(hdr header, stats *Stats) (*Encoder, error) {
+	e := &Encoder{hdr: hdr, stats: stats}
+	e.hdr.Version = formatVersion
+	e.hdr.FrameCount = 0
+	if e.hdr.ParNum == 0 && e.hdr.ParDen == 0 {
+		e.hdr.ParNum, e.hdr.ParDen = 1, 1
+	}
+	if hdr.Interlaced {
+		// Each field has every other row of each plane, so the chroma planes need an even
+		// number of rows too.
+		if _, sy := chromaSubsampling(hdr.Subsampling); hdr.Height%uint32(2*sy) != 0 {
+			return nil, fmt.Errorf("create encoder: the height of an interlaced video must be a multiple of %d, got %d", 2*sy, hdr.Height)
+		}
+		e.hdr = fieldHeader(e.hdr)
+		hdr = e.hdr
+	}
+	if hdr.letterboxed() {
+		if hdr.Layout != layoutPlanar || hdr.Alpha || hdr.Interlaced {
+			return nil, errors.New("create encoder: letterbox bars require a planar layout without alpha or interlacing")
+		}
+		sx, sy := chromaSubsampling(hdr.Subsampling)
+		if int(hdr.BarLeft)%sx != 0 || int(hdr.BarRight)%sx != 0 || int(hdr.BarTop)%sy != 0 || int(hdr.BarBottom)%sy != 0 {
+			return nil, fmt.Errorf("create encoder: letterbox bars must be a multiple of %dx%d", sx, sy)
+		}
+		if uint32(hdr.BarLeft)+uint32(hdr.BarRight) >= hdr.Width || uint32(hdr.BarTop)+uint32(hdr.BarBottom) >= hdr.Height {
+			return nil, fmt.Errorf("create encoder: letterbox bars leave no picture in a %dx%d frame", hdr.Width, hdr.Height)
+		}
+		e.hdr = pictureHeader(e.hdr)
+		hdr = e.hdr
+	}
+	if hdr.TileSize > 0 {
+		e.tileRects = tileRects(hdr)
+		e.tileStats = make([]Stats, len(e.tileRects))
+		for i, t := range e.tileRects {
+			tileEnc, err := NewEncoder(tileHeader(hdr, t), &e.tileStats[i])
+			if err != nil {
+				return nil, err
+			}
+			e.tiles = append(e.tiles, tileEnc)
+		}
+		return e, nil
+	}
+	if _, ok := codecs[hdr.Compression]; !ok {
+		return nil, fmt.Errorf("create encoder: unknown compression %d", hdr.Compression)
+	}
+	return e, nil
+}
+
+// level returns the level the Codec compresses at. See Level.
+func (e *Encoder) level() int {
+	if e.Level == 0 {
+		return flate.BestCompression
+	}
+	return e.Level
+}
+
+// writer returns the Codec's writer for the segment, creating it the first time so that Level
+// can be set after NewEncoder.
+func (e *Encoder) writer() (CompressWriter, error) {
+	if e.w == nil {
+		w, err := codecs[e.hdr.Compression].NewWriter(&e.deflated, e.level())
+		if err != nil {
+			return nil, err
+		}
+		e.w = w
+	}
+	return e.w, nil
+}
+
+// RequestKeyframe forces the next frame to be a keyframe.
+//
+// Since every P-frame depends on the frame before it, a decoder normally has to start from
+// the beginning of the stream. That doesn't work for live streams, where viewers join partway
+// through and packets get lost along the way. Protocols like RTP and WebRTC deal with this by
+// letting the receiver ask the sender for a fresh keyframe (for example, with a Picture Loss
+// Indication), which can be decoded without anything that came before it. RequestKeyframe is
+// how such a request reaches the encoder.
+func (e *Encoder) RequestKeyframe() {
+	e.keyframeRequested = true
+}
+
+// WriteFrame compresses the next YUV frame.
+func (e *Encoder) WriteFrame(frame []byte) error {
+	if e.hdr.Interlaced {
+		top, bottom := splitFields(frame, frameHeader(e.hdr))
+		if err := e.writePicture(top); err != nil {
+			return err
+		}
+		return e.writePicture(bottom)
+	}
+	if e.hdr.letterboxed() {
+		hdr := letterboxedHeader(e.hdr)
+		if !hasBars(frame, hdr) {
+			return errors.New("write frame: the frame doesn't have the letterbox bars in the header")
+		}
+		frame = extractTile(frame, hdr, pictureRect(hdr))
+	}
+	return e.writePicture(frame)
+}
+
+// writePicture compresses the next frame, or the next field of an interlaced frame.
+func (e *Encoder) writePicture(frame []byte) error {
+	if e.hdr.LumaStep > 1 {
+		frame = append([]byte(nil), frame...)
+		quantizeLuma(frame[:e.hdr.Width*e.hdr.Height], int(e.hdr.LumaStep))
+	}
+	if e.tiles != nil {
+		return e.writeTiles(frame)
+	}
+
+	// A frame that's the same as the one before it has nothing new to store at all, so we just
+	// count it. A frame we were asked to make a keyframe still has to be one though, so that it
+	// can be decoded on its own.
+	if e.hdr.Repeats && !e.keyframeRequested && e.last != nil && bytes.Equal(frame, e.last) {
+		e.repeatPicture(frame)
+		return nil
+	}
+
+	// A frame that's a single color doesn't need to be stored in full or as a delta, whichever
+	// it would have been. Its color is all there is to it. Packed frames interleave their
+	// planes, so we only look for these in planar frames.
+	typ := PFrame
+	switch {
+	case e.hdr.Layout == layoutPlanar && isSolidFrame(frame, e.hdr):
+		typ = SolidFrame
+	case e.prev == nil || e.keyframeRequested:
+		typ = KeyFrame
+	}
+	e.keyframeRequested = false
+	idx := int(e.hdr.FrameCount)
+	if e.OnYUVFrame != nil {
+		e.OnYUVFrame(idx, frame)
+	}
+	if e.StoreOnExpand {
+		e.raw = append(e.raw, frame...)
+	}
+
+	var stored []byte
+	if typ == PFrame && e.Adaptive {
+		typ, stored = e.chooseFrameType(frame)
+	} else {
+		stored = e.storeFrame(typ, frame, e.stats)
+	}
+	if typ == PFrame && e.OnDelta != nil {
+		if e.hdr.BlockSkip {
+			e.delta = frameDelta(e.delta, frame, e.prev, e.hdr.ZigZag)
+		}
+		e.OnDelta(idx, e.delta)
+	}
+
+	if err := e.flushRepeats(); err != nil {
+		return err
+	}
+	if err := e.writeRecord(idx, typ, stored); err != nil {
+		return err
+	}
+	switch typ {
+	case KeyFrame:
+		e.stats.KeyframeCount++
+	case PFrame:
+		e.stats.PframeCount++
+	case SolidFrame:
+		e.stats.SolidCount++
+	}
+	e.types = append(e.types, typ)
+	e.hdr.FrameCount++
+	if e.hdr.Repeats {
+		e.last = append(e.last[:0], frame...)
+	}
+	e.updateReference(typ, frame)
+	return nil
+}
+
+// repeatPicture counts frame, which is the same as the frame before it, toward the current run
+// of repeats.
+func (e *Encoder) repeatPicture(frame []byte) {
+	if e.OnYUVFrame != nil {
+		e.OnYUVFrame(int(e.hdr.FrameCount), frame)
+	}
+	if e.StoreOnExpand {
+		e.raw = append(e.raw, frame...)
+	}
+	e.repeats++
+	e.stats.RepeatCount++
+	e.types = append(e.types, RepeatFrame)
+	e.hdr.FrameCount++
+	e.updateReference(RepeatFrame, frame)
+}
+
+// flushRepeats writes the current run of repeats, if there is one, as a RepeatFrame holding how
+// many frames it stands for.
+func (e *Encoder) flushRepeats() error {
+	if e.repeats == 0 {
+		return nil
+	}
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(e.repeats))
+	idx := int(e.hdr.FrameCount) - e.repeats
+	e.repeats = 0
+	return e.writeRecord(idx, RepeatFrame, count[:])
+}
+
+// writeRecord writes a frame of type typ, stored as stored, to the compressed stream. idx is the
+// index of the frame in the segment.
+func (e *Encoder) writeRecord(idx int, typ FrameType, stored []byte) error {
+	w, err := e.writer()
+	if err != nil {
+		return fmt.Errorf("write frame %d: %w", idx, err)
+	}
+	if idx > 0 && typ != e.run {
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("write frame %d: %w", idx, err)
+		}
+		e.endRun()
+	}
+	e.run = typ
+
+	if err := writeFrame(w, typ, stored); err != nil {
+		return fmt.Errorf("write frame %d: %w", idx, err)
+	}
+	return nil
+}
+
+// updateReference updates what the next P-frame is a delta against after frame was written as a
+// frame of type typ. The decoder does the same in reconstructor.frame.
+func (e *Encoder) updateReference(typ FrameType, frame []byte) {
+	switch {
+	case e.hdr.Reference == referenceAverage && !typ.independent():
+		updateAverage(e.prev, frame)
+	case e.hdr.RefDistance > 1:
+		// A keyframe starts the history over, so that no P-frame after it refers back past it.
+		// Otherwise, we reuse the frame that's falling out of the history.
+		var buf []byte
+		if typ.independent() {
+			e.history = e.history[:0]
+		} else if len(e.history) == int(e.hdr.RefDistance) {
+			buf, e.history = e.history[0], e.history[1:]
+		}
+		e.history = append(e.history, append(buf[:0], frame...))
+		e.prev = e.history[0]
+	default:
+		e.prev = append(e.prev[:0], frame...)
+	}
+}
+
+// FrameTypes returns the type of each frame written so far, which is handy for checking from the
+// outside what Adaptive or a RequestKeyframe did. The types are what the decoder will see: for a
+// tiled segment, the tiles' types put together like storedSegment.frameType does, and for an
+// interlaced one, the type of each frame's top field.
+func (e *Encoder) FrameTypes() []FrameType {
+	types := e.pictureTypes()
+	if !e.hdr.Interlaced {
+		return types
+	}
+	frames := make([]FrameType, len(types)/2)
+	for i := range frames {
+		frames[i] = types[2*i]
+	}
+	return frames
+}
+
+// pictureTypes returns the type of each frame or field written so far.
+func (e *Encoder) pictureTypes() []FrameType {
+	if e.tiles == nil {
+		return append([]FrameType(nil), e.types...)
+	}
+	types := e.tiles[0].pictureTypes()
+	for _, tileEnc := range e.tiles[1:] {
+		for i, typ := range tileEnc.pictureTypes() {
+			types[i] = mergeFrameTypes(types[i], typ)
+		}
+	}
+	return types
+}
+
+// storeFrame returns frame as it's stored as a frame of type typ, adding to stats.
+func (e *Encoder) storeFrame(typ FrameType, frame []byte, stats *Stats) []byte {
+	switch {
+	case typ == SolidFrame:
+		return solidColor(frame, e.hdr)
+	case typ == KeyFrame && e.hdr.Symmetry:
+		stored, mirrored := foldFrame(frame, e.hdr)
+		stats.MirroredPlanes += mirrored
+		return stored
+	case typ == KeyFrame && e.hdr.Predictor == predictorMedian:
+		// Unlike P-frames, keyframes have no previous frame to predict from, but we can still
+		// predict each pixel from its neighbors within the same frame. See predictMedian below
+		// for how that works.
+		return predictFrame(frame, e.hdr)
+	case typ == KeyFrame:
+		// This is a keyframe, write the raw frame.
+		return frame
+	case e.hdr.BlockSkip:
+		return skipBlocks(frame, e.prev, e.hdr, stats)
+	default:
+		e.delta = frameDelta(e.delta, frame, e.prev, e.hdr.ZigZag)
+		return e.delta
+	}
+}
+
+// chooseFrameType stores frame both as a keyframe and as a P-frame, and returns whichever of
+// them compresses smaller. See Adaptive.
+func (e *Encoder) chooseFrameType(frame []byte) (FrameType, []byte) {
+	var keyStats, pStats Stats
+	keyframe := e.storeFrame(KeyFrame, frame, &keyStats)
+	pframe := e.storeFrame(PFrame, frame, &pStats)
+	typ, stored, chosen := PFrame, pframe, pStats
+	if e.compressedSize(keyframe) < e.compressedSize(pframe) {
+		typ, stored, chosen = KeyFrame, keyframe, keyStats
+	}
+	e.stats.MirroredPlanes += chosen.MirroredPlanes
+	e.stats.Blocks += chosen.Blocks
+	e.stats.SkippedBlocks += chosen.SkippedBlocks
+	return typ, stored
+}
+
+// compressedSize returns the size of data compressed on its own with the segment's Codec. In the
+// stream, it would come out a little smaller, since the compressor can refer back to the frames
+// before it, but that helps a keyframe and a P-frame about equally.
+func (e *Encoder) compressedSize(data []byte) int {
+	var buf bytes.Buffer
+	// The codecs only fail to create a writer when they're misconfigured, which WriteFrame
+	// would have already run into, and writing to a buffer can't fail.
+	w, _ := codecs[e.hdr.Compression].NewWriter(&buf, e.level())
+	w.Write(data)
+	w.Close()
+	return buf.Len()
+}
+
+// endRun attributes the bytes written since the last flush to the current frame type.
+func (e *Encoder) endRun() {
+	n := e.deflated.Len() - e.runStart
+	switch e.run {
+	case KeyFrame:
+		e.stats.KeyframeSize += n
+	case PFrame:
+		e.stats.PframeSize += n
+	case SolidFrame:
+		e.stats.SolidSize += n
+	case RepeatFrame:
+		e.stats.RepeatSize += n
+	}
+	e.runStart = e.deflated.Len()
+}
+
+// writeTiles splits frame into tiles and writes each one to its own encoder.
+func (e *Encoder) writeTiles(frame []byte) error {
+	idx := int(e.hdr.FrameCount)
+	if e.OnYUVFrame != nil {
+		e.OnYUVFrame(idx, frame)
+	}
+	keyframe := e.keyframeRequested
+	e.keyframeRequested = false
+
+	errs := make([]error, len(e.tiles))
+	parallelFor(len(e.tiles), e.Threads, func(i int) {
+		tileEnc := e.tiles[i]
+		tileEnc.StoreOnExpand = e.StoreOnExpand
+		tileEnc.Adaptive = e.Adaptive
+		tileEnc.Level = e.Level
+		if keyframe {
+			tileEnc.RequestKeyframe()
+		}
+		errs[i] = tileEnc.WriteFrame(extractTile(frame, e.hdr, e.tileRects[i]))
+	})
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("tile %d: %w", i, err)
+		}
+	}
+	e.hdr.FrameCount++
+	return nil
+}
+
+// closeTiles finishes every tile and returns the segment: the header, followed by each tile's
+// own segment preceded by its size.
+func (e *Encoder) closeTiles() ([]byte, error) {
+	var segment bytes.Buffer
+	if err := binary.Write(&segment, binary.BigEndian, e.hdr); err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	for i, tileEnc := range e.tiles {
+		data, err := tileEnc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: %w", i, err)
+		}
+		if err := binary.Write(&segment, binary.BigEndian, uint32(len(data))); err != nil {
+			return nil, fmt.Errorf("write tile %d: %w", i, err)
+		}
+		segment.Write(data)
+
+		// Every tile sees every frame, so the frame counts come from any one of them. A tile can
+		// be a solid color when the frame as a whole isn't though, so those counts are only of
+		// the first tile.
+		ts := e.tileStats[i]
+		if i == 0 {
+			e.stats.KeyframeCount += ts.KeyframeCount
+			e.stats.PframeCount += ts.PframeCount
+			e.stats.SolidCount += ts.SolidCount
+			e.stats.RepeatCount += ts.RepeatCount
+		}
+		e.stats.KeyframeSize += ts.KeyframeSize
+		e.stats.PframeSize += ts.PframeSize
+		e.stats.SolidSize += ts.SolidSize
+		e.stats.RepeatSize += ts.RepeatSize
+		e.stats.Blocks += ts.Blocks
+		e.stats.SkippedBlocks += ts.SkippedBlocks
+		e.stats.MirroredPlanes += ts.MirroredPlanes
+	}
+	return segment.Bytes(), nil
+}
+
+// Close finishes the segment and returns it, header first.
+func (e *Encoder) Close() ([]byte, error) {
+	if e.tiles != nil {
+		return e.closeTiles()
+	}
+	if err := e.flushRepeats(); err != nil {
+		return nil, fmt.Errorf("close encoder: %w", err)
+	}
+	w, err := e.writer()
+	if err != nil {
+		return nil, fmt.Errorf("close encoder: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("close encoder: %w", err)
+	}
+	if e.hdr.FrameCount > 0 {
+		e.endRun()
+	}
+
+	// Compression doesn't always help. On noise, there's nothing for the deltas or DEFLATE to
+	// work with, and the bookkeeping makes the output bigger than what we started with. Real
+	// containers handle this by storing the data as is, and so can we.
+	hdr, payload := e.hdr, e.deflated.Bytes()
+	if e.StoreOnExpand && len(payload) > len(e.raw) {
+		hdr.Stored = true
+		payload = e.raw
+	}
+
+	var segment bytes.Buffer
+	if err := binary.Write(&segment, binary.BigEndian, hdr); err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	segment.Write(payload)
+	return segment.Bytes(), nil
+}
+
+// Codec is the general-purpose compressor that the encoded frames go through after all the
+// video-specific work is done. Everything up to here turns the video into bytes that are mostly
+// small and repetitive, and the Codec takes advantage of that, without knowing anything about
+// video.
+//
+// The encoder streams frames through the Codec instead of compressing the whole segment at once,
+// so it never has to hold the uncompressed frames in memory, and it flushes the writer whenever
+// the frame type changes to count how many compressed bytes each type takes. For trying out a
+// compressor on some bytes, Compress and Decompress do it all at once.
+type Codec interface {
+	// Compress compresses data at flate.BestCompression, the level the encoder uses unless told
+	// otherwise, in the same format NewWriter writes.
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress decompresses what Compress or a writer from NewWriter wrote.
+	Decompress(data []byte) ([]byte, error)
+
+	// NewWriter returns a writer that compresses what's written to it at the given level, from
+	// flate.BestSpeed to flate.BestCompression, and writes it to w.
+	NewWriter(w io.Writer, level int) (CompressWriter, error)
+
+	// NewReader returns a reader that decompresses a stream written by NewWriter. If r is an
+	// io.ByteReader, it must not read past the end of the stream.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// CompressWriter is a writer returned by Codec.NewWriter.
+type CompressWriter interface {
+	io.WriteCloser
+
+	// Flush writes out everything written so far, without ending the stream.
+	Flush() error
+}
+
+const (
+	compressionFlate uint8 = iota
+	compressionGzip
+	compressionZlib
+)
+
+// The standard library has three codecs to choose from, although they're all DEFLATE underneath.
+// gzip and zlib only add a small header and a checksum around it, so they come out a few bytes
+// bigger. They're here mostly to show where a different compressor would plug in.
+var codecs = map[uint8]Codec{
+	compressionFlate: flateCodec{},
+	compressionGzip:  gzipCodec{},
+	compressionZlib:  zlibCodec{},
+}
+
+// maxDeflateRatio is the most DEFLATE can compress anything by, which all of the codecs use. The
+// longest run it can copy from earlier in the stream is 258 bytes, and the shortest it can code
+// one in is 2 bits, 1 for the length and 1 for how far back to copy from.
+const maxDeflateRatio = 258 * 8 / 2
+
+var compressionIDs = map[string]uint8{
+	"flate": compressionFlate,
+	"gzip":  compressionGzip,
+	"zlib":  compressionZlib,
+}
+
+// compress and decompress implement Codec.Compress and Codec.Decompress on top of c's streams,
+// which is all any of the codecs need.
+func compress(c Codec, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(c Codec, data []byte) ([]byte, error) {
+	r, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// flateCodec is raw DEFLATE.
+type flateCodec struct{}
+
+func (c flateCodec) Compress(data []byte) ([]byte, error) {
+	return compress(c, data)
+}
+
+func (c flateCodec) Decompress(data []byte) ([]byte, error) {
+	return decompress(c, data)
+}
+
+func (flateCodec) NewWriter(w io.Writer, level int) (CompressWriter, error) {
+	return flate.NewWriter(w, level)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// gzipCodec is DEFLATE in the gzip format.
+type gzipCodec struct{}
+
+func (c gzipCodec) Compress(data []byte) ([]byte, error) {
+	return compress(c, data)
+}
+
+func (c gzipCodec) Decompress(data []byte) ([]byte, error) {
+	return decompress(c, data)
+}
+
+func (gzipCodec) NewWriter(w io.Writer, level int) (CompressWriter, error) {
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	// Otherwise, the reader would go on to read the next segment as another gzip stream.
+	zr.Multistream(false)
+	return zr, nil
+}
+
+// zlibCodec is DEFLATE in the zlib format.
+type zlibCodec struct{}
+
+func (c zlibCodec) Compress(data []byte) ([]byte, error) {
+	return compress(c, data)
+}
+
+func (c zlibCodec) Decompress(data []byte) ([]byte, error) {
+	return decompress(c, data)
+}
+
+func (zlibCodec) NewWriter(w io.Writer, level int) (CompressWriter, error) {
+	return zlib.NewWriterLevel(w, level)
+}
+
+func (zlibCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// writeFrame writes a stored frame preceded by its type and length, and followed by a CRC32
+// checksum of the type and the frame. If the stream gets corrupted somewhere between the encoder
+// and the decoder, the checksum lets the decoder notice instead of silently showing garbage. Real
+// containers carry checksums like this for the same reason.
+func writeFrame(w io.Writer, typ FrameType, frame []byte) error {
+	if _, err := w.Write([]byte{byte(typ)}); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(frame))); err != nil {
+		return err
+	}
+	if _, err := w.Write(frame); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, frameChecksum(typ, frame))
+}
+
+// frameChecksum returns the CRC32 checksum of a stored frame and its type.
+func frameChecksum(typ FrameType, frame []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE([]byte{byte(typ)}), crc32.IEEETable, frame)
+}
+
+// ErrCorrupt is returned, wrapped in an error saying where it was noticed, when the encoded
+// stream doesn't make sense.
+var ErrCorrupt = errors.New("corrupt stream")
+
+// decodeOptions configures how the decoder handles the encoded stream.
+type decodeOptions struct {
+	// skipCorrupt replaces frames that fail their checksum with the previous frame instead
+	// of failing.
+	skipCorrupt bool
+
+	// maxMemory is the most bytes a segment may need to decode, or 0 for no limit.
+	maxMemory int
+
+	// lumaOnly returns just the Y plane of each frame, which is all a grayscale thumbnail
+	// needs. See reconstructor.lumaOnly.
+	lumaOnly bool
+
+	// tolerant keeps the frames before the end of the stream if it ends partway through a
+	// segment, like when the encoder was killed while writing it, instead of failing. Tiled
+	// segments store their tiles one after the other, so one that's cut off is missing whole
+	// tiles, and this doesn't help.
+	tolerant bool
+
+	// logger is where to log the frames that were skipped or cut off along the way, or nil to
+	// not log them. main passes the default logger.
+	logger *log.Logger
+}
+
+// logf logs to opts.logger, if there is one.
+func (opts decodeOptions) logf(format string, v ...interface{}) {
+	if opts.logger != nil {
+		opts.logger.Printf(format, v...)
+	}
+}
+
+// decodeSegment reads a single segment from the encoded stream and returns its header, its
+// reconstructed YUV frames and the type of each one. It checks ctx between frames and stops
+// early if it's canceled.
+func decodeSegment(ctx context.Context, stream *bytes.Reader, opts decodeOptions) (header, [][]byte, []FrameType, error) {
+	seg, err := splitSegment(ctx, stream, opts)
+	if err != nil {
+		return seg.hdr, nil, nil, err
+	}
+
+	// The stored frames aren't needed once they're reconstructed, so we let the reconstructor
+	// work on them in place.
+	r := newReconstructor(&seg, false, opts.lumaOnly)
+	frames := make([][]byte, seg.hdr.FrameCount)
+	types := make([]FrameType, seg.hdr.FrameCount)
+	for i := range frames {
+		if err := ctx.Err(); err != nil {
+			return seg.hdr, nil, nil, err
+		}
+		types[i] = seg.frameType(i)
+		frames[i] = r.frame(i)
+		if opts.lumaOnly {
+			frames[i] = lumaPlane(frames[i], seg.hdr)
+		}
+		if seg.hdr.LumaStep > 1 {
+			// The reconstructor still needs the quantized frame as a reference.
+			frames[i] = append([]byte(nil), frames[i]...)
+			dequantizeLuma(frames[i][:seg.hdr.Width*seg.hdr.Height], int(seg.hdr.LumaStep))
+		}
+	}
+	if seg.hdr.letterboxed() {
+		// The frames are of the picture between the bars, so we paint the bars back around it.
+		hdr := letterboxedHeader(seg.hdr)
+		for i := range frames {
+			frames[i] = addBars(frames[i], hdr, opts.lumaOnly)
+		}
+		return hdr, frames, types, nil
+	}
+	if !seg.hdr.Interlaced {
+		return seg.hdr, frames, types, nil
+	}
+
+	// What we have so far are the fields, which we weave back into frames. A frame can be
+	// decoded on its own if its top field can, since the bottom field comes after it.
+	hdr := frameHeader(seg.hdr)
+	woven := make([][]byte, hdr.FrameCount)
+	for i := range woven {
+		top, bottom := frames[2*i], frames[2*i+1]
+		if opts.lumaOnly {
+			woven[i] = weaveRows(top, bottom, int(hdr.Width))
+		} else {
+			woven[i] = weaveFields(top, bottom, hdr)
+		}
+		types[i] = types[2*i]
+	}
+	return hdr, woven, types[:hdr.FrameCount], nil
+}
+
+// storedSegment is a segment that's been split into frames as they're stored, before any of the
+// prediction is undone.
+type storedSegment struct {
+	hdr     header
+	frames  [][]byte
+	types   []FrameType
+	corrupt []bool
+
+	// tiles holds each tile's own segment if the segment is tiled, in which case frames is nil.
+	tiles []storedSegment
+}
+
+// isKeyframe returns whether frame i can be reconstructed without the frames before it. For a
+// tiled segment, that's only true if every tile has a keyframe there.
+func (s *storedSegment) isKeyframe(i int) bool {
+	return s.frameType(i).independent()
+}
+
+// frameType returns the type of frame i. In a tiled segment, each tile has a type of its own.
+// If they're all the same, that's the type of the frame. Otherwise, the frame is a keyframe if
+// none of the tiles depend on the frames before them, and a P-frame if any do.
+func (s *storedSegment) frameType(i int) FrameType {
+	if s.tiles == nil {
+		return s.types[i]
+	}
+	typ := s.tiles[0].frameType(i)
+	for k := range s.tiles[1:] {
+		typ = mergeFrameTypes(typ, s.tiles[k+1].frameType(i))
+	}
+	return typ
+}
+
+// mergeFrameTypes returns the type of a frame made of two tiles of types a and b.
+func mergeFrameTypes(a, b FrameType) FrameType {
+	switch {
+	case a == b:
+		return a
+	case a.independent() && b.independent():
+		return KeyFrame
+	default:
+		return PFrame
+	}
+}
+
+// splitSegment reads a single segment from the encoded stream and splits it into frames.
+func splitSegment(ctx context.Context, stream *bytes.Reader, opts decodeOptions) (storedSegment, error) {
+	// First, we read the header. From here on, we only use what the header tells us about the
+	// video, just like a real decoder would.
+	var seg storedSegment
+	hdr := &seg.hdr
+	if err := binary.Read(stream, binary.BigEndian, hdr); err != nil {
+		return seg, fmt.Errorf("read header: %w: %v", ErrCorrupt, err)
+	}
+	if hdr.Version != formatVersion {
+		return seg, fmt.Errorf("read header: unsupported format version %d, expected %d", hdr.Version, formatVersion)
+	}
+
+	// The header could be corrupt too, and everything after this point trusts it to tell us
+	// how to slice up the frames, so we have to check it first.
+	if err := hdr.validate(); err != nil {
+		return seg, fmt.Errorf("read header: %w", err)
+	}
+	width, height := int(hdr.Width), int(hdr.Height)
+	frameSize := hdr.frameSize()
+	maxStoredSize := frameSize
+	if hdr.BlockSkip {
+		// A P-frame could have every block changed, in which case it stores the whole frame as
+		// well as the bitmap.
+		maxStoredSize += blockBitmapSize(*hdr)
+	}
+	if n := frameSize + len(yuvPlanes(*hdr)); hdr.Symmetry && n > maxStoredSize {
+		// Similarly, a keyframe could have no symmetry at all, in which case it stores the whole
+		// frame as well as a byte for each plane.
+		maxStoredSize = n
+	}
+	// Each frame is preceded by a 1 byte frame type and 4 byte length, and followed by a 4 byte
+	// checksum.
+	maxSize := int(hdr.FrameCount) * (1 + 4 + maxStoredSize + 4)
+
+	// Before we allocate anything for the frames, we check that there could be that many of them
+	// in what's left of the stream. Otherwise, a corrupt header claiming billions of frames would
+	// have us allocate gigabytes before we found out it was lying. Stored frames take up their
+	// full size. Compressed frames take up at least the type, length and checksum once inflated,
+	// and DEFLATE can't compress anything by more than maxDeflateRatio.
+	minSize := int64(hdr.FrameCount) * (1 + 4 + 4)
+	if hdr.Repeats && hdr.FrameCount > 0 {
+		// A single repeat can stand for any number of frames, so all we know is that there's at
+		// least one frame stored.
+		minSize = 1 + 4 + 4
+	}
+	available := int64(stream.Len()) * maxDeflateRatio
+	if hdr.Stored {
+		minSize, available = int64(hdr.FrameCount)*int64(frameSize), int64(stream.Len())
+	}
+	// With opts.tolerant, we keep whatever frames were written before the stream was cut off.
+	// For stored frames, we can tell how many that is right away.
+	truncated := false
+	if opts.tolerant && hdr.Stored && hdr.TileSize == 0 && minSize > available {
+		n := stream.Len() / frameSize
+		if hdr.Interlaced {
+			n -= n % 2
+		}
+		opts.logf("The stream ends partway through frame %d of %d, keeping the frames before it", n, hdr.FrameCount)
+		hdr.FrameCount, minSize, truncated = uint32(n), int64(n)*int64(frameSize), true
+	}
+	if minSize > available {
+		return seg, fmt.Errorf("read header: %w: %d frames can't fit in the %d bytes left", ErrCorrupt, hdr.FrameCount, stream.Len())
+	}
+
+	// We hold every frame of the segment in memory at once, so a long enough video (or a corrupt
+	// header claiming one) could use up all of it. Better to say so up front than get killed
+	// partway through.
+	if opts.maxMemory > 0 && maxSize > opts.maxMemory {
+		return seg, fmt.Errorf("decoding %d frames of %dx%d needs up to %d bytes of memory, more than the %d bytes allowed",
+			hdr.FrameCount, width, height, maxSize, opts.maxMemory)
+	}
+
+	// A tiled segment is made up of a segment for each tile, which we split one at a time.
+	if hdr.TileSize > 0 {
+		tiles, err := splitTiles(ctx, stream, *hdr, opts)
+		seg.tiles = tiles
+		return seg, err
+	}
+
+	seg.frames = make([][]byte, hdr.FrameCount)
+	seg.types = make([]FrameType, hdr.FrameCount)
+	seg.corrupt = make([]bool, hdr.FrameCount)
+
+	// If the encoder gave up on compressing the frames, they're right there in the stream. Each
+	// of them is already the finished frame, so as far as reconstructing goes, they're all
+	// keyframes.
+	if hdr.Stored {
+		for i := range seg.frames {
+			if err := ctx.Err(); err != nil {
+				return seg, err
+			}
+			seg.frames[i] = make([]byte, frameSize)
+			if _, err := io.ReadFull(stream, seg.frames[i]); err != nil {
+				return seg, fmt.Errorf("read stored frames: %w: ended partway through frame %d of %d", ErrCorrupt, i, hdr.FrameCount)
+			}
+		}
+		if truncated {
+			// What's left is the start of the frame that was cut off.
+			stream.Seek(0, io.SeekEnd)
+		}
+		return seg, nil
+	}
+
+	// Next, we will decode the DEFLATE stream. Since stream is an io.ByteReader, the DEFLATE
+	// reader won't read past the end of this segment. We also stop reading just past the most
+	// we could possibly need, so a corrupt stream can't make us inflate an unbounded amount of data.
+	var inflated bytes.Buffer
+	r, err := codecs[hdr.Compression].NewReader(stream)
+	if err != nil {
+		return seg, fmt.Errorf("inflate: %w: %v", ErrCorrupt, err)
+	}
+	_, err = io.Copy(&inflated, io.LimitReader(r, int64(maxSize)+1))
+	switch {
+	case opts.tolerant && errors.Is(err, io.ErrUnexpectedEOF):
+		// The compressed frames were cut off, but everything inflated up to that point is
+		// fine. We find out which frame the stream ends in when we split them below.
+		truncated = true
+	case err != nil:
+		// Either the stream ends before DEFLATE's end of block, or it isn't valid DEFLATE.
+		return seg, fmt.Errorf("inflate: %w: %v", ErrCorrupt, err)
+	default:
+		if err := r.Close(); err != nil {
+			return seg, fmt.Errorf("inflate: %w: %v", ErrCorrupt, err)
+		}
+	}
+
+	// cutShort drops frame i, which the stream ends partway through, and the frames after it.
+	cutShort := func(i int) (storedSegment, error) {
+		opts.logf("The stream ends partway through frame %d of %d, keeping the frames before it", i, hdr.FrameCount)
+		if hdr.Interlaced {
+			// Without its bottom field, we'd have half a frame.
+			i -= i % 2
+		}
+		hdr.FrameCount = uint32(i)
+		seg.frames, seg.types, seg.corrupt = seg.frames[:i], seg.types[:i], seg.corrupt[:i]
+		return seg, nil
+	}
+
+	// Split the inflated stream into frames, checking each one against its checksum.
+	frames, types := seg.frames, seg.types
+	for i := 0; i < len(frames); i++ {
+		if err := ctx.Err(); err != nil {
+			return seg, err
+		}
+		if inflated.Len() < 1 {
+			if truncated {
+				return cutShort(i)
+			}
+			return seg, fmt.Errorf("split frames: %w: ended partway through frame %d of %d", ErrCorrupt, i, hdr.FrameCount)
+		}
+		types[i] = FrameType(inflated.Next(1)[0])
+
+		// Next is the length of the stored frame. We could work it out from the header and the
+		// start of the frame, but if we get it even slightly wrong, every frame after this one
+		// gets split in the wrong place. With the length written down, a frame that isn't the
+		// size we expect is just one corrupt frame.
+		if inflated.Len() < 4 {
+			if truncated {
+				return cutShort(i)
+			}
+			return seg, fmt.Errorf("split frames: %w: ended partway through frame %d of %d", ErrCorrupt, i, hdr.FrameCount)
+		}
+		storedSize := int(binary.BigEndian.Uint32(inflated.Next(4)))
+		if storedSize > maxStoredSize {
+			return seg, fmt.Errorf("split frames: %w: frame %d is %d bytes, more than the %d bytes a frame can be", ErrCorrupt, i, storedSize, maxStoredSize)
+		}
+		if inflated.Len() < storedSize+4 {
+			if truncated {
+				return cutShort(i)
+			}
+			return seg, fmt.Errorf("split frames: %w: ended partway through frame %d of %d", ErrCorrupt, i, hdr.FrameCount)
+		}
+		frames[i] = inflated.Next(storedSize)
+
+		var err error
+		switch {
+		case binary.BigEndian.Uint32(inflated.Next(4)) != frameChecksum(types[i], frames[i]):
+			err = fmt.Errorf("split frames: %w: frame %d: checksum mismatch", ErrCorrupt, i)
+		case frameTypeNames[types[i]] == "":
+			err = fmt.Errorf("split frames: %w: frame %d: unknown frame type %d", ErrCorrupt, i, types[i])
+		case i == 0 && !types[i].independent():
+			err = fmt.Errorf("split frames: %w: frame %d: the first frame must be a keyframe", ErrCorrupt, i)
+		default:
+			err = checkStoredSize(frames[i], types[i], *hdr)
+			if err != nil {
+				err = fmt.Errorf("split frames: %w: frame %d: %v", ErrCorrupt, i, err)
+			}
+		}
+		if err != nil {
+			if !opts.skipCorrupt {
+				return seg, err
+			}
+			opts.logf("Frame %d is corrupt, replacing it with the previous frame", i)
+			seg.corrupt[i] = true
+			continue
+		}
+
+		// A repeat stands for as many frames as it says, which are all repeats of the frame
+		// before them.
+		if types[i] == RepeatFrame {
+			n := int(binary.BigEndian.Uint32(frames[i]))
+			if n < 1 || n > len(frames)-i {
+				if !opts.skipCorrupt {
+					return seg, fmt.Errorf("split frames: %w: frame %d: repeats %d frames, but there are %d left", ErrCorrupt, i, n, len(frames)-i)
+				}
+				opts.logf("Frame %d is corrupt, replacing it with the previous frame", i)
+				seg.corrupt[i] = true
+				continue
+			}
+			for k := 1; k < n; k++ {
+				types[i+k] = RepeatFrame
+			}
+			i += n - 1
+		}
+	}
+	if inflated.Len() != 0 {
+		return seg, fmt.Errorf("split frames: %w: %d unexpected bytes after the last frame", ErrCorrupt, inflated.Len())
+	}
+
+	// A P-frame is a delta against the frames before it, so after a corrupt frame, every P-frame
+	// up to the next keyframe would be added to the wrong frame and come out as garbage. We skip
+	// those too, and pick up again at the next keyframe. The type of a corrupt frame can't be
+	// trusted, so it doesn't count as one.
+	for i := 0; i < len(frames); i++ {
+		if !seg.corrupt[i] {
+			continue
+		}
+		j := i + 1
+		for j < len(frames) && (seg.corrupt[j] || !types[j].independent()) {
+			seg.corrupt[j] = true
+			j++
+		}
+		switch {
+		case j == i+1:
+		case j < len(frames):
+			opts.logf("Frames %d to %d depend on a corrupt frame, skipping them until the keyframe at frame %d", i+1, j-1, j)
+		default:
+			opts.logf("Frames %d to %d depend on a corrupt frame, and there's no keyframe after it to skip to", i+1, j-1)
+		}
+		i = j
+	}
+	return seg, nil
+}
+
+// checkStoredSize checks that a stored frame is the size that its type, the header and the start
+// of the frame say it should be. Otherwise, reconstructing it would read past its end.
+func checkStoredSize(stored []byte, typ FrameType, hdr header) error {
+	size := hdr.frameSize()
+	switch {
+	case typ == RepeatFrame:
+		// Repeats are how many frames they stand for.
+		size = 4
+	case typ == SolidFrame:
+		// Solid frames are a byte for each plane, which only planar frames have.
+		if hdr.Layout != layoutPlanar {
+			return fmt.Errorf("solid frames must be planar")
+		}
+		size = len(yuvPlanes(hdr))
+	case hdr.BlockSkip && typ == PFrame:
+		// With -block-skip, P-frames start with a bitmap that tells us how many blocks follow.
+		if len(stored) < blockBitmapSize(hdr) {
+			return fmt.Errorf("%d bytes is too short for the block bitmap", len(stored))
+		}
+		size = skippedFrameSize(stored[:blockBitmapSize(hdr)], hdr)
+	case hdr.Symmetry && typ == KeyFrame:
+		// With -exploit-symmetry, keyframes start with a byte for each plane that tells us how
+		// much of it is stored.
+		n := len(yuvPlanes(hdr))
+		if len(stored) < n {
+			return fmt.Errorf("%d bytes is too short for the mirroring of each plane", len(stored))
+		}
+		var err error
+		if size, err = foldedFrameSize(stored[:n], hdr); err != nil {
+			return err
+		}
+	}
+	if len(stored) != size {
+		return fmt.Errorf("frame is %d bytes, expected %d", len(stored), size)
+	}
+	return nil
+}
+
+// splitTiles reads the segment of each tile of a tiled segment.
+func splitTiles(ctx context.Context, stream *bytes.Reader, hdr header, opts decodeOptions) ([]storedSegment, error) {
+	var tiles []storedSegment
+	for i, t := range tileRects(hdr) {
+		var n uint32
+		if err := binary.Read(stream, binary.BigEndian, &n); err != nil {
+			return nil, fmt.Errorf("read tile %d: %w", i, err)
+		}
+		if int64(n) > int64(stream.Len()) {
+			return nil, fmt.Errorf("read tile %d: %w: tile is %d bytes, but only %d are left", i, ErrCorrupt, n, stream.Len())
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(stream, data); err != nil {
+			return nil, fmt.Errorf("read tile %d: %w", i, err)
+		}
+
+		tileSeg, err := splitSegment(ctx, bytes.NewReader(data), opts)
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: %w", i, err)
+		}
+		want := tileHeader(hdr, t)
+		want.FrameCount, want.Stored = hdr.FrameCount, tileSeg.hdr.Stored
+		if tileSeg.hdr != want {
+			return nil, fmt.Errorf("read tile %d: %w: tile doesn't match the segment it's in", i, ErrCorrupt)
+		}
+		tiles = append(tiles, tileSeg)
+	}
+	return tiles, nil
+}
+
+// reconstructor turns the stored frames of a segment back into YUV frames. Since every P-frame
+// is a delta against the frames before it, the frames have to be reconstructed in order,
+// starting from a keyframe.
+type reconstructor struct {
+	seg *storedSegment
+
+	// keep makes the reconstructor copy the stored frames instead of working on them in place,
+	// so they can be reconstructed again later.
+	keep bool
+
+	// ref is the frame the next P-frame is a delta against, which we keep up to date the same
+	// way the encoder does, with the help of history. prev is the frame reconstructed last.
+	ref, prev []byte
+	history   [][]byte
+
+	// lumaOnly skips reconstructing the U, V and alpha planes of planar frames where that saves
+	// any work, leaving garbage in them. Nothing in the Y plane depends on the other planes, so
+	// it still comes out right.
+	lumaOnly bool
+
+	// tiles reconstructs each tile of a tiled segment.
+	tiles []*reconstructor
+}
+
+func newReconstructor(seg *storedSegment, keep, lumaOnly bool) *reconstructor {
+	r := &reconstructor{seg: seg, keep: keep, lumaOnly: lumaOnly}
+	for k := range seg.tiles {
+		r.tiles = append(r.tiles, newReconstructor(&seg.tiles[k], keep, lumaOnly))
+	}
+	return r
+}
+
+// frame reconstructs frame i, which must be a keyframe or the frame after the last one.
+func (r *reconstructor) frame(i int) []byte {
+	hdr := r.seg.hdr
+	if r.tiles != nil {
+		frame := make([]byte, hdr.frameSize())
+		for k, t := range tileRects(hdr) {
+			insertTile(frame, r.tiles[k].frame(i), hdr, t)
+		}
+		return frame
+	}
+
+	frame := r.seg.frames[i]
+	if r.keep {
+		frame = append([]byte(nil), frame...)
+	}
+
+	// For every P-frame, we need to add the previous frame to the delta frame. This is the
+	// opposite of what we did in the encoder. Keyframes may need their spatial prediction undone.
+	//
+	// If a frame is corrupt, or depends on one that is, we show the previous frame again instead,
+	// until the next keyframe. See splitSegment. If there's no previous frame, we show a black
+	// frame.
+	switch {
+	case hdr.Stored:
+		// Stored frames are already finished.
+	case r.seg.corrupt[i] && r.prev == nil:
+		frame = packFrame(blackFrame(hdr), hdr.Layout, int(hdr.Width), int(hdr.Height))
+	case r.seg.corrupt[i], r.seg.types[i] == RepeatFrame:
+		frame = append([]byte(nil), r.prev...)
+	case r.seg.types[i] == SolidFrame:
+		frame = solidFrame(frame, hdr)
+	case r.seg.types[i] == KeyFrame && hdr.Symmetry:
+		frame = unfoldFrame(frame, hdr)
+	case r.seg.types[i] == KeyFrame:
+		if hdr.Predictor == predictorMedian && r.lumaOnly {
+			unpredictMedian(r.planes(frame), int(hdr.Width), int(hdr.Height))
+		} else if hdr.Predictor == predictorMedian {
+			unpredictFrame(frame, hdr)
+		}
+	case hdr.BlockSkip:
+		frame = unskipBlocks(frame, r.ref, hdr)
+	default:
+		planes := r.planes(frame)
+		if hdr.ZigZag {
+			zigzagDecode(planes)
+		}
+		add(planes, r.ref)
+	}
+
+	switch {
+	case hdr.RefDistance > 1:
+		if r.seg.types[i].independent() {
+			r.history = r.history[:0]
+		} else if len(r.history) == int(hdr.RefDistance) {
+			r.history = r.history[1:]
+		}
+		r.history = append(r.history, frame)
+		r.ref = r.history[0]
+	case hdr.Reference != referenceAverage:
+		r.ref = frame
+	case r.ref == nil || r.seg.types[i].independent():
+		r.ref = append([]byte(nil), frame...)
+	default:
+		updateAverage(r.ref, frame)
+	}
+	r.prev = frame
+	return frame
+}
+
+// planes returns the part of a stored keyframe or P-frame that we reconstruct where we have the
+// choice, which with lumaOnly is just the Y plane. Repeats, solid frames and corrupt frames don't
+// store a whole frame, so there's nothing to slice.
+func (r *reconstructor) planes(frame []byte) []byte {
+	if r.lumaOnly && r.seg.hdr.Layout == layoutPlanar {
+		return frame[:r.seg.hdr.Width*r.seg.hdr.Height]
+	}
+	return frame
+}
+
+// Decoder decodes the frames of an encoded video in any order, which is what a player needs to
+// scrub through a timeline.
+//
+// A DEFLATE stream can only be inflated from the start, and nothing says where a segment ends
+// but the end of its DEFLATE stream, so NewDecoder reads through the video once to find where
+// each segment starts and how many frames it has. After that, the Decoder only holds on to the
+// segment the current frame is in, inflating it when a frame in it is first needed and dropping
+// it when moving on to another one. Within a segment, it saves on the reconstruction: to get to
+// a frame, the Decoder only has to start from the nearest keyframe before it and apply the
+// P-frames from there, instead of starting from the beginning of the video. The more often
+// there are keyframes (see -keyframe-interval), the less work a seek takes.
+type Decoder struct {
+	data []byte
+
+	// offsets is where each segment starts in data.
+	offsets []int
+
+	// first is the index of the first frame of each segment, plus the total frame count at the end.
+	first []int
+
+	// pos is the index of the frame ReadFrame returns next.
+	pos int
+
+	// loaded is the only segment the Decoder holds at a time, and seg is its index, or -1 if it
+	// holds none.
+	loaded storedSegment
+	seg    int
+
+	// r is reconstructing the loaded segment, and next is the frame in it that it can
+	// reconstruct next.
+	r    *reconstructor
+	next int
+}
+
+// NewDecoder finds the segments of an encoded video so its frames can be decoded by Seek and
+// ReadFrame. Like Decode, it stops and returns ctx.Err() if ctx is canceled.
+func NewDecoder(ctx context.Context, data []byte) (*Decoder, error) {
+	d := &Decoder{data: data, first: []int{0}, seg: -1}
+	stream := bytes.NewReader(data)
+	for stream.Len() > 0 {
+		// Splitting the segment is the only way to find its end. Its frames aren't kept, so
+		// only one segment is ever in memory.
+		offset := len(data) - stream.Len()
+		seg, err := splitSegment(ctx, stream, decodeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		d.offsets = append(d.offsets, offset)
+		frames := int(seg.hdr.FrameCount)
+		if seg.hdr.Interlaced {
+			frames /= 2
+		}
+		d.first = append(d.first, d.first[len(d.first)-1]+frames)
+	}
+	return d, nil
+}
+
+// FrameCount returns the number of frames in the video.
+func (d *Decoder) FrameCount() int {
+	return d.first[len(d.first)-1]
+}
+
+// Seek makes frameIndex the next frame ReadFrame returns.
+func (d *Decoder) Seek(frameIndex int) error {
+	if frameIndex < 0 || frameIndex > d.FrameCount() {
+		return fmt.Errorf("seek to frame %d: out of range, the video has %d frames", frameIndex, d.FrameCount())
+	}
+	d.pos = frameIndex
+	return nil
+}
+
+// ReadFrame decodes the next YUV frame and returns it along with the header of the segment it's
+// in, or returns io.EOF after the last frame.
+func (d *Decoder) ReadFrame() (header, []byte, error) {
+	if d.pos >= d.FrameCount() {
+		return header{}, nil, io.EOF
+	}
+	s := sort.SearchInts(d.first, d.pos+1) - 1
+	seg, err := d.segment(s)
+	if err != nil {
+		return header{}, nil, err
+	}
+	i := d.pos - d.first[s]
+	if seg.hdr.Interlaced {
+		// The segment is made up of fields. We reconstruct both fields of the frame and weave
+		// them together.
+		top, bottom := d.readPicture(seg, 2*i), d.readPicture(seg, 2*i+1)
+		d.pos++
+		hdr := frameHeader(seg.hdr)
+		return hdr, weaveFields(top, bottom, hdr), nil
+	}
+	frame := d.readPicture(seg, i)
+	d.pos++
+	if seg.hdr.letterboxed() {
+		hdr := letterboxedHeader(seg.hdr)
+		return hdr, addBars(frame, hdr, false), nil
+	}
+	return seg.hdr, frame, nil
+}
+
+// segment returns segment s, splitting it first unless it's the one the Decoder already holds.
+// The one it held before is dropped, along with the reconstructor working on it.
+func (d *Decoder) segment(s int) (*storedSegment, error) {
+	if d.seg != s {
+		d.loaded, d.seg, d.r = storedSegment{}, -1, nil
+		seg, err := splitSegment(context.Background(), bytes.NewReader(d.data[d.offsets[s]:]), decodeOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", s, err)
+		}
+		d.loaded, d.seg = seg, s
+	}
+	return &d.loaded, nil
+}
+
+// readPicture reconstructs frame i of the loaded segment seg, which is a field if the segment is
+// interlaced.
+func (d *Decoder) readPicture(seg *storedSegment, i int) []byte {
+	// If we can't just carry on from the last frame we reconstructed, we go back to the nearest
+	// keyframe and reconstruct forward from there. The first frame of a segment is always a
+	// keyframe, so this can't go past the start of the segment.
+	if d.r == nil || d.next > i {
+		k := i
+		for !seg.isKeyframe(k) {
+			k--
+		}
+		d.r, d.next = newReconstructor(seg, true, false), k
+	}
+	for ; d.next < i; d.next++ {
+		d.r.frame(d.next)
+	}
+	frame := d.r.frame(i)
+	d.next++
+
+	// The reconstructor may still need the frame as a reference, so the caller gets a copy.
+	frame = append([]byte(nil), frame...)
+	if seg.hdr.LumaStep > 1 {
+		dequantizeLuma(frame[:seg.hdr.Width*seg.hdr.Height], int(seg.hdr.LumaStep))
+	}
+	return frame
+}
+
+// Next decodes the next frame and returns it as rgb24 (or rgba, if the video has an alpha
+// channel) with the padding cropped off, or returns io.EOF after the last frame. It's the
+// decoding counterpart to FrameWriter: frames come out one at a time, and the Decoder only holds
+// on to the segment they're in and the frames it needs as references, so a long video can be
+// processed without having all of it inflated, or every decoded frame, in memory at once.
+func (d *Decoder) Next() ([]byte, error) {
+	hdr, frame, err := d.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	width, height := int(hdr.Width), int(hdr.Height)
+	frame = unpackFrame(frame, hdr)
+	bytesPerPixel := 3
+	if hdr.Alpha {
+		bytesPerPixel = 4
+	}
+	return cropFrame(convertToRGB(frame, hdr), width, height, width-int(hdr.PadRight), height-int(hdr.PadBottom), bytesPerPixel), nil
+}
+
+// lumaPlane returns the Y plane of a frame.
+func lumaPlane(frame []byte, hdr header) []byte {
+	width, height := int(hdr.Width), int(hdr.Height)
+	if hdr.Layout == layoutPacked {
+		frame = unpackYUYV(frame, width, height)
+	}
+	// Planar and NV12 frames both start with the Y plane.
+	return frame[:width*height]
+}
+
+// blackFrame returns an opaque black planar frame.
+func blackFrame(hdr header) []byte {
+	// Black has no color, which is 128 in U and V.
+	color := []byte{0, 128, 128, 255}
+	return solidFrame(color[:len(yuvPlanes(hdr))], hdr)
+}
+
+// isSolidFrame returns whether every plane of a planar frame is a single value.
+func isSolidFrame(frame []byte, hdr header) bool {
+	for _, p := range yuvPlanes(hdr) {
+		plane := frame[p.offset : p.offset+p.width*p.height]
+		for _, b := range plane {
+			if b != plane[0] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// solidColor returns the value of each plane of a solid planar frame, which is how it's stored.
+func solidColor(frame []byte, hdr header) []byte {
+	var color []byte
+	for _, p := range yuvPlanes(hdr) {
+		color = append(color, frame[p.offset])
+	}
+	return color
+}
+
+// solidFrame reverses solidColor, filling each plane of a planar frame with its value.
+func solidFrame(color []byte, hdr header) []byte {
+	planes := yuvPlanes(hdr)
+	last := planes[len(planes)-1]
+	frame := make([]byte, last.offset+last.width*last.height)
+	for k, p := range planes {
+		plane := frame[p.offset : p.offset+p.width*p.height]
+		for j := range plane {
+			plane[j] = color[k]
+		}
+	}
+	return frame
+}
+
+// convertToRGB converts a planar YUV frame back to rgb24, or to rgba if it has an alpha
+// plane.
+func convertToRGB(frame []byte, hdr header) []byte {
+	width, height := int(hdr.Width), int(hdr.Height)
+	planes := yuvPlanes(hdr)
+	Y, U, V := frame[planes[0].offset:], frame[planes[1].offset:], frame[planes[2].offset:]
+	var A []byte
+	if hdr.Alpha {
+		A = frame[planes[3].offset:]
+	}
+	sx, sy := chromaSubsampling(hdr.Subsampling)
+	bytesPerPixel := 3
+	if hdr.Alpha {
+		bytesPerPixel = 4
+	}
+	t := &rgbTables[hdr.Range]
+
+	// Each U and V sample is shared by sx pixels in a row, so we work out its part of each
+	// channel once and reuse it for all of them.
+	rgb := make([]byte, width*height*bytesPerPixel)
+	out := rgb
+	for j := 0; j < height; j++ {
+		row := (j / sy) * (width / sx)
+		for c := 0; c < width/sx; c++ {
+			u, v := U[row+c], V[row+c]
+			rv, guv, bu := t.rv[v], t.gu[u]+t.gv[v], t.bu[u]
+			for k := c * sx; k < (c+1)*sx; k++ {
+				y := t.y[Y[j*width+k]]
+				out[0] = fixedToByte(y + rv)
+				out[1] = fixedToByte(y + guv)
+				out[2] = fixedToByte(y + bu)
+				if hdr.Alpha {
+					out[3] = A[j*width+k]
+				}
+				out = out[bytesPerPixel:]
+			}
+		}
+	}
+	return rgb
+}
+
+// rgbTable holds each term of the conversion from YUV to RGB for every possible value of Y, U
+// and V, in fixed point with fixedBits bits after the point. Converting a pixel works out
+//
+//	r = y + 1.402 * v
+//	g = y - 0.344 * u - 0.714 * v
+//	b = y + 1.772 * u
+//
+// where u and v are centered on zero. Done with floats, that's three multiplies per channel for
+// every pixel, which is most of the time it takes to decode. But since Y, U and V are only ever
+// one of 256 values, each term is too, and we can work them all out once up front. Then
+// converting a pixel is a few lookups and integer adds. Fixed point keeps the fractions, so the
+// result comes out the same as with floats, except for the odd value that lands within a rounding
+// error of a whole number and ends up one off.
+type rgbTable struct {
+	y, rv, gu, gv, bu [256]int32
+}
+
+const fixedBits = 16
+
+// rgbTables has a table for each range.
+var rgbTables = [...]rgbTable{
+	rangeFull:    newRGBTable(rangeFull),
+	rangeLimited: newRGBTable(rangeLimited),
+}
+
+func newRGBTable(colorRange uint8) rgbTable {
+	fixed := func(x float64) int32 {
+		return int32(math.Round(x * (1 << fixedBits)))
+	}
+	var t rgbTable
+	for i := 0; i < 256; i++ {
+		y, c := float64(i), float64(i)-128
+		if colorRange == rangeLimited {
+			// Stretch the values back out to the full range.
+			y = (y - 16) * 255 / 219
+			c = c * 255 / 224
+		}
+		t.y[i] = fixed(y)
+		t.rv[i] = fixed(1.402 * c)
+		t.gu[i] = fixed(-0.344 * c)
+		t.gv[i] = fixed(-0.714 * c)
+		t.bu[i] = fixed(1.772 * c)
+	}
+	return t
+}
+
+// fixedToByte rounds a fixed point value down to a whole number and clamps it to a byte.
+func fixedToByte(x int32) byte {
+	switch {
+	case x < 0:
+		return 0
+	case x >= 256<<fixedBits:
+		return 255
+	}
+	return byte(x >> fixedBits)
+}
+
+// rgbImage wraps an rgb24 (or rgba, if bytesPerPixel is 4) frame in an image.RGBA.
+func rgbImage(frame []byte, width, height, bytesPerPixel int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for j := 0; j < width*height; j++ {
+		copy(img.Pix[4*j:4*j+3], frame[bytesPerPixel*j:])
+		img.Pix[4*j+3] = 255
+	}
+	return img
+}
+
+// frameImage wraps a decoded rgb24 (or rgba, if bytesPerPixel is 4) frame in an image, keeping
+// its alpha channel if it has one.
+func frameImage(frame []byte, width, height, bytesPerPixel int) image.Image {
+	if bytesPerPixel != 4 {
+		return rgbImage(frame, width, height, bytesPerPixel)
+	}
+	// rgba frames aren't premultiplied, and neither is image.NRGBA, so they're the same thing.
+	return &image.NRGBA{Pix: frame, Stride: 4 * width, Rect: image.Rect(0, 0, width, height)}
+}
+
+// comparisonImage puts an original frame, the decoded frame and the difference between them side
+// by side, in that order.
+//
+// Most of the difference comes from throwing away chroma samples, and it's far too subtle to see
+// by looking at the two frames. So in the difference, each channel is the difference between the
+// two frames multiplied by diffScale. Black means the frames are the same there, and the
+// brighter it is, the more the encoder changed it. Look for the errors along the edges of colored
+// objects, where neighboring pixels that shared a U and V sample didn't have the same color. The
+// conversion to YUV and back isn't exact either, which tints the whole difference slightly.
+func comparisonImage(original, decoded []byte, width, height, bytesPerPixel int) *image.RGBA {
+	const diffScale = 8
+	img := image.NewRGBA(image.Rect(0, 0, 3*width, height))
+	draw.Draw(img, image.Rect(0, 0, width, height), rgbImage(original, width, height, bytesPerPixel), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(width, 0, 2*width, height), rgbImage(decoded, width, height, bytesPerPixel), image.Point{}, draw.Src)
+	for i := 0; i < height; i++ {
+		for j := 0; j < width; j++ {
+			a, b := original[bytesPerPixel*(i*width+j):], decoded[bytesPerPixel*(i*width+j):]
+			pix := img.Pix[img.PixOffset(2*width+j, i):]
+			for c := 0; c < 3; c++ {
+				d := int(a[c]) - int(b[c])
+				if d < 0 {
+					d = -d
+				}
+				pix[c] = uint8(clamp(float64(d*diffScale), 0, 255))
+			}
+			pix[3] = 255
+		}
+	}
+	return img
+}
+
+// writeFrames writes frames one after another to a file at path, gzipped if gz is set.
+func writeFrames(path string, frames [][]byte, gz bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+	for _, frame := range frames {
+		if _, err := w.Write(frame); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// writePlanes writes each plane of a YUV frame to a grayscale PNG in dir, named after the plane
+// and its dimensions, like u-192x108.png, so that it's clear how much smaller the chroma is.
+func writePlanes(dir string, frame []byte, hdr header) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	frame = unpackFrame(frame, hdr)
+	for k, p := range yuvPlanes(hdr) {
+		img := &image.Gray{
+			Pix:    frame[p.offset : p.offset+p.width*p.height],
+			Stride: p.width,
+			Rect:   image.Rect(0, 0, p.width, p.height),
+		}
+		name := fmt.Sprintf("%s-%dx%d.png", []string{"y", "u", "v", "a"}[k], p.width, p.height)
+		if err := writePNG(filepath.Join(dir, name), img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePNG writes img to a PNG file at path.
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// gifSize returns the size of frames when encoded as an animated GIF that shows each of them for
+// delay hundredths of a second.
+//
+// GIF makes the opposite trade to ours. Instead of keeping every pixel's brightness and throwing
+// away color detail, it keeps all of the detail but only 256 colors, from a palette. We use the
+// 216 colors of the web-safe palette, and each pixel becomes the nearest of them, so smooth
+// gradients turn into bands. Like our P-frames, it can also take advantage of frames being
+// similar: each frame is drawn on top of the one before it, so wherever a pixel comes out the
+// same color as before, we make it transparent. Those runs of the same transparent index are
+// what GIF's LZW compression does best with, much like our runs of zero deltas with DEFLATE.
+func gifSize(frames [][]byte, width, height, bytesPerPixel, delay int) (int, error) {
+	pal := append(color.Palette(nil), palette.WebSafe...)
+	transparent := uint8(len(pal))
+	pal = append(pal, color.Transparent)
+
+	anim := &gif.GIF{}
+	var prev *image.Paletted
+	for _, frame := range frames {
+		img := image.NewPaletted(image.Rect(0, 0, width, height), pal)
+		draw.Draw(img, img.Rect, rgbImage(frame, width, height, bytesPerPixel), image.Point{}, draw.Src)
+		stored := img
+		if prev != nil {
+			stored = image.NewPaletted(img.Rect, pal)
+			for j, c := range img.Pix {
+				if c == prev.Pix[j] {
+					c = transparent
+				}
+				stored.Pix[j] = c
+			}
+		}
+		anim.Image = append(anim.Image, stored)
+		anim.Delay = append(anim.Delay, delay)
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+		prev = img
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
+
+// jpegFrameSize returns the size of a frame when JPEG encoded at the given quality.
+func jpegFrameSize(frame []byte, width, height, bytesPerPixel, quality int) (int, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, rgbImage(frame, width, height, bytesPerPixel), &jpeg.Options{Quality: quality}); err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
+
+// selfTest encodes and decodes a small generated clip of a diagonal gradient sliding across the
+// frame, and returns the PSNR of the result. It doesn't need any input, so it's a quick way to
+// check that everything works.
+func selfTest() (float64, error) {
+	const width, height, frameCount = 64, 48, 10
+
+	var frames [][]byte
+	for t := 0; t < frameCount; t++ {
+		frame := make([]byte, 0, width*height*3)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				frame = append(frame, byte(2*(x+y+t)), byte(4*x), byte(4*y))
+			}
+		}
+		frames = append(frames, frame)
+	}
+
+	hdr := header{Width: width, Height: height, FramerateNum: 25, FramerateDen: 1}
+	var stats Stats
+	enc, err := NewEncoder(hdr, &stats)
+	if err != nil {
+		return 0, err
+	}
+	for _, frame := range frames {
+		if err := enc.WriteFrame(convertToYUV(frame, width, height, yuvOptions{})); err != nil {
+			return 0, err
+		}
+	}
+	encoded, err := enc.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	hdr, decoded, _, err := decodeSegment(context.Background(), bytes.NewReader(encoded), decodeOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if len(decoded) != frameCount {
+		return 0, fmt.Errorf("decoded %d frames, expected %d", len(decoded), frameCount)
+	}
+	var squaredErr float64
+	for i, frame := range decoded {
+		squaredErr += squaredError(frames[i], convertToRGB(frame, hdr))
+	}
+	return psnr(squaredErr / float64(frameCount*width*height*3)), nil
+}
+
+// paddedSize rounds width and height up to the dimensions the chroma subsampling needs.
+func paddedSize(width, height int, subsampling uint8) (int, int) {
+	sx, sy := chromaSubsampling(subsampling)
+	return (width + sx - 1) / sx * sx, (height + sy - 1) / sy * sy
+}
+
+// padFrame pads an rgb24 (or rgba) frame out to codedWidth x codedHeight by repeating its last
+// column and row. Repeating the edge, rather than padding with black, keeps the shared chroma
+// samples along the edge the same color as the pixels that are really there.
+func padFrame(frame []byte, width, height, codedWidth, codedHeight, bytesPerPixel int) []byte {
+	if width == codedWidth && height == codedHeight {
+		return frame
+	}
+	padded := make([]byte, 0, codedWidth*codedHeight*bytesPerPixel)
+	for y := 0; y < codedHeight; y++ {
+		srcY := y
+		if srcY >= height {
+			srcY = height - 1
+		}
+		row := frame[srcY*width*bytesPerPixel:][:width*bytesPerPixel]
+		padded = append(padded, row...)
+		last := row[len(row)-bytesPerPixel:]
+		for x := width; x < codedWidth; x++ {
+			padded = append(padded, last...)
+		}
+	}
+	return padded
+}
+
+// cropFrame crops an rgb24 (or rgba) frame down to its top left width x height pixels.
+func cropFrame(frame []byte, codedWidth, codedHeight, width, height, bytesPerPixel int) []byte {
+	if width == codedWidth && height == codedHeight {
+		return frame
+	}
+	return cropRegion(frame, codedWidth, bytesPerPixel, image.Rect(0, 0, width, height))
+}
+
+// cropRegion copies the region r out of a frame that's width pixels across.
+func cropRegion(frame []byte, width, bytesPerPixel int, r image.Rectangle) []byte {
+	return extractBlock(frame, width*bytesPerPixel, r.Min.X*bytesPerPixel, r.Min.Y, r.Dx()*bytesPerPixel, r.Dy())
+}
+
+// downscale shrinks a frame by factor in each direction, replacing each factor by factor block of
+// pixels with their average. It's the same averaging we do to downsample the chroma, applied to
+// every channel. If the dimensions aren't a multiple of factor, the blocks along the right and
+// bottom edges are averaged over the pixels they have.
+func downscale(frame []byte, width, height, bytesPerPixel, factor int) []byte {
+	w, h := (width+factor-1)/factor, (height+factor-1)/factor
+	scaled := make([]byte, w*h*bytesPerPixel)
+	sums := make([]int, bytesPerPixel)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			for c := range sums {
+				sums[c] = 0
+			}
+			var n int
+			for i := y * factor; i < (y+1)*factor && i < height; i++ {
+				for j := x * factor; j < (x+1)*factor && j < width; j++ {
+					p := frame[bytesPerPixel*(i*width+j):]
+					for c := range sums {
+						sums[c] += int(p[c])
+					}
+					n++
+				}
+			}
+			q := scaled[bytesPerPixel*(y*w+x):]
+			for c, sum := range sums {
+				q[c] = byte((sum + n/2) / n)
+			}
+		}
+	}
+	return scaled
+}
+
+// parseCrop parses a region given as x,y,w,h.
+func parseCrop(s string) (image.Rectangle, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		return image.Rectangle{}, fmt.Errorf("%q: expected x,y,w,h", s)
+	}
+	var v [4]int
+	for i, field := range fields {
+		var err error
+		if v[i], err = strconv.Atoi(field); err != nil {
+			return image.Rectangle{}, fmt.Errorf("%q: %w", s, err)
+		}
+	}
+	if v[0] < 0 || v[1] < 0 || v[2] <= 0 || v[3] <= 0 {
+		return image.Rectangle{}, fmt.Errorf("%q: x and y must not be negative, and w and h must be positive", s)
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// autoLevel encodes the same frames at every DEFLATE level from flate.BestSpeed to
+// flate.BestCompression with encode, which returns the size they came out at. It logs each
+// level's size and time with logf, and returns the fastest level whose size is within slack,
+// as a fraction, of the smallest.
+//
+// A single run is at the mercy of whatever else the machine is doing, so the times are only a
+// rough guide. The sizes are exact though, and they're what the slack is measured against.
+func autoLevel(encode func(level int) (int, error), slack float64, logf func(string, ...interface{})) (int, error) {
+	type result struct {
+		size    int
+		elapsed time.Duration
+	}
+	results := make(map[int]result)
+	smallest := 0
+	for level := flate.BestSpeed; level <= flate.BestCompression; level++ {
+		start := time.Now()
+		size, err := encode(level)
+		if err != nil {
+			return 0, fmt.Errorf("level %d: %w", level, err)
+		}
+		r := result{size, time.Since(start)}
+		results[level] = r
+		logf("Auto level: level %d is %d bytes in %v", level, r.size, r.elapsed.Round(time.Millisecond))
+		if smallest == 0 || size < smallest {
+			smallest = size
+		}
+	}
+
+	best := 0
+	for level := flate.BestSpeed; level <= flate.BestCompression; level++ {
+		r := results[level]
+		if float64(r.size) > float64(smallest)*(1+slack) {
+			continue
+		}
+		if best == 0 || r.elapsed < results[best].elapsed {
+			best = level
+		}
+	}
+	return best, nil
+}
+
+// maxTargetLumaQuant is the coarsest luma step fitLumaStep tries. Past it, Y has only 8 distinct
+// values, and the video is more banding than picture.
+const maxTargetLumaQuant = 32
+
+// fitLumaStep returns the smallest luma step from lo to hi at which encode, which returns the size
+// the video comes out at, fits it in target bytes, or hi if none of them do. It logs each size it
+// measures with logf.
+//
+// A coarser step leaves DEFLATE fewer distinct values to code, so the size goes down as the step
+// goes up. It doesn't always go down by much, since the chroma isn't quantized at all, and once
+// in a while a step comes out a few bytes bigger than the one before it, but it's close enough
+// to monotonic to binary search, which only needs a handful of encodes instead of one for every
+// step.
+func fitLumaStep(encode func(step int) (int, error), target, lo, hi int, logf func(string, ...interface{})) (int, error) {
+	fits := func(step int) (bool, error) {
+		size, err := encode(step)
+		if err != nil {
+			return false, fmt.Errorf("luma step %d: %w", step, err)
+		}
+		logf("Two-pass: luma step %d is %d bytes", step, size)
+		return size <= target, nil
+	}
+	if ok, err := fits(lo); ok || err != nil {
+		return lo, err
+	}
+	if hi <= lo {
+		return lo, nil
+	}
+	if ok, err := fits(hi); !ok || err != nil {
+		return hi, err
+	}
+	// lo doesn't fit and hi does, so the smallest step that fits is somewhere in (lo, hi].
+	for lo+1 < hi {
+		mid := (lo + hi) / 2
+		ok, err := fits(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, nil
+}
+
+// planKeyframes is the first pass of a two-pass encode. It returns which frames should be
+// keyframes.
+//
+// A single-pass encoder has to decide what to do with each frame as it comes, without knowing
+// what comes next. With two passes, we can look at the whole video first. Here, we compress
+// each frame both ways, on its own and as a delta, and make it a keyframe whenever that's
+// cheaper. That's usually a scene cut, where the delta against the previous frame is no help
+// at all. A real two-pass encoder would also use what it learned to hand out its bit budget,
+// spending more on complex frames and less on simple ones. Our only quality knob is the luma
+// step, which is the same for a whole segment, so with a target size, fitLumaStep picks one for
+// the whole video instead.
+//
+// To keep the first pass quick, we use DEFLATE's fastest level. It compresses worse than the
+// real thing, but about equally worse for both options, which is all we need to compare them.
+func planKeyframes(frames [][]byte) []bool {
+	compressedSize := func(data []byte) int {
+		var buf bytes.Buffer
+		// BestSpeed is a valid level, so this can't fail, and neither can writing to a buffer.
+		w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+		w.Write(data)
+		w.Close()
+		return buf.Len()
+	}
+
+	plan := make([]bool, len(frames))
+	for i := range frames {
+		if i == 0 {
+			plan[i] = true
+			continue
+		}
+		delta := make([]byte, len(frames[i]))
+		subtract(delta, frames[i], frames[i-1])
+		plan[i] = compressedSize(frames[i]) < compressedSize(delta)
+	}
+	return plan
+}
+
+// decodeFile decodes every segment of an encoded video, returning each frame along with the
+// header of the segment it's in.
+func decodeFile(path string, opts decodeOptions) ([]header, [][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers, frames, err := decodeAll(context.Background(), data, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return headers, frames, nil
+}
+
+// startProfiles starts writing a CPU profile to cpuPath, if it isn't empty. The returned
+// function stops it and writes a heap profile to memPath, if that isn't empty. It's safe to call
+// more than once.
+func startProfiles(cpuPath, memPath string) (stop func() error, err error) {
+	var cpu *os.File
+	if cpuPath != "" {
+		if cpu, err = os.Create(cpuPath); err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(cpu); err != nil {
+			cpu.Close()
+			return nil, err
+		}
+	}
+	stopped := false
+	return func() error {
+		if stopped {
+			return nil
+		}
+		stopped = true
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			if err := cpu.Close(); err != nil {
+				return err
+			}
+		}
+		if memPath == "" {
+			return nil
+		}
+		f, err := os.Create(memPath)
+		if err != nil {
+			return err
+		}
+		// The heap profile is only as of the last garbage collection, so we run one to get
+		// everything up to now.
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
+
+// writeVersion writes the format version this build encodes and decodes to w, along with the Go
+// version and revision it was built from and which of the format's optional features it
+// supports. A build can decode a file if it has the same format version and supports every
+// feature the file uses. The features come from the same tables the encoder and decoder use, so
+// they can't fall out of date.
+func writeVersion(w io.Writer) {
+	fmt.Fprintf(w, "format version: %d\n", formatVersion)
+	fmt.Fprintf(w, "go version: %s\n", runtime.Version())
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				fmt.Fprintf(w, "revision: %s\n", setting.Value)
+			}
+		}
+	}
+
+	names := func(ids map[string]uint8) string {
+		var list []string
+		for name := range ids {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		return strings.Join(list, ", ")
+	}
+	fmt.Fprintf(w, "subsampling: %s\n", names(subsamplingIDs))
+	fmt.Fprintf(w, "compression: %s\n", names(compressionIDs))
+	var types []string
+	for typ := FrameType(0); int(typ) < len(frameTypeNames); typ++ {
+		types = append(types, frameTypeNames[typ])
+	}
+	fmt.Fprintf(w, "frame types: %s\n", strings.Join(types, ", "))
+}
+
+// diffFiles decodes two encoded videos and writes how they differ to w: the PSNR of each frame
+// of b against a, followed by a summary with the largest difference and where the first one is.
+// This answers the question of whether a change to the encoder changed its output, and by how
+// much.
+func diffFiles(w io.Writer, a, b string, opts decodeOptions) error {
+	headersA, framesA, err := decodeFile(a, opts)
+	if err != nil {
+		return err
+	}
+	headersB, framesB, err := decodeFile(b, opts)
+	if err != nil {
+		return err
+	}
+	if len(framesA) != len(framesB) {
+		fmt.Fprintf(w, "frame counts differ: %d vs %d\n", len(framesA), len(framesB))
+	}
+
+	var differing, maxDelta int
+	first := ""
+	for i := 0; i < len(framesA) && i < len(framesB); i++ {
+		hdr := headersA[i]
+		if hdr.Width != headersB[i].Width || hdr.Height != headersB[i].Height || len(framesA[i]) != len(framesB[i]) {
+			return fmt.Errorf("frame %d: %dx%d frame can't be compared to %dx%d frame", i, hdr.Width, hdr.Height, headersB[i].Width, headersB[i].Height)
+		}
+		if bytes.Equal(framesA[i], framesB[i]) {
+			fmt.Fprintf(w, "frame %d: identical\n", i)
+			continue
+		}
+
+		differing++
+		for j := range framesA[i] {
+			delta := int(framesA[i][j]) - int(framesB[i][j])
+			if delta < 0 {
+				delta = -delta
+			}
+			if delta > maxDelta {
+				maxDelta = delta
+			}
+			if delta != 0 && first == "" {
+				first = fmt.Sprintf("frame %d, %s", i, sampleLocation(hdr, j))
+			}
+		}
+		fmt.Fprintf(w, "frame %d: PSNR %0.2f dB\n", i, psnr(squaredError(framesA[i], framesB[i])/float64(len(framesA[i]))))
+	}
+
+	if differing == 0 && len(framesA) == len(framesB) {
+		fmt.Fprintln(w, "identical")
+		return nil
+	}
+	fmt.Fprintf(w, "%d frames differ, max delta %d", differing, maxDelta)
+	if first != "" {
+		fmt.Fprintf(w, ", first difference at %s", first)
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// sampleLocation describes where byte j of a YUV frame is, like "U (12, 3)".
+func sampleLocation(hdr header, j int) string {
+	if hdr.Layout == layoutPacked {
+		// YUYV has two bytes per pixel, interleaving luma and chroma.
+		return fmt.Sprintf("(%d, %d)", j/2%int(hdr.Width), j/2/int(hdr.Width))
+	}
+	if width := int(hdr.Width); hdr.Layout == layoutNV12 && j >= width*int(hdr.Height) {
+		// NV12 has a U and V pair for each 2x2 square after the Y plane.
+		c := (j - width*int(hdr.Height)) / 2
+		return fmt.Sprintf("%s (%d, %d)", []string{"U", "V"}[j%2], c%(width/2), c/(width/2))
+	}
+	names := []string{"Y", "U", "V", "A"}
+	planes := yuvPlanes(hdr)
+	for i := len(planes) - 1; i >= 0; i-- {
+		if p := planes[i]; j >= p.offset {
+			j -= p.offset
+			return fmt.Sprintf("%s (%d, %d)", names[i], j%p.width, j/p.width)
+		}
+	}
+	return ""
+}
+
+// squaredError returns the sum of the squared differences between each byte of a and b.
+func squaredError(a, b []byte) float64 {
+	return float64(SSD(a, b))
+}
+
+// weightedSquaredError is squaredError measured in YUV instead of RGB. It converts each pixel
+// of the frames a and b, which have bytesPerPixel bytes per pixel, to Y, U and V, without
+// subsampling or rounding, and sums the squared differences of each, times its weight in
+// weights. Dividing it by the number of pixels times the sum of the weights gives the mean
+// squared error to pass to psnr, so with weights of 1, 0, 0, it's the PSNR of just the luma.
+func weightedSquaredError(a, b []byte, bytesPerPixel int, weights [3]float64) float64 {
+	var sum float64
+	for i := 0; i+bytesPerPixel <= len(a); i += bytesPerPixel {
+		ar, ag, ab := float64(a[i]), float64(a[i+1]), float64(a[i+2])
+		br, bg, bb := float64(b[i]), float64(b[i+1]), float64(b[i+2])
+		dy := (0.299*ar + 0.587*ag + 0.114*ab) - (0.299*br + 0.587*bg + 0.114*bb)
+		au, av := chroma(ar, ag, ab)
+		bu, bv := chroma(br, bg, bb)
+		du, dv := au-bu, av-bv
+		sum += weights[0]*dy*dy + weights[1]*du*du + weights[2]*dv*dv
+	}
+	return sum
+}
+
+// parsePSNRWeights parses the weights of Y, U and V for -psnr-weights, like "6,1,1". An empty
+// string gives equal weights, though the PSNR is only measured in YUV if -psnr-weights is set.
+func parsePSNRWeights(s string) ([3]float64, error) {
+	weights := [3]float64{1, 1, 1}
+	if s == "" {
+		return weights, nil
+	}
+	fields := strings.Split(s, ",")
+	if len(fields) != 3 {
+		return weights, fmt.Errorf("%q must be three weights for Y, U and V, like 6,1,1", s)
+	}
+	for i, field := range fields {
+		w, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return weights, err
+		}
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return weights, fmt.Errorf("weight %q must be a non-negative number", field)
+		}
+		weights[i] = w
+	}
+	if weights[0]+weights[1]+weights[2] == 0 {
+		return weights, fmt.Errorf("%q must have at least one weight above 0", s)
+	}
+	return weights, nil
+}
+
+// SAD returns the sum of the absolute differences between each byte of a and b, which must be
+// the same length. It's the usual way to score how well two blocks match: 0 means they're the
+// same, and the bigger it is, the more different they are.
+func SAD(a, b []byte) int {
+	var sum int
+	for i := range a {
+		d := int(a[i]) - int(b[i])
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum
+}
+
+// SSD returns the sum of the squared differences between each byte of a and b, which must be the
+// same length. Compared to SAD, it punishes a few big differences more than many small ones, and
+// it's what PSNR is based on.
+func SSD(a, b []byte) int {
+	var sum int
+	for i := range a {
+		d := int(a[i]) - int(b[i])
+		sum += d * d
+	}
+	return sum
+}
+
+// extractBlock copies the w by h block with its top-left corner at (x, y) out of a plane whose
+// rows start stride bytes apart. Each row of the block is a contiguous run of bytes in the plane,
+// so we copy it a row at a time, skipping ahead a whole row of the plane each time.
+func extractBlock(plane []byte, stride, x, y, w, h int) []byte {
+	block := make([]byte, 0, w*h)
+	for i := y; i < y+h; i++ {
+		block = append(block, plane[i*stride+x:i*stride+x+w]...)
+	}
+	return block
+}
+
+// psnr converts a mean squared error into a peak signal-to-noise ratio, in decibels. This is
+// the most common way to measure how much a lossy codec changed the video: the higher the
+// better, with anything above about 40 dB hard to tell apart from the original. Identical
+// videos have an infinite PSNR.
+func psnr(mse float64) float64 {
+	return 10 * math.Log10(255*255/mse)
+}
+
+// ssim returns the structural similarity between the luma of two frames, from -1 to 1, with 1
+// meaning they're identical. PSNR treats every pixel on its own, but our eyes care more about
+// structure, like edges and textures, than about small changes in brightness. SSIM compares
+// the mean, variance and covariance of small windows of each frame instead. We use 8x8 windows
+// that don't overlap, which is a little cruder than the usual sliding Gaussian window.
+func ssim(a, b []byte, width, height, bytesPerPixel int) float64 {
+	const window = 8
+	const c1 = (0.01 * 255) * (0.01 * 255)
+	const c2 = (0.03 * 255) * (0.03 * 255)
+
+	luma := func(frame []byte, i int) float64 {
+		i *= bytesPerPixel
+		return 0.299*float64(frame[i]) + 0.587*float64(frame[i+1]) + 0.114*float64(frame[i+2])
+	}
+
+	var total float64
+	var windows int
+	for y0 := 0; y0+window <= height; y0 += window {
+		for x0 := 0; x0+window <= width; x0 += window {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := y0; y < y0+window; y++ {
+				for x := x0; x < x0+window; x++ {
+					la, lb := luma(a, y*width+x), luma(b, y*width+x)
+					sumA += la
+					sumB += lb
+					sumAA += la * la
+					sumBB += lb * lb
+					sumAB += la * lb
+				}
+			}
+			n := float64(window * window)
+			meanA, meanB := sumA/n, sumB/n
+			varA, varB := sumAA/n-meanA*meanA, sumBB/n-meanB*meanB
+			cov := sumAB/n - meanA*meanB
+			total += (2*meanA*meanB + c1) * (2*cov + c2) / ((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	if windows == 0 {
+		return 1
+	}
+	return total / float64(windows)
+}
+
+// segment is a clip of frames that all have the same dimensions.
+type segment struct {
+	width, height int
+
+	// frameCount is the number of frames to read, or 0 to read until the end of the input.
+	frameCount int
+
+	frames [][]byte
+
+	// loopLength is the number of frames in each repeat of the clip with -loop, or 0 if it isn't
+	// repeated.
+	loopLength int
+
+	// original is the input frames, kept for -verify and -compare-out.
+	original [][]byte
+
+	// subsampled is the frames converted with each subsampling other than -subsampling that one
+	// of the -renditions uses.
+	subsampled map[uint8][][]byte
+
+	// letterboxes is the bars -detect-letterbox found around the frames with each subsampling.
+	letterboxes map[uint8]letterbox
+
+	// first is the index in the clip of the first of frames, which is only past 0 if we resumed
+	// from a checkpoint.
+	first int
+}
+
+// parseSegments parses a comma-separated list of segments written as WIDTHxHEIGHT:FRAMES, for
+// example 384x216:100,192x108:50. The frame count of the last segment may be omitted to read
+// until the end of the input.
+func parseSegments(s string) ([]*segment, error) {
+	var segments []*segment
+	fields := strings.Split(s, ",")
+	for i, field := range fields {
+		dimensions, count, hasCount := strings.Cut(field, ":")
+		w, h, ok := strings.Cut(dimensions, "x")
+		if !ok {
+			return nil, fmt.Errorf("segment %q: expected WIDTHxHEIGHT", field)
+		}
+		seg := &segment{}
+		var err error
+		if seg.width, err = strconv.Atoi(w); err != nil {
+			return nil, fmt.Errorf("segment %q: %w", field, err)
+		}
+		if seg.height, err = strconv.Atoi(h); err != nil {
+			return nil, fmt.Errorf("segment %q: %w", field, err)
+		}
+		if hasCount {
+			if seg.frameCount, err = strconv.Atoi(count); err != nil {
+				return nil, fmt.Errorf("segment %q: %w", field, err)
+			}
+		}
+		if seg.width <= 0 || seg.height <= 0 || seg.frameCount < 0 {
+			return nil, fmt.Errorf("segment %q: dimensions and frame count must be positive", field)
+		}
+		if seg.frameCount == 0 && i != len(fields)-1 {
+			return nil, fmt.Errorf("segment %q: only the last segment may omit its frame count", field)
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// segmentsSize returns the total size of the frames in every segment.
+func segmentsSize(segments []*segment) int {
+	var total int
+	for _, seg := range segments {
+		total += size(seg.frames)
+	}
+	return total
+}
+
+// formatVersion is the version of the format this build encodes and decodes. It goes up whenever
+// the format changes in a way that older decoders would get wrong:
+//
+//   - Version 2 added the pixel aspect ratio, ParNum and ParDen.
+//   - Version 3 added BlockSize.
+//   - Version 4 added Interlaced.
+//   - Version 5 added Repeats.
+//   - Version 6 added the letterbox bars, BarTop through BarV.
+const formatVersion = 6
+
+// header describes the encoded video. It is written uncompressed at the start of the
+// encoded stream.
+type header struct {
+	// Version is the version of the format the segment is encoded in. It comes first, so that
+	// a decoder can tell a segment from a newer version apart even if the rest of the header has
+	// changed. NewEncoder fills it in.
+	Version uint8
+
+	Width, Height uint32
+	FrameCount    uint32
+
+	// The framerate is stored as a fraction so that rates like 29.97 (30000/1001) are exact.
+	FramerateNum, FramerateDen uint16
+
+	// Predictor is the spatial predictor applied to keyframes.
+	Predictor uint8
+
+	// Layout is the layout of the YUV frames.
+	Layout uint8
+
+	// Subsampling is how many pixels share each U and V sample in a planar frame.
+	Subsampling uint8
+
+	// Alpha is set if each frame has an alpha plane after the V plane.
+	Alpha bool
+
+	// BlockSkip is set if P-frames only store the blocks that changed. See skipBlocks.
+	BlockSkip bool
+
+	// ZigZag is set if P-frame deltas are zig-zag encoded. See zigzagEncode.
+	ZigZag bool
+
+	// Reference is what each P-frame is a delta against.
+	Reference uint8
+
+	// Stored is set if the frames are stored uncompressed, one after another, because
+	// compressing them made them bigger.
+	Stored bool
+
+	// TileSize is the width and height of the tiles the frames are split into, or 0 if they
+	// aren't. See tileRects.
+	TileSize uint16
+
+	// PadRight and PadBottom are how many columns and rows were added to the right and bottom
+	// of the video to make its dimensions work with the chroma subsampling. The decoder crops
+	// them off again. See paddedSize.
+	PadRight, PadBottom uint8
+
+	// Symmetry is set if keyframes only store the part of each plane that the rest of it is a
+	// mirror image of. See foldFrame.
+	Symmetry bool
+
+	// RefDistance is how many frames back each P-frame is a delta against with referencePrev,
+	// never going back past the last keyframe. 0 means the same as 1, the previous frame.
+	RefDistance uint8
+
+	// Range is the range of the Y, U and V values. See rangeLimited.
+	Range uint8
+
+	// Compression is the Codec the frames are compressed with.
+	Compression uint8
+
+	// LumaStep is the step the Y values are quantized with, so that each one is stored as
+	// Y / LumaStep. 0 means the same as 1, no quantization. See quantizeLuma.
+	LumaStep uint8
+
+	// ParNum and ParDen are the pixel aspect ratio: how wide each pixel should be shown
+	// relative to how tall it is. NewEncoder writes 1:1, square pixels, if they're both 0.
+	ParNum, ParDen uint16
+
+	// BlockSize is the width and height of the blocks, in luma pixels, that P-frames are divided
+	// into with BlockSkip. 0 means the same as defaultBlockSize. See blockGrid.
+	BlockSize uint8
+
+	// Interlaced is set if each frame is stored as two fields, one after the other. Height and
+	// FrameCount are then of the fields, not the frames. PadBottom is still of the frames. See
+	// splitFields.
+	Interlaced bool
+
+	// Repeats is set if runs of frames that are the same as the one before them are stored as a
+	// single RepeatFrame.
+	Repeats bool
+
+	// BarTop, BarBottom, BarLeft and BarRight are how many rows and columns of solid color, like
+	// the bars of a letterboxed film, were cut off each edge of the frames before they were
+	// coded, and BarY, BarU and BarV are their color. Width and Height are then of the picture
+	// between the bars. PadRight and PadBottom are still of the frames. See detectLetterbox.
+	BarTop, BarBottom, BarLeft, BarRight uint16
+	BarY, BarU, BarV                     uint8
+}
+
+const (
+	predictorNone uint8 = iota
+	predictorMedian
+)
+
+const (
+	// layoutPlanar stores all the Y values, then all the U values, then all the V values.
+	layoutPlanar uint8 = iota
+
+	// layoutPacked stores the frame as YUYV, one U and V sample for every two pixels in a row.
+	layoutPacked
+
+	// layoutNV12 stores all the Y values, then the U and V values interleaved. See packNV12.
+	layoutNV12
+)
+
+const (
+	// subsampling420 shares each U and V sample between a 2x2 square of pixels.
+	subsampling420 uint8 = iota
+
+	// subsampling411 shares each U and V sample between four pixels in a row, keeping the full
+	// vertical resolution. Older formats like NTSC DV use this.
+	subsampling411
+)
+
+var subsamplingIDs = map[string]uint8{
+	"420": subsampling420,
+	"411": subsampling411,
+}
+
+// chromaSubsampling returns how many pixels across and down share each U and V sample.
+func chromaSubsampling(subsampling uint8) (x, y int) {
+	if subsampling == subsampling411 {
+		return 4, 1
+	}
+	return 2, 2
+}
+
+const (
+	// referencePrev makes each P-frame a delta against the previous frame.
+	referencePrev uint8 = iota
+
+	// referenceAverage makes each P-frame a delta against a running average of the frames
+	// before it. See updateAverage.
+	referenceAverage
+)
+
+const (
+	// rangeFull uses all 256 values for Y, U and V.
+	rangeFull uint8 = iota
+
+	// rangeLimited keeps Y between 16 and 235 and U and V between 16 and 240, like broadcast
+	// video. The values outside were reserved for sync signals in analog TV, and digital TV kept
+	// the convention. Most video files still use it, so a player that assumes the wrong range
+	// shows limited range video washed out, or full range video with crushed blacks and whites.
+	rangeLimited
+)
+
+var layoutNames = map[uint8]string{
+	layoutPlanar: "YUV420P",
+	layoutPacked: "YUYV422",
+	layoutNV12:   "NV12",
+}
+
+// maxDimension is the largest width or height the decoder accepts. It's far larger than any
+// real video, but small enough that the size of a segment can't overflow an int64.
+const maxDimension = 1 << 14
+
+// knownID returns whether id is one of the values in ids.
+func knownID(ids map[string]uint8, id uint8) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that the header describes a video we know how to decode.
+func (h header) validate() error {
+	if h.Width == 0 || h.Height == 0 || h.Width > maxDimension || h.Height > maxDimension {
+		return fmt.Errorf("invalid dimensions %dx%d", h.Width, h.Height)
+	}
+	if !knownID(subsamplingIDs, h.Subsampling) {
+		return fmt.Errorf("unknown subsampling %d", h.Subsampling)
+	}
+	sx, sy := chromaSubsampling(h.Subsampling)
+	if int(h.Width)%sx != 0 || int(h.Height)%sy != 0 {
+		// Each U and V sample is shared by a sx x sy block of pixels, so the dimensions have to
+		// be a multiple of that. For YUV420, that means they have to be even.
+		return fmt.Errorf("invalid dimensions %dx%d: must be a multiple of %dx%d", h.Width, h.Height, sx, sy)
+	}
+	if int(h.PadRight) >= sx || int(h.PadBottom) >= sy {
+		return fmt.Errorf("invalid padding %dx%d", h.PadRight, h.PadBottom)
+	}
+	if h.FramerateNum == 0 || h.FramerateDen == 0 {
+		return fmt.Errorf("invalid framerate %d/%d", h.FramerateNum, h.FramerateDen)
+	}
+	if h.Predictor > predictorMedian {
+		return fmt.Errorf("unknown predictor %d", h.Predictor)
+	}
+	if h.Layout > layoutNV12 {
+		return fmt.Errorf("unknown layout %d", h.Layout)
+	}
+	if h.Reference > referenceAverage {
+		return fmt.Errorf("unknown reference %d", h.Reference)
+	}
+	if h.Predictor != predictorNone && h.Layout != layoutPlanar {
+		return fmt.Errorf("predictor %d requires a planar layout", h.Predictor)
+	}
+	if h.Alpha && h.Layout != layoutPlanar {
+		return errors.New("alpha requires a planar layout")
+	}
+	if h.BlockSkip && h.Layout != layoutPlanar {
+		return errors.New("block skipping requires a planar layout")
+	}
+	if h.Subsampling != subsampling420 && h.Layout != layoutPlanar {
+		return fmt.Errorf("subsampling %d requires a planar layout", h.Subsampling)
+	}
+	if h.TileSize%16 != 0 {
+		return fmt.Errorf("invalid tile size %d: must be a multiple of 16", h.TileSize)
+	}
+	if h.TileSize > 0 && h.Layout != layoutPlanar {
+		return errors.New("tiling requires a planar layout")
+	}
+	if _, ok := codecs[h.Compression]; !ok {
+		return fmt.Errorf("unknown compression %d", h.Compression)
+	}
+	if h.Range > rangeLimited {
+		return fmt.Errorf("unknown range %d", h.Range)
+	}
+	if h.RefDistance > 1 && h.Reference != referencePrev {
+		return fmt.Errorf("reference distance %d requires reference %d", h.RefDistance, referencePrev)
+	}
+	if h.Symmetry && h.Layout != layoutPlanar {
+		return errors.New("symmetry requires a planar layout")
+	}
+	if (h.ParNum == 0) != (h.ParDen == 0) {
+		return fmt.Errorf("invalid pixel aspect ratio %d:%d", h.ParNum, h.ParDen)
+	}
+	if h.LumaStep > 1 && h.Layout != layoutPlanar {
+		return fmt.Errorf("luma step %d requires a planar layout", h.LumaStep)
+	}
+	if h.BlockSize != 0 && !validBlockSize(int(h.BlockSize)) {
+		return fmt.Errorf("invalid block size %d", h.BlockSize)
+	}
+	if h.Interlaced && h.Layout != layoutPlanar {
+		return errors.New("interlacing requires a planar layout")
+	}
+	if h.Interlaced && h.FrameCount%2 != 0 {
+		return fmt.Errorf("%d fields can't be woven into frames", h.FrameCount)
+	}
+	if h.letterboxed() && (h.Layout != layoutPlanar || h.Alpha || h.Interlaced) {
+		return errors.New("letterbox bars require a planar layout without alpha or interlacing")
+	}
+	if int(h.BarLeft)%sx != 0 || int(h.BarRight)%sx != 0 || int(h.BarTop)%sy != 0 || int(h.BarBottom)%sy != 0 {
+		return fmt.Errorf("invalid letterbox bars %d, %d, %d, %d: must be a multiple of %dx%d", h.BarTop, h.BarBottom, h.BarLeft, h.BarRight, sx, sy)
+	}
+	if frame := letterboxedHeader(h); frame.Width > maxDimension || frame.Height > maxDimension {
+		return fmt.Errorf("invalid dimensions %dx%d with letterbox bars", frame.Width, frame.Height)
+	}
+	return nil
+}
+
+// letterboxed returns whether the frames have letterbox bars around them.
+func (h header) letterboxed() bool {
+	return h.BarTop != 0 || h.BarBottom != 0 || h.BarLeft != 0 || h.BarRight != 0
+}
+
+// frameSize returns the size of a single YUV frame.
+func (h header) frameSize() int {
+	width, height := int(h.Width), int(h.Height)
+	sx, sy := chromaSubsampling(h.Subsampling)
+	size := width*height + 2*(width/sx)*(height/sy)
+	if h.Layout == layoutPacked {
+		size = width * height * 2
+	}
+	if h.Alpha {
+		size += width * height
+	}
+	return size
+}
+
+// packYUYV rearranges a planar YUV420 frame into packed YUYV:
+//
+//	+----+----+----+----+----+----+----+----+
+//	| Y0 | U0 | Y1 | V0 | Y2 | U1 | Y3 | V1 | ...
+//	+----+----+----+----+----+----+----+----+
+//
+// YUYV has a U and V sample for every two pixels in each row, whereas YUV420 shares one across
+// two rows as well, so each U and V sample is repeated on both rows that share it.
+func packYUYV(frame []byte, width, height int) []byte {
+	Y := frame[:width*height]
+	U := frame[width*height : width*height+width*height/4]
+	V := frame[width*height+width*height/4:]
+
+	packed := make([]byte, 0, width*height*2)
+	for i := 0; i < height; i++ {
+		for j := 0; j < width; j += 2 {
+			c := (i/2)*(width/2) + j/2
+			packed = append(packed, Y[i*width+j], U[c], Y[i*width+j+1], V[c])
+		}
+	}
+	return packed
+}
+
+// unpackYUYV reverses packYUYV, taking the U and V samples from the first of each pair of rows.
+func unpackYUYV(packed []byte, width, height int) []byte {
+	frame := make([]byte, width*height*3/2)
+	Y := frame[:width*height]
+	U := frame[width*height : width*height+width*height/4]
+	V := frame[width*height+width*height/4:]
+
+	for i := 0; i < height; i++ {
+		for j := 0; j < width; j += 2 {
+			p := (i*width + j) * 2
+			Y[i*width+j], Y[i*width+j+1] = packed[p], packed[p+2]
+			if i%2 == 0 {
+				c := (i/2)*(width/2) + j/2
+				U[c], V[c] = packed[p+1], packed[p+3]
+			}
+		}
+	}
+	return frame
+}
+
+// packNV12 rearranges a planar YUV420 frame into NV12, which keeps the Y plane as it is but
+// interleaves the U and V planes into one:
+//
+//	+----+----+----+----+     +----+----+----+----+----+----+----+----+
+//	| Y0 | Y1 | Y2 | Y3 | ... | U0 | V0 | U1 | V1 | U2 | V2 | U3 | V3 | ...
+//	+----+----+----+----+     +----+----+----+----+----+----+----+----+
+//
+// It's the native format of most hardware decoders and GPUs. A pixel's U and V are next to each
+// other, so they can be fetched together, and there are only two planes to keep track of.
+func packNV12(frame []byte, width, height int) []byte {
+	n := width * height
+	U, V := frame[n:n+n/4], frame[n+n/4:n+n/2]
+	nv12 := make([]byte, n+n/2)
+	copy(nv12, frame[:n])
+	for c := range U {
+		nv12[n+2*c], nv12[n+2*c+1] = U[c], V[c]
+	}
+	return nv12
+}
+
+// unpackNV12 reverses packNV12.
+func unpackNV12(nv12 []byte, width, height int) []byte {
+	n := width * height
+	frame := make([]byte, n+n/2)
+	copy(frame, nv12[:n])
+	U, V := frame[n:n+n/4], frame[n+n/4:]
+	for c := range U {
+		U[c], V[c] = nv12[n+2*c], nv12[n+2*c+1]
+	}
+	return frame
+}
+
+// packFrame rearranges a planar frame into layout.
+func packFrame(frame []byte, layout uint8, width, height int) []byte {
+	switch layout {
+	case layoutPacked:
+		return packYUYV(frame, width, height)
+	case layoutNV12:
+		return packNV12(frame, width, height)
+	}
+	return frame
+}
+
+// unpackFrame returns a frame in any layout as a planar frame.
+func unpackFrame(frame []byte, hdr header) []byte {
+	switch hdr.Layout {
+	case layoutPacked:
+		return unpackYUYV(frame, int(hdr.Width), int(hdr.Height))
+	case layoutNV12:
+		return unpackNV12(frame, int(hdr.Width), int(hdr.Height))
+	}
+	return frame
+}
+
+// tile is a rectangle of a frame, in luma pixels.
+type tile struct {
+	x, y, width, height int
+}
+
+// tileRects splits a frame into tiles, left to right then top to bottom.
+//
+// A 4K frame is over 8 million pixels, and going over the whole thing for every step means
+// constantly evicting it from the CPU cache. Splitting the frame into tiles that are coded
+// independently, each one as its own little video, keeps each piece small enough to stay in
+// cache and lets us code the tiles in parallel. Real codecs like HEVC and AV1 have tiles for the
+// same reasons. The cost is that DEFLATE can no longer find matches across tile boundaries.
+//
+// Tiles on the right and bottom edges are cut short if the frame isn't a multiple of the tile
+// size. Since the tile size is a multiple of 16, tiles always line up with the chroma samples.
+func tileRects(hdr header) []tile {
+	size := int(hdr.TileSize)
+	var tiles []tile
+	for y := 0; y < int(hdr.Height); y += size {
+		for x := 0; x < int(hdr.Width); x += size {
+			t := tile{x, y, size, size}
+			if x+size > int(hdr.Width) {
+				t.width = int(hdr.Width) - x
+			}
+			if y+size > int(hdr.Height) {
+				t.height = int(hdr.Height) - y
+			}
+			tiles = append(tiles, t)
+		}
+	}
+	return tiles
+}
+
+// tileHeader returns the header of the segment a tile is coded as.
+func tileHeader(hdr header, t tile) header {
+	hdr.Width, hdr.Height = uint32(t.width), uint32(t.height)
+	hdr.FrameCount = 0
+	hdr.Stored = false
+	hdr.TileSize = 0
+	// The frame is split into fields before it's split into tiles, so each tile is of a field.
+	// Likewise, the bars are cut off first, so each tile is of the picture between them.
+	hdr.Interlaced = false
+	hdr.BarTop, hdr.BarBottom, hdr.BarLeft, hdr.BarRight = 0, 0, 0, 0
+	// The whole frame is quantized before it's split into tiles, and dequantized after the tiles
+	// are put back together.
+	hdr.LumaStep = 0
+	return hdr
+}
+
+// extractTile copies tile t out of each plane of a planar frame.
+func extractTile(frame []byte, hdr header, t tile) []byte {
+	tileHdr := tileHeader(hdr, t)
+	out := make([]byte, tileHdr.frameSize())
+	copyTile(out, frame, hdr, t, false)
+	return out
+}
+
+// insertTile copies a tile extracted by extractTile back into frame.
+func insertTile(frame, tileFrame []byte, hdr header, t tile) {
+	copyTile(tileFrame, frame, hdr, t, true)
+}
+
+// copyTile copies each row of tile t between frame and tileFrame, into frame if insert is set
+// and into tileFrame otherwise.
+func copyTile(tileFrame, frame []byte, hdr header, t tile, insert bool) {
+	tilePlanes := yuvPlanes(tileHeader(hdr, t))
+	for i, p := range yuvPlanes(hdr) {
+		tp := tilePlanes[i]
+		x0, y0 := t.x*p.width/int(hdr.Width), t.y*p.height/int(hdr.Height)
+		for row := 0; row < tp.height; row++ {
+			inFrame := frame[p.offset+(y0+row)*p.width+x0:][:tp.width]
+			inTile := tileFrame[tp.offset+row*tp.width:][:tp.width]
+			if insert {
+				copy(inFrame, inTile)
+			} else {
+				copy(inTile, inFrame)
+			}
+		}
+	}
+}
+
+// Interlaced video comes from the days of CRTs, which drew every other line of the picture on
+// one pass down the screen and the lines in between on the next. Cameras captured it the same
+// way, so each frame is really two pictures, called fields, taken a field's time apart: the top
+// field on the even rows and the bottom field on the odd rows.
+//
+//	row 0: top field, time t          +-------------+       +-------------+
+//	row 1: bottom field, time t+1/2   | ||||        |       | ||||        | top field
+//	row 2: top field, time t          |  ||||       |  -->  +-------------+
+//	row 3: bottom field, time t+1/2   | ||||        |       |  ||||       | bottom field
+//	...                               +-------------+       +-------------+
+//
+// Anything that moves is in a different place in each field, so it comes out with jagged edges
+// called combing. To a spatial predictor or DEFLATE, combing looks like a lot of detail, since no
+// row looks like the ones next to it. Within a field, though, it's a perfectly ordinary picture.
+// With -interlaced, we split each frame into its fields and encode them as frames of half the
+// height, one after the other. Each P-field is a delta against the field before it, which was
+// captured half a frame earlier, or against the field of the same parity with -ref-distance 2.
+
+// fieldHeader returns the header of the fields of an interlaced video, given the header of its
+// frames.
+func fieldHeader(hdr header) header {
+	hdr.Height /= 2
+	hdr.FrameCount *= 2
+	return hdr
+}
+
+// frameHeader reverses fieldHeader.
+func frameHeader(hdr header) header {
+	hdr.Height *= 2
+	hdr.FrameCount /= 2
+	return hdr
+}
+
+// splitFields splits a planar frame described by hdr into its top field, the even rows of each
+// plane, and its bottom field, the odd rows.
+func splitFields(frame []byte, hdr header) (top, bottom []byte) {
+	top = make([]byte, 0, len(frame)/2)
+	bottom = make([]byte, 0, len(frame)/2)
+	for _, p := range yuvPlanes(hdr) {
+		for y := 0; y < p.height; y++ {
+			row := frame[p.offset+y*p.width : p.offset+(y+1)*p.width]
+			if y%2 == 0 {
+				top = append(top, row...)
+			} else {
+				bottom = append(bottom, row...)
+			}
+		}
+	}
+	return top, bottom
+}
+
+// weaveFields reverses splitFields.
+func weaveFields(top, bottom []byte, hdr header) []byte {
+	frame := make([]byte, 0, len(top)+len(bottom))
+	for _, p := range yuvPlanes(hdr) {
+		n := p.width * p.height / 2
+		frame = append(frame, weaveRows(top[:n], bottom[:n], p.width)...)
+		top, bottom = top[n:], bottom[n:]
+	}
+	return frame
+}
+
+// weaveRows interleaves the rows of a single plane of a top and bottom field.
+func weaveRows(top, bottom []byte, width int) []byte {
+	plane := make([]byte, 0, len(top)+len(bottom))
+	for y := 0; y < len(top); y += width {
+		plane = append(plane, top[y:y+width]...)
+		plane = append(plane, bottom[y:y+width]...)
+	}
+	return plane
+}
+
+// Films are shot wider than 16:9, so to show the whole picture on a 16:9 screen, it's shrunk to
+// fit the width and the rows above and below it are filled with black bars. That's called
+// letterboxing, and its sideways cousin, with bars on the left and right of a 4:3 picture, is
+// called pillarboxing. Either way, the bars are the same in every frame. Real encoders mostly
+// rely on the bars being cheap to code, but since we know exactly what they are, we can do
+// better and not code them at all: the header says how thick they are and what color, and the
+// frames only hold the picture between them.
+
+// letterbox is the solid bars around the picture of a letterboxed video: how many rows or
+// columns of them there are on each edge, and their color.
+type letterbox struct {
+	top, bottom, left, right uint16
+	y, u, v                  uint8
+}
+
+// detectLetterbox finds the bars around the picture in planar frames described by hdr. A bar is
+// a run of rows or columns at an edge that are all the color of the top-left pixel in every
+// frame. They're usually black, but any solid color works. Each bar is a whole number of chroma
+// samples thick, so that the picture between them lines up with the chroma samples too. If the
+// frames are a solid color all the way through, there's no picture for the bars to be around,
+// and we don't find any.
+func detectLetterbox(frames [][]byte, hdr header) letterbox {
+	if len(frames) == 0 {
+		return letterbox{}
+	}
+	planes := yuvPlanes(hdr)
+	lb := letterbox{y: frames[0][0], u: frames[0][planes[1].offset], v: frames[0][planes[2].offset]}
+	isBar := func(x, y, w, h int) bool {
+		for _, frame := range frames {
+			if !isSolidRect(frame, hdr, x, y, w, h, lb.y, lb.u, lb.v) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Once we've found a row that isn't part of a bar, the bottom bar can't go past it, and
+	// every column has a pixel in it that isn't either, so neither can the left and right bars.
+	sx, sy := chromaSubsampling(hdr.Subsampling)
+	width, height := int(hdr.Width), int(hdr.Height)
+	top := 0
+	for top < height && isBar(0, top, width, sy) {
+		top += sy
+	}
+	if top == height {
+		return letterbox{}
+	}
+	bottom := 0
+	for isBar(0, height-bottom-sy, width, sy) {
+		bottom += sy
+	}
+	left := 0
+	for isBar(left, 0, sx, height) {
+		left += sx
+	}
+	right := 0
+	for isBar(width-right-sx, 0, sx, height) {
+		right += sx
+	}
+
+	// The header only has room for bars up to 65535 pixels thick. Thicker ones are left partly
+	// in the picture, which is still correct, just not as small.
+	limit := func(n, step int) uint16 {
+		if n > math.MaxUint16 {
+			n = math.MaxUint16 / step * step
+		}
+		return uint16(n)
+	}
+	if top+bottom+left+right == 0 {
+		return letterbox{}
+	}
+	lb.top, lb.bottom, lb.left, lb.right = limit(top, sy), limit(bottom, sy), limit(left, sx), limit(right, sx)
+	return lb
+}
+
+// isSolidRect returns whether the w by h rectangle of pixels with its top-left corner at (x, y)
+// in a planar frame described by hdr is all Y, U and V. The rectangle has to line up with the
+// chroma samples.
+func isSolidRect(frame []byte, hdr header, x, y, w, h int, Y, U, V uint8) bool {
+	for i, p := range yuvPlanes(hdr)[:3] {
+		value := []uint8{Y, U, V}[i]
+		x0, y0 := x*p.width/int(hdr.Width), y*p.height/int(hdr.Height)
+		pw, ph := w*p.width/int(hdr.Width), h*p.height/int(hdr.Height)
+		for row := y0; row < y0+ph; row++ {
+			for _, b := range frame[p.offset+row*p.width+x0:][:pw] {
+				if b != value {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// hasBars returns whether a planar frame described by hdr has the letterbox bars hdr says.
+func hasBars(frame []byte, hdr header) bool {
+	width, height := int(hdr.Width), int(hdr.Height)
+	top, bottom, left, right := int(hdr.BarTop), int(hdr.BarBottom), int(hdr.BarLeft), int(hdr.BarRight)
+	return isSolidRect(frame, hdr, 0, 0, width, top, hdr.BarY, hdr.BarU, hdr.BarV) &&
+		isSolidRect(frame, hdr, 0, height-bottom, width, bottom, hdr.BarY, hdr.BarU, hdr.BarV) &&
+		isSolidRect(frame, hdr, 0, 0, left, height, hdr.BarY, hdr.BarU, hdr.BarV) &&
+		isSolidRect(frame, hdr, width-right, 0, right, height, hdr.BarY, hdr.BarU, hdr.BarV)
+}
+
+// pictureRect returns where the picture between the letterbox bars is in a frame described by
+// hdr. It's cut out and put back like a tile, so it's a tile too.
+func pictureRect(hdr header) tile {
+	return tile{
+		int(hdr.BarLeft), int(hdr.BarTop),
+		int(hdr.Width) - int(hdr.BarLeft) - int(hdr.BarRight),
+		int(hdr.Height) - int(hdr.BarTop) - int(hdr.BarBottom),
+	}
+}
+
+// pictureHeader returns the header of the picture between the bars of a letterboxed video, given
+// the header of its frames.
+func pictureHeader(hdr header) header {
+	hdr.Width -= uint32(hdr.BarLeft) + uint32(hdr.BarRight)
+	hdr.Height -= uint32(hdr.BarTop) + uint32(hdr.BarBottom)
+	return hdr
+}
+
+// letterboxedHeader reverses pictureHeader.
+func letterboxedHeader(hdr header) header {
+	hdr.Width += uint32(hdr.BarLeft) + uint32(hdr.BarRight)
+	hdr.Height += uint32(hdr.BarTop) + uint32(hdr.BarBottom)
+	return hdr
+}
+
+// addBars paints the letterbox bars around the picture between them, giving a planar frame
+// described by hdr. With lumaOnly, the picture and the frame are just the Y plane.
+func addBars(picture []byte, hdr header, lumaOnly bool) []byte {
+	planes, picturePlanes := yuvPlanes(hdr), yuvPlanes(pictureHeader(hdr))
+	if lumaOnly {
+		planes = planes[:1]
+	}
+	last := planes[len(planes)-1]
+	frame := make([]byte, last.offset+last.width*last.height)
+	for i, p := range planes {
+		value := []uint8{hdr.BarY, hdr.BarU, hdr.BarV}[i]
+		plane := frame[p.offset : p.offset+p.width*p.height]
+		for j := range plane {
+			plane[j] = value
+		}
+		pp := picturePlanes[i]
+		x0, y0 := int(hdr.BarLeft)*p.width/int(hdr.Width), int(hdr.BarTop)*p.height/int(hdr.Height)
+		for row := 0; row < pp.height; row++ {
+			copy(plane[(y0+row)*p.width+x0:], picture[pp.offset+row*pp.width:][:pp.width])
+		}
+	}
+	return frame
+}
+
+// defaultBlockSize is the size of the blocks, in luma pixels, that -block-skip divides frames
+// into unless -block-size says otherwise. It's the size of a macroblock in MPEG-2 and H.264.
+const defaultBlockSize = 16
+
+// validBlockSize returns whether n can be a block size: a power of two from 4 to 128. Blocks
+// smaller than 4 pixels would have less than a pixel of chroma with YUV411, and a bigger block
+// than 128 wouldn't fit in the header.
+func validBlockSize(n int) bool {
+	return n >= 4 && n <= 128 && n&(n-1) == 0
+}
+
+// blockSize returns the size of the blocks, in luma pixels, that P-frames are divided into with
+// BlockSkip.
+//
+// Smaller blocks can skip more of a frame where only a little of it changed, but each one costs
+// a bit in the bitmap whether it's skipped or not. At 4x4, the bitmap is 1/128 of the luma
+// plane. At 32x32, it's 1/8192, but a single changed pixel means storing 1024 of them.
+func (h header) blockSize() int {
+	if h.BlockSize == 0 {
+		return defaultBlockSize
+	}
+	return int(h.BlockSize)
+}
+
+// blockGrid returns the number of columns and rows of blocks in a frame. If the frame isn't a
+// multiple of the block size, the blocks on the right and bottom edges are cut short.
+func blockGrid(hdr header) (cols, rows int) {
+	size := hdr.blockSize()
+	return (int(hdr.Width) + size - 1) / size, (int(hdr.Height) + size - 1) / size
+}
+
+// blockBitmapSize returns the size of the bitmap of skipped blocks, one bit per block.
+func blockBitmapSize(hdr header) int {
+	cols, rows := blockGrid(hdr)
+	return (cols*rows + 7) / 8
+}
+
+// forEachBlockRow calls fn with the offset and length of each row of the block in column bx
+// and row by, in every plane of a planar frame.
+func forEachBlockRow(hdr header, bx, by int, fn func(offset, length int)) {
+	for _, p := range yuvPlanes(hdr) {
+		// The chroma planes are smaller than the luma plane, so their blocks are too.
+		blockWidth := hdr.blockSize() * p.width / int(hdr.Width)
+		blockHeight := hdr.blockSize() * p.height / int(hdr.Height)
+		x0, y0 := bx*blockWidth, by*blockHeight
+		x1, y1 := x0+blockWidth, y0+blockHeight
+		if x1 > p.width {
+			x1 = p.width
+		}
+		if y1 > p.height {
+			y1 = p.height
+		}
+		for y := y0; y < y1; y++ {
+			fn(p.offset+y*p.width+x0, x1-x0)
+		}
+	}
+}
+
+// skipBlocks stores a P-frame block by block. In a mostly static scene, most of the frame is
+// exactly the same as the previous one, so rather than storing a delta of zeros for those parts,
+// we divide the frame into blocks and store a single bit for each one saying whether it can be
+// skipped because it hasn't changed:
+//
+//	+---+---+---+---+
+//	| 1 | 1 | 1 | 1 |
+//	+---+---+---+---+
+//	| 1 | 0 | 0 | 1 |   bitmap: 1111 1001 1111
+//	+---+---+---+---+
+//	| 1 | 1 | 1 | 1 |
+//	+---+---+---+---+
+//
+// After the bitmap, we only store the deltas of the blocks that changed. DEFLATE would have
+// squeezed the zeros down anyway, but it can't beat one bit per block. Real codecs call these
+// skip blocks, or skipped macroblocks.
+func skipBlocks(frame, prev []byte, hdr header, stats *Stats) []byte {
+	cols, rows := blockGrid(hdr)
+	var bitmap bitWriter
+	var deltas []byte
+	for by := 0; by < rows; by++ {
+		for bx := 0; bx < cols; bx++ {
+			unchanged := true
+			forEachBlockRow(hdr, bx, by, func(offset, length int) {
+				if !bytes.Equal(frame[offset:offset+length], prev[offset:offset+length]) {
+					unchanged = false
+				}
+			})
+			stats.Blocks++
+			if unchanged {
+				bitmap.writeBits(1, 1)
+				stats.SkippedBlocks++
+				continue
+			}
+			bitmap.writeBits(0, 1)
+
+			forEachBlockRow(hdr, bx, by, func(offset, length int) {
+				start := len(deltas)
+				deltas = append(deltas, make([]byte, length)...)
+				subtract(deltas[start:], frame[offset:offset+length], prev[offset:offset+length])
+			})
+		}
+	}
+	if hdr.ZigZag {
+		zigzagEncode(deltas)
+	}
+	return append(bitmap.bytes(), deltas...)
+}
+
+// skippedFrameSize returns the size of a P-frame stored by skipBlocks, given its bitmap.
+func skippedFrameSize(bitmap []byte, hdr header) int {
+	cols, rows := blockGrid(hdr)
+	size := len(bitmap)
+	r := bitReader{buf: bitmap}
+	for by := 0; by < rows; by++ {
+		for bx := 0; bx < cols; bx++ {
+			// The bitmap always has a bit for every block, so this can't run out.
+			if skipped, _ := r.readBits(1); skipped == 1 {
+				continue
+			}
+			forEachBlockRow(hdr, bx, by, func(offset, length int) {
+				size += length
+			})
+		}
+	}
+	return size
+}
+
+// unskipBlocks reverses skipBlocks, copying the skipped blocks from prev.
+func unskipBlocks(stored, prev []byte, hdr header) []byte {
+	cols, rows := blockGrid(hdr)
+	r := bitReader{buf: stored[:blockBitmapSize(hdr)]}
+	deltas := stored[blockBitmapSize(hdr):]
+	if hdr.ZigZag {
+		zigzagDecode(deltas)
+	}
+	frame := append([]byte(nil), prev...)
+	for by := 0; by < rows; by++ {
+		for bx := 0; bx < cols; bx++ {
+			if skipped, _ := r.readBits(1); skipped == 1 {
+				continue
+			}
+			forEachBlockRow(hdr, bx, by, func(offset, length int) {
+				for j := 0; j < length; j++ {
+					frame[offset+j] += deltas[j]
+				}
+				deltas = deltas[length:]
+			})
+		}
+	}
+	return frame
+}
+
+// bitWriter packs fields that are narrower than a byte, like the flags in a skip bitmap, into a
+// byte slice. Fields are written most significant bit first, so the first field ends up in the
+// top bits of the first byte:
+//
+//	writeBits(0b1, 1), writeBits(0b01, 2), writeBits(0b11111, 5), writeBits(0b1, 1)
+//
+//	+-----------------+-----------------+
+//	| 1 0 1 1 1 1 1 1 | 1 0 0 0 0 0 0 0 |
+//	+-----------------+-----------------+
+//	  ^ ^^^ ^^^^^^^^^   ^ ^^^^^^^^^^^^^
+//	                        padding
+type bitWriter struct {
+	buf []byte
+
+	// acc holds the n bits that have been written but don't fill a byte yet, in its low bits.
+	acc uint64
+	n   int
+}
+
+// writeBits writes the low n bits of v, where n is at most 32.
+func (w *bitWriter) writeBits(v uint32, n int) {
+	w.acc = w.acc<<n | uint64(v)&(1<<n-1)
+	w.n += n
+	for w.n >= 8 {
+		w.n -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.n))
+	}
+}
+
+// bytes flushes the final partial byte, padding it with zeros, and returns everything written.
+func (w *bitWriter) bytes() []byte {
+	if w.n > 0 {
+		w.buf = append(w.buf, byte(w.acc<<(8-w.n)))
+		w.acc, w.n = 0, 0
+	}
+	return w.buf
+}
+
+// bitReader reads fields written by a bitWriter.
+type bitReader struct {
+	buf []byte
+
+	// pos is the number of bits read so far.
+	pos int
+}
+
+// readBits reads an n bit field, where n is at most 32.
+func (r *bitReader) readBits(n int) (uint32, error) {
+	if r.pos+n > 8*len(r.buf) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		bit := r.buf[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v, nil
+}
+
+// predictFrame applies the median predictor to each plane of a planar frame and returns the
+// prediction errors.
+func predictFrame(frame []byte, hdr header) []byte {
+	residual := make([]byte, len(frame))
+	for _, p := range yuvPlanes(hdr) {
+		predictMedian(residual[p.offset:p.offset+p.width*p.height], frame[p.offset:p.offset+p.width*p.height], p.width, p.height)
+	}
+	return residual
+}
+
+// unpredictFrame reverses predictFrame in place.
+func unpredictFrame(frame []byte, hdr header) {
+	for _, p := range yuvPlanes(hdr) {
+		unpredictMedian(frame[p.offset:p.offset+p.width*p.height], p.width, p.height)
+	}
+}
+
+const (
+	// mirrorLeftRight means each row of the plane reads the same backwards, so only the left
+	// half is stored.
+	mirrorLeftRight uint8 = 1 << iota
+
+	// mirrorTopBottom means the plane is the same upside down, so only the top half is stored.
+	mirrorTopBottom
+)
+
+// foldFrame stores a keyframe with -exploit-symmetry, returning it along with the number of
+// planes that were mirror images of themselves.
+//
+// Natural video is almost never exactly symmetric, but synthetic content like logos, test
+// patterns and title cards often is. If the right half of a plane is just the left half
+// backwards, there's no need to store it at all: the decoder can mirror the left half. The
+// same goes for the bottom half and the top half, and if both are true, we only need to store a
+// quarter of the plane. This is a tiny example of content-adaptive coding, where the encoder
+// looks at what it's given and picks the cheapest way to describe it.
+//
+// The stored frame starts with a byte for each plane saying how it was folded, followed by
+// what's left of each plane. With the median predictor, it's applied to the folded planes.
+func foldFrame(frame []byte, hdr header) ([]byte, int) {
+	planes := yuvPlanes(hdr)
+	stored := make([]byte, len(planes), len(planes)+len(frame))
+	var mirrored int
+	for k, p := range planes {
+		src := frame[p.offset : p.offset+p.width*p.height]
+		if isMirroredLeftRight(src, p.width, p.height) {
+			stored[k] |= mirrorLeftRight
+		}
+		if isMirroredTopBottom(src, p.width, p.height) {
+			stored[k] |= mirrorTopBottom
+		}
+		if stored[k] != 0 {
+			mirrored++
+		}
+
+		width, height := foldedSize(p.width, p.height, stored[k])
+		folded := make([]byte, 0, width*height)
+		for i := 0; i < height; i++ {
+			folded = append(folded, src[i*p.width:i*p.width+width]...)
+		}
+		if hdr.Predictor == predictorMedian {
+			predicted := make([]byte, len(folded))
+			predictMedian(predicted, folded, width, height)
+			folded = predicted
+		}
+		stored = append(stored, folded...)
+	}
+	return stored, mirrored
+}
+
+// unfoldFrame reverses foldFrame.
+func unfoldFrame(stored []byte, hdr header) []byte {
+	planes := yuvPlanes(hdr)
+	frame := make([]byte, hdr.frameSize())
+	mirror, stored := stored[:len(planes)], stored[len(planes):]
+	for k, p := range planes {
+		width, height := foldedSize(p.width, p.height, mirror[k])
+		folded := stored[:width*height]
+		stored = stored[width*height:]
+		if hdr.Predictor == predictorMedian {
+			unpredictMedian(folded, width, height)
+		}
+
+		// Mirror the columns we have onto the right half of each row, then the rows we have onto
+		// the bottom half.
+		dst := frame[p.offset : p.offset+p.width*p.height]
+		for i := 0; i < height; i++ {
+			row := dst[i*p.width : (i+1)*p.width]
+			copy(row, folded[i*width:(i+1)*width])
+			if mirror[k]&mirrorLeftRight != 0 {
+				for j := width; j < p.width; j++ {
+					row[j] = row[p.width-1-j]
+				}
+			}
+		}
+		for i := height; i < p.height; i++ {
+			copy(dst[i*p.width:(i+1)*p.width], dst[(p.height-1-i)*p.width:])
+		}
+	}
+	return frame
+}
+
+// foldedSize returns the dimensions of what's stored of a width by height plane folded by
+// mirror. If the width or height is odd, the middle column or row is kept.
+func foldedSize(width, height int, mirror uint8) (int, int) {
+	if mirror&mirrorLeftRight != 0 {
+		width = (width + 1) / 2
+	}
+	if mirror&mirrorTopBottom != 0 {
+		height = (height + 1) / 2
+	}
+	return width, height
+}
+
+// foldedFrameSize returns the size of a keyframe stored by foldFrame, given the byte for each
+// plane at the start of it, or an error if one of them is invalid.
+func foldedFrameSize(mirror []byte, hdr header) (int, error) {
+	size := len(mirror)
+	for k, p := range yuvPlanes(hdr) {
+		if mirror[k]&^(mirrorLeftRight|mirrorTopBottom) != 0 {
+			return 0, fmt.Errorf("unknown mirroring %d of plane %d", mirror[k], k)
+		}
+		width, height := foldedSize(p.width, p.height, mirror[k])
+		size += width * height
+	}
+	return size, nil
+}
+
+// isMirroredLeftRight returns whether every row of plane reads the same backwards.
+func isMirroredLeftRight(plane []byte, width, height int) bool {
+	for i := 0; i < height; i++ {
+		row := plane[i*width : (i+1)*width]
+		for j := 0; j < width/2; j++ {
+			if row[j] != row[width-1-j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isMirroredTopBottom returns whether plane is the same upside down.
+func isMirroredTopBottom(plane []byte, width, height int) bool {
+	for i := 0; i < height/2; i++ {
+		if !bytes.Equal(plane[i*width:(i+1)*width], plane[(height-1-i)*width:(height-i)*width]) {
+			return false
+		}
+	}
+	return true
+}
+
+type plane struct {
+	offset, width, height int
+}
+
+// yuvPlanes returns the layout of the Y, U, V and alpha planes in a planar frame.
+func yuvPlanes(hdr header) []plane {
+	width, height := int(hdr.Width), int(hdr.Height)
+	sx, sy := chromaSubsampling(hdr.Subsampling)
+	chromaWidth, chromaHeight := width/sx, height/sy
+	planes := []plane{
+		{0, width, height},
+		{width * height, chromaWidth, chromaHeight},
+		{width*height + chromaWidth*chromaHeight, chromaWidth, chromaHeight},
+	}
+	if hdr.Alpha {
+		planes = append(planes, plane{width*height + 2*chromaWidth*chromaHeight, width, height})
+	}
+	return planes
+}
+
+// predictMedian writes the difference between each byte of src and its median prediction
+// to dst. This is the same predictor used by JPEG-LS: given the pixel to the left (a), above
+// (b) and above-left (c),
+//
+//	+---+---+
+//	| c | b |
+//	+---+---+
+//	| a | x |
+//	+---+---+
+//
+// we guess that x is the median of a, b and a + b - c. On smooth content, this guess is
+// usually within a few values, so the residuals are mostly small numbers clustered around
+// zero, which DEFLATE compresses much better than the raw pixels.
+func predictMedian(dst, src []byte, width, height int) {
+	for i := 0; i < height; i++ {
+		for j := 0; j < width; j++ {
+			dst[i*width+j] = src[i*width+j] - median(src, i, j, width)
+		}
+	}
+}
+
+// unpredictMedian reverses predictMedian in place. We have to scan in the same order as the
+// encoder so that the neighbors have already been reconstructed when we need them.
+func unpredictMedian(plane []byte, width, height int) {
+	for i := 0; i < height; i++ {
+		for j := 0; j < width; j++ {
+			plane[i*width+j] += median(plane, i, j, width)
+		}
+	}
+}
+
+// median returns the median prediction for the pixel at row i, column j. Pixels outside the
+// plane are treated as zero.
+func median(plane []byte, i, j, width int) byte {
+	var a, b, c int
+	if j > 0 {
+		a = int(plane[i*width+j-1])
+	}
+	if i > 0 {
+		b = int(plane[(i-1)*width+j])
+	}
+	if i > 0 && j > 0 {
+		c = int(plane[(i-1)*width+j-1])
+	}
+	switch {
+	case c >= a && c >= b:
+		if a < b {
+			return byte(a)
+		}
+		return byte(b)
+	case c <= a && c <= b:
+		if a > b {
+			return byte(a)
+		}
+		return byte(b)
+	default:
+		return byte(a + b - c)
+	}
+}
+
+// imageSequence reads a sequence of image files as one raw rgb24 (or rgba) video, decoding each
+// one as it gets to it.
+type imageSequence struct {
+	paths         []string
+	width, height int
+	alpha         bool
+
+	// frame is what's left to read of the current image.
+	frame []byte
+}
+
+// newImageSequence returns an imageSequence of the files matching pattern, in sorted order. The
+// video has the dimensions of the first one, and every other one has to match.
+func newImageSequence(pattern string, alpha bool) (*imageSequence, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no files match %q", pattern)
+	}
+	sort.Strings(paths)
+
+	f, err := os.Open(paths[0])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", paths[0], err)
+	}
+	return &imageSequence{paths: paths, width: config.Width, height: config.Height, alpha: alpha}, nil
+}
+
+func (s *imageSequence) Read(p []byte) (int, error) {
+	for len(s.frame) == 0 {
+		if len(s.paths) == 0 {
+			return 0, io.EOF
+		}
+		frame, err := s.readImage(s.paths[0])
+		if err != nil {
+			return 0, err
+		}
+		s.frame, s.paths = frame, s.paths[1:]
+	}
+	n := copy(p, s.frame)
+	s.frame = s.frame[n:]
+	return n, nil
+}
+
+// readImage decodes the image at path into an rgb24 (or rgba) frame.
+func (s *imageSequence) readImage(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() != s.width || bounds.Dy() != s.height {
+		return nil, fmt.Errorf("%s: image is %dx%d, but the first one is %dx%d", path, bounds.Dx(), bounds.Dy(), s.width, s.height)
+	}
+
+	// Images come in all sorts of color models, so we draw each one onto an NRGBA image to get
+	// the plain, non-premultiplied red, green, blue and alpha of each pixel.
+	nrgba := image.NewNRGBA(image.Rect(0, 0, s.width, s.height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+	if s.alpha {
+		return nrgba.Pix, nil
+	}
+	frame := make([]byte, 0, s.width*s.height*3)
+	for j := 0; j < len(nrgba.Pix); j += 4 {
+		frame = append(frame, nrgba.Pix[j:j+3]...)
+	}
+	return frame, nil
+}
+
+// sidecarKeys are the settings a sidecar file can have, each named after the flag it sets.
+var sidecarKeys = []string{"width", "height", "framerate", "par"}
+
+// readSidecar reads the metadata file that can sit next to a raw video. It has one setting per
+// line, with blank lines and lines starting with # ignored:
+//
+//	# video.rgb24.meta
+//	width=384
+//	height=216
+//	framerate=25
+//
+// If the file doesn't exist, readSidecar returns no settings.
+func readSidecar(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key=value, got %q", i+1, line)
+		}
+		if _, ok := meta[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate %s", i+1, key)
+		}
+
+		switch key {
+		case "width", "height":
+			if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+				return nil, fmt.Errorf("line %d: %s must be a positive integer, got %q", i+1, key, value)
+			}
+		case "framerate":
+			if _, _, err := parseRatio(value); err != nil {
+				return nil, fmt.Errorf("line %d: invalid framerate: %v", i+1, err)
+			}
+		case "par":
+			if _, _, err := parseRatio(value); err != nil {
+				return nil, fmt.Errorf("line %d: invalid par: %v", i+1, err)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown setting %q", i+1, key)
+		}
+		meta[key] = value
+	}
+	return meta, nil
+}
 
-	for {
-		// Read raw video frames from stdin. In rgb24 format, each pixel (r, g, b) is one byte
-		// so the total size of the frame is width * height * 3.
+// checkpointPath is where -checkpoint records how far the encode has got.
+const checkpointPath = "encoded.bin.checkpoint"
 
-		frame := make([]byte, width*height*3)
+// checkpoint is how far an encode with -checkpoint has got: the encoded video is Offset bytes up
+// to frame Frame, counting the frames kept after -temporal-factor, and it resumes from there.
+// Interval is the -checkpoint it was made with, which a resumed encode has to use too.
+type checkpoint struct {
+	Interval int   `json:"interval"`
+	Frame    int   `json:"frame"`
+	Offset   int64 `json:"offset"`
+}
 
-		// read the frame from stdin
-		if _, err := io.ReadFull(os.Stdin, frame); err != nil {
-			break
+// readCheckpoint reads the checkpoint at path.
+func readCheckpoint(path string) (checkpoint, error) {
+	var cp checkpoint
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, fmt.Errorf("%s: %w", path, err)
+	}
+	if cp.Frame < 0 || cp.Offset < 0 {
+		return cp, fmt.Errorf("%s: frame %d and offset %d must not be negative", path, cp.Frame, cp.Offset)
+	}
+	return cp, nil
+}
+
+// saveCheckpoint appends encoded to the file at videoPath and then records in a checkpoint at
+// path that the video is whole up to frame cp.Frame.
+//
+// The encode could be killed at any moment, including while we're in here, so the order matters.
+// The segments go to disk before the checkpoint that says they're there, and the checkpoint is
+// written to a temporary file and renamed over the old one, which happens all at once. Whenever
+// the encode stops, the checkpoint on disk is one the video can be resumed from, and anything
+// in the video after its offset is thrown away.
+func saveCheckpoint(path, videoPath string, encoded []byte, cp checkpoint) error {
+	f, err := os.OpenFile(videoPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encoded); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if cp.Offset, err = f.Seek(0, io.SeekCurrent); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// skipInput skips the first n bytes of r, seeking past them if it's a file. Stdin is an
+// *os.File too, but seeking fails when it's a pipe, so then we read them and throw them away.
+func skipInput(r io.Reader, n int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		if _, err := s.Seek(n, io.SeekCurrent); err == nil {
+			return nil
 		}
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
 
-		frames = append(frames, frame)
+// checkFrameSize returns an error if the dimensions of a frame don't make sense, or if the frame
+// would be more than limit bytes with bytesPerPixel bytes per pixel. A limit of 0 means no limit.
+func checkFrameSize(width, height, bytesPerPixel, limit int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("%dx%d: the width and height must be positive", width, height)
 	}
+	// The size of an absurd frame can overflow an int, so we work it out as a float64. It's only
+	// approximate past 2^53 bytes, but that's plenty to tell it's too big.
+	size := float64(width) * float64(height) * float64(bytesPerPixel)
+	if limit > 0 && size > float64(limit) {
+		return fmt.Errorf("%dx%d: each frame would be %.0f bytes, more than the limit of %d MiB (see -max-frame-size)", width, height, size, limit>>20)
+	}
+	return nil
+}
 
-	// Now we have our raw video, using a truly ridiculous amount of memory!
+// rendition is one of the extra versions of the video that -renditions encodes alongside the main
+// one, with its own quality and subsampling.
+type rendition struct {
+	name      string
+	lumaQuant int
 
-	rawSize := size(frames)
-	log.Printf("Raw size: %d bytes", rawSize)
+	// level is the DEFLATE level, or 0 to use the same level as the main video, which might not
+	// be known until -auto-level has picked it.
+	level int
 
-	for i, frame := range frames {
-		// First, we will convert each frame to YUV420 format. Each pixel in RGB24 format
-		// looks like this:
-		//
-		// +-----------+-----------+-----------+-----------+
-		// |           |           |           |           |
-		// | (r, g, b) | (r, g, b) | (r, g, b) | (r, g, b) |
-		// |           |           |           |           |
-		// +-----------+-----------+-----------+-----------+
-		// |           |           |           |           |
-		// | (r, g, b) | (r, g, b) | (r, g, b) | (r, g, b) |
-		// |           |           |           |           |
-		// +-----------+-----------+-----------+-----------+  ...
-		// |           |           |           |           |
-		// | (r, g, b) | (r, g, b) | (r, g, b) | (r, g, b) |
-		// |           |           |           |           |
-		// +-----------+-----------+-----------+-----------+
-		// |           |           |           |           |
-		// | (r, g, b) | (r, g, b) | (r, g, b) | (r, g, b) |
-		// |           |           |           |           |
-		// +-----------+-----------+-----------+-----------+
-		//
-		//                        ...
-		//
-		// YUV420 format looks like this:
-		//
-		// +-----------+-----------+-----------+-----------+
-		// |  Y(0, 0)  |  Y(0, 1)  |  Y(0, 2)  |  Y(0, 3)  |
-		// |  U(0, 0)  |  U(0, 0)  |  U(0, 1)  |  U(0, 1)  |
-		// |  V(0, 0)  |  V(0, 0)  |  V(0, 1)  |  V(0, 1)  |
-		// +-----------+-----------+-----------+-----------+
-		// |  Y(1, 0)  |  Y(1, 1)  |  Y(1, 2)  |  Y(1, 3)  |
-		// |  U(0, 0)  |  U(0, 0)  |  U(0, 1)  |  U(0, 1)  |
-		// |  V(0, 0)  |  V(0, 0)  |  V(0, 1)  |  V(0, 1)  |
-		// +-----------+-----------+-----------+-----------+  ...
-		// |  Y(2, 0)  |  Y(2, 1)  |  Y(2, 2)  |  Y(2, 3)  |
-		// |  U(1, 0)  |  U(1, 0)  |  U(1, 1)  |  U(1, 1)  |
-		// |  V(1, 0)  |  V(1, 0)  |  V(1, 1)  |  V(1, 1)  |
-		// +-----------+-----------+-----------+-----------+
-		// |  Y(3, 0)  |  Y(3, 1)  |  Y(3, 2)  |  Y(3, 3)  |
-		// |  U(1, 0)  |  U(1, 0)  |  U(1, 1)  |  U(1, 1)  |
-		// |  V(1, 0)  |  V(1, 0)  |  V(1, 1)  |  V(1, 1)  |
-		// +-----------+-----------+-----------+-----------+
-		//					      ...
-		//
-		// The gist of this format is that instead of the components R, G, B which each
-		// pixel needs, we first convert it to a different space, Y (luminance) and UV (chrominance).
-		// The way to think about this is that the Y component is the brightness of the pixel,
-		// and the UV components are the color of the pixel. The UV components are shared
-		// between 4 adjacent pixels, so we only need to store them once for each 4 pixels.
-		//
-		// The intuition is that the human eye is more sensitive to brightness than color,
-		// so we can store the brightness of each pixel and then store the color of each
-		// 4 pixels. This is a huge space savings, since we only need to store 1/4 of the
-		// pixels in the image.
-		//
-		// If you're seeking more resources, YUV format is also known as YCbCr.
-		// Actually that's not completely true, but it's close enough and color space selection
-		// is a whole other topic.
+	subsampling uint8
+}
+
+// parseRenditions parses a space-separated list of renditions written as NAME:KEY=VALUE,..., for
+// example "hi:level=9 lo:luma-quant=8,subsampling=411". The keys are luma-quant, level and
+// subsampling, and any that are left out are taken from base.
+func parseRenditions(s string, base rendition) ([]rendition, error) {
+	var renditions []rendition
+	seen := make(map[string]bool)
+	for _, field := range strings.Fields(s) {
+		name, settings, _ := strings.Cut(field, ":")
+		if name == "" || strings.IndexFunc(name, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+		}) >= 0 {
+			return nil, fmt.Errorf("rendition %q: the name must be letters, digits, - and _", field)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("rendition %q: there's already a rendition called %s", field, name)
+		}
+		seen[name] = true
+
+		r := base
+		r.name = name
+		if settings != "" {
+			for _, setting := range strings.Split(settings, ",") {
+				key, value, ok := strings.Cut(setting, "=")
+				if !ok {
+					return nil, fmt.Errorf("rendition %q: expected KEY=VALUE, not %q", field, setting)
+				}
+				var err error
+				switch key {
+				case "luma-quant":
+					if r.lumaQuant, err = strconv.Atoi(value); err == nil && (r.lumaQuant < 1 || r.lumaQuant > math.MaxUint8) {
+						err = fmt.Errorf("must be between 1 and %d", math.MaxUint8)
+					}
+				case "level":
+					if r.level, err = strconv.Atoi(value); err == nil && (r.level < flate.BestSpeed || r.level > flate.BestCompression) {
+						err = fmt.Errorf("must be from %d to %d", flate.BestSpeed, flate.BestCompression)
+					}
+				case "subsampling":
+					if r.subsampling, ok = subsamplingIDs[value]; !ok {
+						err = errors.New("must be 420 or 411")
+					}
+				default:
+					err = errors.New("unknown setting, must be luma-quant, level or subsampling")
+				}
+				if err != nil {
+					return nil, fmt.Errorf("rendition %q: %s=%s: %w", field, key, value, err)
+				}
+			}
+		}
+		renditions = append(renditions, r)
+	}
+	return renditions, nil
+}
+
+// parseRatio parses a ratio written as "N", "N/D" or "N:D".
+func parseRatio(s string) (num, den uint16, err error) {
+	n, d, ok := strings.Cut(s, "/")
+	if !ok {
+		n, d, ok = strings.Cut(s, ":")
+	}
+	if !ok {
+		d = "1"
+	}
+	num64, err := strconv.ParseUint(n, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	den64, err := strconv.ParseUint(d, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if num64 == 0 || den64 == 0 {
+		return 0, 0, fmt.Errorf("%q must be positive", s)
+	}
+	return uint16(num64), uint16(den64), nil
+}
+
+// yuvOptions configures how frames are converted to YUV.
+type yuvOptions struct {
+	// dither enables error diffusion when quantizing the downsampled chroma.
+	dither bool
+
+	// linear averages the chroma in linear light instead of straight from the sRGB values.
+	linear bool
+
+	// alpha is set if the input is rgba instead of rgb24. The alpha channel is stored as a
+	// fourth plane after V.
+	alpha bool
+
+	// subsampling is how many pixels share each U and V sample. See chromaSubsampling.
+	subsampling uint8
+
+	// colorRange is the range to scale the Y, U and V values to. See rangeLimited.
+	colorRange uint8
+
+	// integer does the conversion in fixed point instead of floating point. See integerLuma.
+	integer bool
+}
+
+// convertToYUV converts an rgb24 frame to planar YUV420, or YUV411 if opts.subsampling says so.
+func convertToYUV(frame []byte, width, height int, opts yuvOptions) []byte {
+	// YUV420 is a different way of representing the same pixels. Each pixel in RGB24 format
+	// looks like this:
+	//
+	// +-----------+-----------+-----------+-----------+
+	// |           |           |           |           |
+	// | (r, g, b) | (r, g, b) | (r, g, b) | (r, g, b) |
+	// |           |           |           |           |
+	// +-----------+-----------+-----------+-----------+
+	// |           |           |           |           |
+	// | (r, g, b) | (r, g, b) | (r, g, b) | (r, g, b) |
+	// |           |           |           |           |
+	// +-----------+-----------+-----------+-----------+  ...
+	// |           |           |           |           |
+	// | (r, g, b) | (r, g, b) | (r, g, b) | (r, g, b) |
+	// |           |           |           |           |
+	// +-----------+-----------+-----------+-----------+
+	// |           |           |           |           |
+	// | (r, g, b) | (r, g, b) | (r, g, b) | (r, g, b) |
+	// |           |           |           |           |
+	// +-----------+-----------+-----------+-----------+
+	//
+	//                        ...
+	//
+	// YUV420 format looks like this:
+	//
+	// +-----------+-----------+-----------+-----------+
+	// |  Y(0, 0)  |  Y(0, 1)  |  Y(0, 2)  |  Y(0, 3)  |
+	// |  U(0, 0)  |  U(0, 0)  |  U(0, 1)  |  U(0, 1)  |
+	// |  V(0, 0)  |  V(0, 0)  |  V(0, 1)  |  V(0, 1)  |
+	// +-----------+-----------+-----------+-----------+
+	// |  Y(1, 0)  |  Y(1, 1)  |  Y(1, 2)  |  Y(1, 3)  |
+	// |  U(0, 0)  |  U(0, 0)  |  U(0, 1)  |  U(0, 1)  |
+	// |  V(0, 0)  |  V(0, 0)  |  V(0, 1)  |  V(0, 1)  |
+	// +-----------+-----------+-----------+-----------+  ...
+	// |  Y(2, 0)  |  Y(2, 1)  |  Y(2, 2)  |  Y(2, 3)  |
+	// |  U(1, 0)  |  U(1, 0)  |  U(1, 1)  |  U(1, 1)  |
+	// |  V(1, 0)  |  V(1, 0)  |  V(1, 1)  |  V(1, 1)  |
+	// +-----------+-----------+-----------+-----------+
+	// |  Y(3, 0)  |  Y(3, 1)  |  Y(3, 2)  |  Y(3, 3)  |
+	// |  U(1, 0)  |  U(1, 0)  |  U(1, 1)  |  U(1, 1)  |
+	// |  V(1, 0)  |  V(1, 0)  |  V(1, 1)  |  V(1, 1)  |
+	// +-----------+-----------+-----------+-----------+
+	//					      ...
+	//
+	// The gist of this format is that instead of the components R, G, B which each
+	// pixel needs, we first convert it to a different space, Y (luminance) and UV (chrominance).
+	// The way to think about this is that the Y component is the brightness of the pixel,
+	// and the UV components are the color of the pixel. The UV components are shared
+	// between 4 adjacent pixels, so we only need to store them once for each 4 pixels.
+	//
+	// The intuition is that the human eye is more sensitive to brightness than color,
+	// so we can store the brightness of each pixel and then store the color of each
+	// 4 pixels. This is a huge space savings, since we only need to store 1/4 of the
+	// pixels in the image.
+	//
+	// If you're seeking more resources, YUV format is also known as YCbCr.
+	// Actually that's not completely true, but it's close enough and color space selection
+	// is a whole other topic.
+	//
+	// By convention, in our byte slice, we store reading left to right then top to bottom.
+	// That is, to find a pixel at row i, column j, we would find the byte at index
+	// (i * width + j) * 3.
+	//
+	// In practice, this doesn't matter that much because our image will be transposed if
+	// this is done backwards. The important thing is that we are consistent.
+
+	bytesPerPixel := 3
+	if opts.alpha {
+		bytesPerPixel = 4
+	}
+
+	Y := make([]byte, width*height)
+	for j := 0; j < width*height; j++ {
+		// Convert the pixel from RGB to YUV
+		p := frame[bytesPerPixel*j:]
+		if opts.integer {
+			Y[j] = integerLuma(p[0], p[1], p[2], opts.colorRange)
+			continue
+		}
+		r, g, b := float64(p[0]), float64(p[1]), float64(p[2])
+
+		// These coefficients are from the ITU-R standard.
+		// See https://en.wikipedia.org/wiki/YUV#Y%E2%80%B2UV444_to_RGB888_conversion
 		//
-		// By convention, in our byte slice, we store reading left to right then top to bottom.
-		// That is, to find a pixel at row i, column j, we would find the byte at index
-		// (i * width + j) * 3.
+		// In practice, the actual coefficients vary based on the standard.
+		// For our example, it doesn't matter that much, the key insight is
+		// more that converting to YUV allows us to downsample the color
+		// space efficiently.
 		//
-		// In practice, this doesn't matter that much because our image will be transposed if
-		// this is done backwards. The important thing is that we are consistent.
+		// U and V are worked out below, since we only need them for the average of each
+		// block of pixels that shares them. See chroma.
+		y := +0.299*r + 0.587*g + 0.114*b
 
-		Y := make([]byte, width*height)
-		U := make([]float64, width*height)
-		V := make([]float64, width*height)
-		for j := 0; j < width*height; j++ {
-			// Convert the pixel from RGB to YUV
-			r, g, b := float64(frame[3*j]), float64(frame[3*j+1]), float64(frame[3*j+2])
+		// Store the Y values in a byte slice of their own.
+		Y[j] = uint8(y)
+		if opts.colorRange == rangeLimited {
+			Y[j] = uint8(math.Round(16 + y*219/255))
+		}
+	}
 
-			// These coefficients are from the ITU-R standard.
-			// See https://en.wikipedia.org/wiki/YUV#Y%E2%80%B2UV444_to_RGB888_conversion
-			//
-			// In practice, the actual coefficients vary based on the standard.
-			// For our example, it doesn't matter that much, the key insight is
-			// more that converting to YUV allows us to downsample the color
-			// space efficiently.
-			y := +0.299*r + 0.587*g + 0.114*b
-			u := -0.169*r - 0.331*g + 0.449*b + 128
-			v := 0.499*r - 0.418*g - 0.0813*b + 128
+	// Now, we will downsample the U and V components. This is a process where we
+	// take the 4 pixels that share a U and V component and average them together.
+	//
+	// In YUV420, those 4 pixels are a 2x2 square. Some older formats, like NTSC DV, use YUV411
+	// instead, where they're 4 pixels in a row. That keeps all of the vertical color detail
+	// at the expense of the horizontal, but it's still 1/4 of the samples either way.
+	sx, sy := chromaSubsampling(opts.subsampling)
+	chromaWidth, chromaHeight := width/sx, height/sy
 
-			// Store the YUV values in our byte slices. These are separated to make the
-			// next step a bit easier.
-			Y[j] = uint8(y)
-			U[j] = u
-			V[j] = v
-		}
+	// We will store the downsampled U and V components in these slices.
+	uDownsampled := make([]byte, chromaWidth*chromaHeight)
+	vDownsampled := make([]byte, chromaWidth*chromaHeight)
 
-		// Now, we will downsample the U and V components. This is a process where we
-		// take the 4 pixels that share a U and V component and average them together.
+	// Storing the average in a byte rounds off its fractional part. On a smooth gradient, many
+	// neighboring samples lose the same fraction, which shows up as visible bands. Dithering
+	// carries the error we throw away over to the neighboring samples we haven't stored yet
+	// (Floyd-Steinberg error diffusion) so that on average, the stored values are correct. The
+	// catch is that this adds noise that changes from frame to frame, which costs compression.
+	var uError, vError []float64
+	if opts.dither {
+		uError = make([]float64, chromaWidth*chromaHeight)
+		vError = make([]float64, chromaWidth*chromaHeight)
+	}
 
-		// We will store the downsampled U and V components in these slices.
-		uDownsampled := make([]byte, width*height/4)
-		vDownsampled := make([]byte, width*height/4)
-		for x := 0; x < height; x += 2 {
-			for y := 0; y < width; y += 2 {
-				// We will average the U and V components of the 4 pixels that share this
-				// U and V component.
-				u := (U[x*width+y] + U[x*width+y+1] + U[(x+1)*width+y] + U[(x+1)*width+y+1]) / 4
-				v := (V[x*width+y] + V[x*width+y+1] + V[(x+1)*width+y] + V[(x+1)*width+y+1]) / 4
+	for x := 0; x < height; x += sy {
+		for y := 0; y < width; y += sx {
+			// We will average the U and V components of the 4 pixels that share this
+			// U and V component.
+			if opts.integer {
+				c := x/sy*chromaWidth + y/sx
+				uDownsampled[c], vDownsampled[c] = integerChroma(frame, x, y, width, sx, sy, bytesPerPixel, opts.colorRange)
+				continue
+			}
+			var u, v float64
+			if opts.linear {
+				u, v = linearChroma(frame, x, y, width, sx, sy, bytesPerPixel)
+			} else {
+				// We work out the U and V of each pixel here rather than keeping them for
+				// every pixel in the loop above, which would take 16 bytes per pixel as
+				// float64s just to be added up and thrown away.
+				for i := x; i < x+sy; i++ {
+					for j := y; j < y+sx; j++ {
+						p := frame[bytesPerPixel*(i*width+j):]
+						pu, pv := chroma(float64(p[0]), float64(p[1]), float64(p[2]))
+						u += pu
+						v += pv
+					}
+				}
+				u /= float64(sx * sy)
+				v /= float64(sx * sy)
+			}
+			if opts.colorRange == rangeLimited {
+				// U and V are centered on 128, so we scale them toward it.
+				u = 128 + (u-128)*224/255
+				v = 128 + (v-128)*224/255
+			}
 
-				// Store the downsampled U and V components in our byte slices.
-				uDownsampled[x/2*width/2+y/2] = uint8(u)
-				vDownsampled[x/2*width/2+y/2] = uint8(v)
+			// Converting to a byte would simply chop off the fractional part, so 127.9 would
+			// become 127. Every sample would come out a little low on average, shifting all the
+			// colors slightly, so we round to the nearest value instead.
+			c := x/sy*chromaWidth + y/sx
+			if opts.dither {
+				u = clamp(u+uError[c], 0, 255)
+				v = clamp(v+vError[c], 0, 255)
+				diffuseError(uError, u-math.Round(u), x/sy, y/sx, chromaWidth, chromaHeight)
+				diffuseError(vError, v-math.Round(v), x/sy, y/sx, chromaWidth, chromaHeight)
 			}
+
+			// Store the downsampled U and V components in our byte slices.
+			uDownsampled[c] = uint8(math.Round(u))
+			vDownsampled[c] = uint8(math.Round(v))
 		}
+	}
 
-		yuvFrame := make([]byte, len(Y)+len(uDownsampled)+len(vDownsampled))
+	yuvFrame := make([]byte, len(Y)+len(uDownsampled)+len(vDownsampled))
 
-		// Now we need to store the YUV values in a byte slice. To make the data more
-		// compressible, we will store all the Y values first, then all the U values,
-		// then all the V values. This is called a planar format.
-		//
-		// The intuition is that adjacent Y, U, and V values are more likely to be
-		// similar than Y, U, and V themselves. Therefore, storing the components
-		// in a planar format will save more data later.
+	// Now we need to store the YUV values in a byte slice. To make the data more
+	// compressible, we will store all the Y values first, then all the U values,
+	// then all the V values. This is called a planar format.
+	//
+	// The intuition is that adjacent Y, U, and V values are more likely to be
+	// similar than Y, U, and V themselves. Therefore, storing the components
+	// in a planar format will save more data later.
 
-		copy(yuvFrame, Y)
-		copy(yuvFrame[len(Y):], uDownsampled)
-		copy(yuvFrame[len(Y)+len(uDownsampled):], vDownsampled)
+	copy(yuvFrame, Y)
+	copy(yuvFrame[len(Y):], uDownsampled)
+	copy(yuvFrame[len(Y)+len(uDownsampled):], vDownsampled)
 
-		frames[i] = yuvFrame
+	// If there's an alpha channel, it gets a plane of its own at full resolution, just like Y.
+	// Transparency usually comes in large flat regions, so it compresses really well.
+	if opts.alpha {
+		for j := 0; j < width*height; j++ {
+			yuvFrame = append(yuvFrame, frame[4*j+3])
+		}
 	}
 
-	// Now we have our YUV-encoded video, which takes half the space!
+	return yuvFrame
+}
 
-	yuvSize := size(frames)
-	log.Printf("YUV420P size: %d bytes (%0.2f%% original size)", yuvSize, 100*float32(yuvSize)/float32(rawSize))
+// linearChroma averages the sx by sy block of pixels whose top-left corner is at row x,
+// column y in linear light, and returns the U and V of the average.
+//
+// The RGB values in our frame aren't proportional to how much light there is. They're gamma
+// encoded with the sRGB transfer function, which spends more of the 256 values on dark colors
+// because our eyes are better at telling those apart. That means averaging the values isn't the
+// same as averaging the light: a black pixel next to a white pixel averages to 128, but a
+// display shows 128 at only about 22% brightness, not 50%. Usually the difference is too small
+// to notice, but on a sharp edge between two very different colors, the blended chroma comes out
+// too dark and the wrong hue, which shows up as a fringe along the edge.
+//
+// To fix this, we undo the transfer function to get back to linear light, average there, and
+// then apply it again before converting to YUV.
+func linearChroma(frame []byte, x, y, width, sx, sy, bytesPerPixel int) (u, v float64) {
+	var r, g, b float64
+	for i := x; i < x+sy; i++ {
+		for j := y; j < y+sx; j++ {
+			p := frame[bytesPerPixel*(i*width+j):]
+			r += srgbToLinear(p[0])
+			g += srgbToLinear(p[1])
+			b += srgbToLinear(p[2])
+		}
+	}
+	n := float64(sx * sy)
+	return chroma(linearToSRGB(r/n), linearToSRGB(g/n), linearToSRGB(b/n))
+}
 
-	// We can also write this out to a file, which can be played with ffplay:
-	//
-	//   ffplay -f rawvideo -pixel_format yuv420p -video_size 384x216 -framerate 25 encoded.yuv
+// chroma returns the U and V of a pixel. See convertToYUV for the Y.
+func chroma(r, g, b float64) (u, v float64) {
+	u = -0.169*r - 0.331*g + 0.449*b + 128
+	v = 0.499*r - 0.418*g - 0.0813*b + 128
+	return u, v
+}
 
-	if err := os.WriteFile("encoded.yuv", bytes.Join(frames, nil), 0644); err != nil {
-		log.Fatal(err)
+// integerLuma returns the Y of a pixel like convertToYUV does, but in fixed point with 16 bits
+// after the point, and integerChroma does the same for the U and V of a block like the average
+// of chroma.
+//
+// Floating point math is exact enough, but it isn't always the same everywhere. Go is allowed to
+// fuse a multiply and an add into one instruction that rounds once instead of twice, and does on
+// arm64 but not on most amd64 machines, so a value that lands right on a rounding boundary can
+// come out one off depending on where the encoder ran. Integer math has no rounding to disagree
+// about, so with -deterministic, the same input encodes to the same bytes on every machine. The
+// coefficients are rounded to 16 bits, so the result is sometimes one off from the floating point
+// conversion, which is far too small to see.
+func integerLuma(r, g, b byte, colorRange uint8) byte {
+	y := 19595*int64(r) + 38470*int64(g) + 7471*int64(b)
+	if colorRange == rangeLimited {
+		return byte((16<<16 + y*219/255 + 1<<15) >> 16)
+	}
+	return byte(y >> 16)
+}
+
+func integerChroma(frame []byte, x, y, width, sx, sy, bytesPerPixel int, colorRange uint8) (u, v byte) {
+	var su, sv int64
+	for i := x; i < x+sy; i++ {
+		for j := y; j < y+sx; j++ {
+			p := frame[bytesPerPixel*(i*width+j):]
+			r, g, b := int64(p[0]), int64(p[1]), int64(p[2])
+			su += -11076*r - 21692*g + 29426*b
+			sv += 32702*r - 27394*g - 5328*b
+		}
+	}
+	n := int64(sx * sy)
+	su, sv = su/n, sv/n
+	if colorRange == rangeLimited {
+		su, sv = su*224/255, sv*224/255
 	}
+	// U and V are centered on 128, and the coefficients add up to zero, so they can't go past 0
+	// or 255 before rounding, just as with floats.
+	round := func(c int64) byte {
+		return byte((c + 128<<16 + 1<<15) >> 16)
+	}
+	return round(su), round(sv)
+}
+
+// srgbToLinear converts an sRGB value to linear light between 0 and 1.
+// See https://en.wikipedia.org/wiki/SRGB#Transfer_function_(%22gamma%22)
+func srgbToLinear(c byte) float64 {
+	x := float64(c) / 255
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB is the inverse of srgbToLinear, returning a value between 0 and 255.
+func linearToSRGB(x float64) float64 {
+	if x <= 0.0031308 {
+		return 255 * 12.92 * x
+	}
+	return 255 * (1.055*math.Pow(x, 1/2.4) - 0.055)
+}
+
+// diffuseError spreads the quantization error e of the sample at row i, column j to its
+// neighbors in the Floyd-Steinberg pattern:
+//
+//	        +------+------+
+//	        |  *   | 7/16 |
+//	+-------+------+------+
+//	| 3/16  | 5/16 | 1/16 |
+//	+-------+------+------+
+func diffuseError(errs []float64, e float64, i, j, width, height int) {
+	if j+1 < width {
+		errs[i*width+j+1] += e * 7 / 16
+	}
+	if i+1 < height {
+		if j > 0 {
+			errs[(i+1)*width+j-1] += e * 3 / 16
+		}
+		errs[(i+1)*width+j] += e * 5 / 16
+		if j+1 < width {
+			errs[(i+1)*width+j+1] += e * 1 / 16
+		}
+	}
+}
+
+type rleOptions struct {
+	// escape selects runLengthEncodeEscaped instead of the simple count, value encoding.
+	escape bool
 
+	// zigzag zig-zag encodes the deltas before run length encoding them.
+	zigzag bool
+
+	// varint stores the counts of the simple encoding as variable-length integers. See
+	// runLengthEncode.
+	varint bool
+}
+
+// runLengthEncodeFrames stores the first frame as is and run length encodes the delta of every
+// frame after it.
+func runLengthEncodeFrames(frames [][]byte, opts rleOptions) [][]byte {
 	encoded := make([][]byte, len(frames))
+	var delta []byte
 	for i := range frames {
 		// Next, we will simplify the data by computing the delta between each frame.
 		// Observe that in many cases, pixels between frames don't change much. Therefore,
@@ -212,10 +6058,7 @@ func main() {
 			continue
 		}
 
-		delta := make([]byte, len(frames[i]))
-		for j := 0; j < len(delta); j++ {
-			delta[j] = frames[i][j] - frames[i-1][j]
-		}
+		delta = frameDelta(delta, frames[i], frames[i-1], opts.zigzag)
 
 		// Now we have our delta frame, which if we print out contains a bunch of zeroes (woah!).
 		// These zeros are pretty compressible, so we will compress them with run length encoding.
@@ -226,164 +6069,322 @@ func main() {
 		//
 		// Run length encoding is no longer used in modern codecs, but it's a good exercise and sufficient
 		// to achieve our compression goals.
+		//
+		// One weakness of this scheme is that a value that doesn't repeat takes up two bytes, so on
+		// noisy data, the output can be twice as large as the input. runLengthEncodeEscaped fixes
+		// this, at the cost of being a little more complicated.
 
-		var rle []byte
-		for j := 0; j < len(delta); {
-			// Count the number of times the current value repeats.
-			var count byte
-			for count = 0; count < 255 && j+int(count) < len(delta) && delta[j+int(count)] == delta[j]; count++ {
-			}
-
-			// Store the count and value.
-			rle = append(rle, count)
-			rle = append(rle, delta[j])
-
-			j += int(count)
+		if opts.escape {
+			encoded[i] = runLengthEncodeEscaped(delta)
+			continue
 		}
 
 		// Save the RLE frame.
-		encoded[i] = rle
+		encoded[i] = runLengthEncode(delta, opts.varint)
 	}
+	return encoded
+}
 
-	rleSize := size(encoded)
-	log.Printf("RLE size: %d bytes (%0.2f%% original size)", rleSize, 100*float32(rleSize)/float32(rawSize))
+// runLengthEncode run length encodes data as pairs of a count and the value repeated that many
+// times.
+//
+// A count is a byte, so it can only go up to 255. A frame where nothing moved is a delta of tens
+// of thousands of zeros, which still takes hundreds of pairs. With varint, the counts are
+// variable-length integers instead, like in Protocol Buffers: each byte holds 7 bits of the
+// count, and the top bit says whether another byte follows. A count below 128 still takes a
+// single byte, but a run of a million zeros takes four bytes in all.
+func runLengthEncode(data []byte, varint bool) []byte {
+	maxCount := 255
+	if varint {
+		maxCount = len(data)
+	}
 
-	// This is good, we're at 1/4 the size of the original video. But we can do better.
-	// Note that most of our longest runs are runs of zeros. This is because the delta
-	// between frames is usually small. We have a bit of flexibility in choice of algorithm
-	// here, so to keep the encoder simple, we will defer to using the DEFLATE algorithm
-	// which is available in the standard library. The implementation is beyond the scope
-	// of this demonstration.
+	var rle []byte
+	for j := 0; j < len(data); {
+		// Count the number of times the current value repeats.
+		count := 1
+		for count < maxCount && j+count < len(data) && data[j+count] == data[j] {
+			count++
+		}
 
-	var deflated bytes.Buffer
-	w, err := flate.NewWriter(&deflated, flate.BestCompression)
-	if err != nil {
-		log.Fatal(err)
+		// Store the count and value.
+		if varint {
+			rle = binary.AppendUvarint(rle, uint64(count))
+		} else {
+			rle = append(rle, byte(count))
+		}
+		rle = append(rle, data[j])
+
+		j += count
 	}
-	for i := range frames {
-		if i == 0 {
-			// This is the keyframe, write the raw frame.
-			if _, err := w.Write(frames[i]); err != nil {
-				log.Fatal(err)
+	return rle
+}
+
+// runLengthDecode reverses runLengthEncode.
+func runLengthDecode(rle []byte, varint bool) ([]byte, error) {
+	var data []byte
+	for len(rle) > 0 {
+		count, n := uint64(rle[0]), 1
+		if varint {
+			count, n = binary.Uvarint(rle)
+			if n <= 0 {
+				return nil, fmt.Errorf("run length decode: %w: invalid count", ErrCorrupt)
 			}
-			continue
 		}
-
-		delta := make([]byte, len(frames[i]))
-		for j := 0; j < len(delta); j++ {
-			delta[j] = frames[i][j] - frames[i-1][j]
+		if len(rle) < n+1 {
+			return nil, fmt.Errorf("run length decode: %w: count without a value", ErrCorrupt)
 		}
-		if _, err := w.Write(delta); err != nil {
-			log.Fatal(err)
+		if count == 0 || count > uint64(maxDimension*maxDimension*4) {
+			return nil, fmt.Errorf("run length decode: %w: invalid count %d", ErrCorrupt, count)
 		}
+		data = append(data, bytes.Repeat(rle[n:n+1], int(count))...)
+		rle = rle[n+1:]
 	}
-	if err := w.Close(); err != nil {
-		log.Fatal(err)
-	}
+	return data, nil
+}
 
-	deflatedSize := deflated.Len()
-	log.Printf("DEFLATE size: %d bytes (%0.2f%% original size)", deflatedSize, 100*float32(deflatedSize)/float32(rawSize))
+// runLengthEncodeEscaped run length encodes data using a control byte to distinguish runs of
+// repeated values from runs of literal values, much like the PackBits format:
+//
+//   - A control byte c below 128 is followed by c + 1 literal values.
+//   - A control byte c of 128 or above is followed by a single value repeated c - 125 times.
+//
+// Literal runs only cost one extra byte for every 128 values, so even random data barely grows.
+func runLengthEncodeEscaped(data []byte) []byte {
+	var rle []byte
+	for j := 0; j < len(data); {
+		// Count the number of times the current value repeats.
+		count := 1
+		for count < 130 && j+count < len(data) && data[j+count] == data[j] {
+			count++
+		}
 
-	// You'll note that the DEFLATE step takes quite a while to run. In general, encoders tend to run
-	// much slower than decoders. This is true for most compression algorithms, not just video codecs.
-	// This is because the encoder needs to do a lot of work to analyze the data and make decisions
-	// about how to compress it. The decoder, on the other hand, is just a simple loop that reads the
-	// data and does the opposite of the encoder.
-	//
-	// At this point, we've achieved a 90% compression ratio!
-	//
-	// As an aside, you might be thinking that typical JPEG compression is 90%, so why not JPEG encode
-	// every frame? While true, the algorithm we have supplied above is quite a bit simpler than JPEG.
-	// We demonstrate that taking advantage of temporal locality can yield compression ratios just as
-	// high as JPEG, but with a much simpler algorithm.
-	//
-	// Additionally, the DEFLATE algorithm does not take advantage of the two dimensionality of the data
-	// and is therefore not as efficient as it could be. In the real world, video codecs are much more
-	// complex than the one we have implemented here. They take advantage of the two dimensionality of
-	// the data, they use more sophisticated algorithms, and they are optimized for the hardware they
-	// run on. For example, the H.264 codec is implemented in hardware on many modern GPUs.
-	//
-	// Now we have our encoded video. Let's decode it and see what we get.
+		// A run of two costs two bytes either way, so it's only worth storing a repeat for three
+		// or more.
+		if count >= 3 {
+			rle = append(rle, byte(count+125), data[j])
+			j += count
+			continue
+		}
 
-	// First, we will decode the DEFLATE stream.
-	var inflated bytes.Buffer
-	r := flate.NewReader(&deflated)
-	if _, err := io.Copy(&inflated, r); err != nil {
-		log.Fatal(err)
-	}
-	if err := r.Close(); err != nil {
-		log.Fatal(err)
+		// Otherwise, collect literal values until the next run of three or more.
+		start := j
+		for j < len(data) && j-start < 128 && !(j+2 < len(data) && data[j] == data[j+1] && data[j] == data[j+2]) {
+			j++
+		}
+		rle = append(rle, byte(j-start-1))
+		rle = append(rle, data[start:j]...)
 	}
+	return rle
+}
 
-	// Split the inflated stream into frames.
-	decodedFrames := make([][]byte, 0)
-	for {
-		frame := make([]byte, width*height*3/2)
-		if _, err := io.ReadFull(&inflated, frame); err != nil {
-			if err == io.EOF {
-				break
+// runLengthDecodeEscaped reverses runLengthEncodeEscaped.
+func runLengthDecodeEscaped(rle []byte) ([]byte, error) {
+	var data []byte
+	for len(rle) > 0 {
+		c := int(rle[0])
+		if c >= 128 {
+			if len(rle) < 2 {
+				return nil, fmt.Errorf("run length decode: %w: repeat without a value", ErrCorrupt)
 			}
-			log.Fatal(err)
+			data = append(data, bytes.Repeat(rle[1:2], c-125)...)
+			rle = rle[2:]
+			continue
+		}
+		if len(rle) < c+2 {
+			return nil, fmt.Errorf("run length decode: %w: %d literals, but only %d bytes left", ErrCorrupt, c+1, len(rle)-1)
 		}
-		decodedFrames = append(decodedFrames, frame)
+		data = append(data, rle[1:c+2]...)
+		rle = rle[c+2:]
 	}
+	return data, nil
+}
 
-	// For every frame except the first one, we need to add the previous frame to the delta frame.
-	// This is the opposite of what we did in the encoder.
-	for i := range decodedFrames {
-		if i == 0 {
+// deltaHistogram adds the number of times each byte value appears in the deltas of the
+// P-frames to counts. With zigzag, the deltas are zig-zag encoded first.
+func deltaHistogram(counts *[256]int, frames [][]byte, keyframeInterval int, zigzag bool) {
+	var delta []byte
+	for i := 1; i < len(frames); i++ {
+		if keyframeInterval > 0 && i%keyframeInterval == 0 {
 			continue
 		}
-
-		for j := 0; j < len(decodedFrames[i]); j++ {
-			decodedFrames[i][j] += decodedFrames[i-1][j]
+		delta = frameDelta(delta, frames[i], frames[i-1], zigzag)
+		for _, d := range delta {
+			counts[d]++
 		}
 	}
+}
 
-	if err := os.WriteFile("decoded.yuv", bytes.Join(decodedFrames, nil), 0644); err != nil {
-		log.Fatal(err)
+// printHistogram writes counts to w as a table, one row for each delta from -16 to 16 (or each
+// zig-zag encoded delta from 0 to 32) and a final row for everything else.
+func printHistogram(w io.Writer, counts *[256]int, zigzag bool) {
+	const limit = 16
+	var total int
+	for _, n := range counts {
+		total += n
+	}
+
+	row := func(label string, n int) {
+		percent := 100 * ratio(n, total)
+		fmt.Fprintf(w, "%6s %10d %6.2f%% %s\n", label, n, percent, strings.Repeat("#", int(percent/2)))
 	}
 
-	// Then convert each YUV frame into RGB.
-	for i, frame := range decodedFrames {
-		Y := frame[:width*height]
-		U := frame[width*height : width*height+width*height/4]
-		V := frame[width*height+width*height/4:]
+	fmt.Fprintf(w, "%6s %10s %7s\n", "delta", "count", "share")
+	rest := total
+	if zigzag {
+		for z := 0; z <= 2*limit; z++ {
+			row(strconv.Itoa(z), counts[z])
+			rest -= counts[z]
+		}
+		row(fmt.Sprintf(">%d", 2*limit), rest)
+		return
+	}
+	for d := -limit; d <= limit; d++ {
+		row(strconv.Itoa(d), counts[byte(d)])
+		rest -= counts[byte(d)]
+	}
+	row(fmt.Sprintf("|d|>%d", limit), rest)
+}
 
-		rgb := make([]byte, 0, width*height*3)
-		for j := 0; j < height; j++ {
-			for k := 0; k < width; k++ {
-				y := float64(Y[j*width+k])
-				u := float64(U[(j/2)*(width/2)+(k/2)]) - 128
-				v := float64(V[(j/2)*(width/2)+(k/2)]) - 128
+// updateAverage moves each byte of avg a quarter of the way towards frame.
+//
+// Delta frames work great when the only thing that changes between frames is what's moving.
+// On a noisy or flickering static scene, though, every pixel changes a little every frame, so
+// the delta against the previous frame is full of noise: this frame's noise minus the last
+// one's. The running average smooths the noise out, so a frame's delta against it only carries
+// this frame's noise. The catch is that the average lags behind anything that moves, so on
+// footage with a lot of motion, the deltas get bigger instead. Real codecs keep long-term
+// references like this alongside the previous frame and pick whichever predicts better.
+//
+// The decoder has to compute exactly the same average to undo the deltas, so we stick to
+// integer math that rounds the same way everywhere.
+func updateAverage(avg, frame []byte) {
+	for j := range avg {
+		avg[j] = byte((3*int(avg[j]) + int(frame[j]) + 2) >> 2)
+	}
+}
 
-				r := clamp(y+1.402*v, 0, 255)
-				g := clamp(y-0.344*u-0.714*v, 0, 255)
-				b := clamp(y+1.772*u, 0, 255)
+// quantizeLuma divides each Y value by step, rounding to the nearest whole number, and
+// dequantizeLuma multiplies it back. Every Y value in a range of step values comes back as the
+// same one, so there are only about 256/step of them left. That's fewer symbols for DEFLATE to
+// code, and the deltas between frames are more often zero, since small changes in brightness
+// round away. The price is banding, which shows up first in smooth gradients like the sky.
+//
+// This is the same idea that makes JPEG and every modern video codec lossy, except that they
+// quantize frequencies after a DCT instead of the pixels themselves, which lets them throw away
+// the detail our eyes notice least.
+func quantizeLuma(y []byte, step int) {
+	for j, v := range y {
+		y[j] = byte((int(v) + step/2) / step)
+	}
+}
 
-				rgb = append(rgb, uint8(r), uint8(g), uint8(b))
-			}
+// dequantizeLuma reverses quantizeLuma, as closely as it can.
+func dequantizeLuma(y []byte, step int) {
+	for j, q := range y {
+		v := int(q) * step
+		if v > 255 {
+			v = 255
 		}
-		decodedFrames[i] = rgb
+		y[j] = byte(v)
 	}
+}
 
-	// Finally, write the decoded video to a file.
-	//
-	// This video can be played with ffplay:
-	//
-	//   ffplay -f rawvideo -pixel_format rgb24 -video_size 384x216 -framerate 25 decoded.rgb24
-	//
-	out, err := os.Create("decoded.rgb24")
-	if err != nil {
-		log.Fatal(err)
+// zigzagEncode maps each delta, read as a signed byte, so that values close to zero in either
+// direction become small bytes:
+//
+//	 0 -> 0
+//	-1 -> 1
+//	 1 -> 2
+//	-2 -> 3
+//	 2 -> 4
+//	   ...
+//
+// Subtraction wraps around, so a pixel that got a little darker has a delta of 255 or 254,
+// right next to the deltas of pixels that got a little brighter, 1 or 2. To DEFLATE, those look
+// like completely different values. After zig-zag encoding, small changes are all small bytes,
+// no matter which way they went. Protocol Buffers uses the same trick for signed integers.
+func zigzagEncode(delta []byte) {
+	for j, d := range delta {
+		delta[j] = byte(int8(d)<<1) ^ byte(int8(d)>>7)
 	}
-	defer out.Close()
+}
 
-	for i := range decodedFrames {
-		if _, err := out.Write(decodedFrames[i]); err != nil {
-			log.Fatal(err)
+// zigzagDecode reverses zigzagEncode.
+func zigzagDecode(delta []byte) {
+	for j, z := range delta {
+		delta[j] = z>>1 ^ -(z & 1)
+	}
+}
+
+// frameDelta computes the delta a P-frame of frame against ref is stored as, reusing dst if it's
+// big enough, and returns it. The encoder, the run length encoding stats and the histogram all go
+// through here, so they can't disagree about what a delta is.
+func frameDelta(dst, frame, ref []byte, zigzag bool) []byte {
+	if cap(dst) < len(frame) {
+		dst = make([]byte, len(frame))
+	}
+	dst = dst[:len(frame)]
+	subtract(dst, frame, ref)
+	if zigzag {
+		zigzagEncode(dst)
+	}
+	return dst
+}
+
+// subtract sets dst[j] = a[j] - b[j] for every byte, wrapping around on underflow.
+func subtract(dst, a, b []byte) {
+	// Frames are big, so doing this one byte at a time is slow. Instead, we treat each group of
+	// 8 bytes as a uint64 and subtract them all at once. We can't just subtract the uint64s,
+	// though, because a byte that underflows would borrow from the byte next to it. To stop
+	// that from happening, we set the top bit of every byte in a and clear it in b so no byte
+	// can underflow, then patch up the top bits with an XOR afterwards.
+	const lo, hi = 0x7f7f7f7f7f7f7f7f, 0x8080808080808080
+	j := 0
+	for ; j+8 <= len(dst); j += 8 {
+		x := binary.LittleEndian.Uint64(a[j:])
+		y := binary.LittleEndian.Uint64(b[j:])
+		binary.LittleEndian.PutUint64(dst[j:], ((x|hi)-(y&lo))^((x^^y)&hi))
+	}
+
+	// Then handle whatever is left over one byte at a time.
+	for ; j < len(dst); j++ {
+		dst[j] = a[j] - b[j]
+	}
+}
+
+// add adds b to a in place, wrapping around on overflow. This reverses subtract.
+func add(a, b []byte) {
+	for j := range a {
+		a[j] += b[j]
+	}
+}
+
+// parallelFor calls fn for every i from 0 to n-1, running up to threads calls at once.
+func parallelFor(n, threads int, fn func(i int)) {
+	if threads <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
 		}
+		return
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
 	}
+	close(next)
+	wg.Wait()
 }
 
 func size(frames [][]byte) int {
@@ -394,6 +6395,20 @@ func size(frames [][]byte) int {
 	return size
 }
 
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+func average(total, count int) int {
+	if count == 0 {
+		return 0
+	}
+	return total / count
+}
+
 func clamp(x, min, max float64) float64 {
 	if x < min {
 		return min
@@ -0,0 +1,4283 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs main instead of the tests when runCodec starts the test binary, so that the
+// tests can run the codec the way a user would, flags and all.
+func TestMain(m *testing.M) {
+	if os.Getenv("CODEC_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// codecCommand returns a command that runs the codec with args in dir, where it reads and writes
+// its files.
+func codecCommand(dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CODEC_RUN_MAIN=1")
+	return cmd
+}
+
+// runCodec runs the codec with args in dir and stdin as its input, and returns what it wrote to
+// stdout and stderr. If the codec fails, err says how.
+func runCodec(t testing.TB, dir string, stdin []byte, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	cmd := codecCommand(dir, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &outBuf, &errBuf
+	err = cmd.Run()
+	return outBuf.String(), errBuf.String(), err
+}
+
+// mustRunCodec is runCodec, failing the test if the codec fails.
+func mustRunCodec(t testing.TB, dir string, stdin []byte, args ...string) (stdout, stderr string) {
+	t.Helper()
+	stdout, stderr, err := runCodec(t, dir, stdin, args...)
+	if err != nil {
+		t.Fatalf("codec %s: %v\n%s", strings.Join(args, " "), err, stderr)
+	}
+	return stdout, stderr
+}
+
+// readFile reads a file the codec wrote, failing the test if it can't.
+func readFile(t testing.TB, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testFrames returns n rgb24 frames of a gradient that moves a pixel to the right each frame,
+// which is smooth enough to compress well and changes enough to make P-frames that aren't empty.
+func testFrames(width, height, n int) [][]byte {
+	frames := make([][]byte, n)
+	for i := range frames {
+		frame := make([]byte, width*height*3)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				p := frame[3*(y*width+x):]
+				p[0] = byte(4 * (x + i))
+				p[1] = byte(4 * y)
+				p[2] = byte(2 * (x + y + i))
+			}
+		}
+		frames[i] = frame
+	}
+	return frames
+}
+
+// testYUVFrames returns testFrames converted to planar YUV 4:2:0.
+func testYUVFrames(width, height, n int) [][]byte {
+	frames := testFrames(width, height, n)
+	for i, frame := range frames {
+		frames[i] = convertToYUV(frame, width, height, yuvOptions{})
+	}
+	return frames
+}
+
+// testHeader returns the header of a plain 25 fps video of width by height pixels.
+func testHeader(width, height int) header {
+	return header{Width: uint32(width), Height: uint32(height), FramerateNum: 25, FramerateDen: 1}
+}
+
+// encodeFrames encodes YUV frames as a single segment, failing the test if it can't.
+func encodeFrames(t testing.TB, hdr header, frames [][]byte) []byte {
+	t.Helper()
+	data, err := Encode(context.Background(), hdr, frames, &Stats{})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	return data
+}
+
+// decodeFrames decodes every frame of an encoded video, failing the test if it can't.
+func decodeFrames(t testing.TB, data []byte) ([]header, [][]byte) {
+	t.Helper()
+	headers, frames, err := Decode(context.Background(), data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return headers, frames
+}
+
+// assertFrames fails the test if got and want aren't the same frames.
+func assertFrames(t testing.TB, got, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("frame %d doesn't match", i)
+		}
+	}
+}
+
+// rawSegment returns a segment with hdr and inflated as what its DEFLATE stream inflates to,
+// which lets a test write a stream the encoder never would. The DEFLATE stream is a single
+// uncompressed block, so inflated starts rawSegmentOffset bytes into the segment.
+func rawSegment(t testing.TB, hdr header, inflated []byte) []byte {
+	t.Helper()
+	var segment bytes.Buffer
+	hdr.Version = formatVersion
+	if err := binary.Write(&segment, binary.BigEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	w, err := flate.NewWriter(&segment, flate.NoCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(inflated)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return segment.Bytes()
+}
+
+// rawSegmentOffset is where rawSegment puts the inflated stream: after the header and the 5
+// byte header of the uncompressed DEFLATE block.
+var rawSegmentOffset = binary.Size(header{}) + 5
+
+// storedFrames returns what the frames of a keyframe followed by P-frames inflate to.
+func storedFrames(t testing.TB, frames [][]byte) []byte {
+	t.Helper()
+	var inflated bytes.Buffer
+	for i, frame := range frames {
+		typ, stored := KeyFrame, frame
+		if i > 0 {
+			typ, stored = PFrame, make([]byte, len(frame))
+			subtract(stored, frame, frames[i-1])
+		}
+		if err := writeFrame(&inflated, typ, stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return inflated.Bytes()
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 3)
+	hdr := testHeader(width, height)
+	hdr.FrameCount = uint32(len(frames))
+	inflated := storedFrames(t, frames)
+	encoded := encodeFrames(t, hdr, frames)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated inflated stream", rawSegment(t, hdr, inflated[:len(inflated)-10])},
+		{"inflated stream missing a frame", rawSegment(t, hdr, storedFrames(t, frames[:2]))},
+		{"oversized inflated stream", rawSegment(t, hdr, append(append([]byte(nil), inflated...), 1, 2, 3))},
+		{"truncated compressed stream", encoded[:len(encoded)-10]},
+		{"truncated header", encoded[:10]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := Decode(context.Background(), tt.data); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Decode returned %v, want ErrCorrupt", err)
+			}
+		})
+	}
+
+	// The untouched inflated stream decodes to the frames, so it's really the changes above that
+	// the decoder is catching.
+	_, got := decodeFrames(t, rawSegment(t, hdr, inflated))
+	assertFrames(t, got, frames)
+}
+
+func TestMedianPredictor(t *testing.T) {
+	const width, height = 64, 32
+	frames := testYUVFrames(width, height, 2)
+
+	// A keyframe of a smooth gradient is what the predictor is for. Its prediction errors are
+	// nearly all the same, so they should compress much smaller than the pixels themselves.
+	sizes := map[uint8]int{}
+	for _, predictor := range []uint8{predictorNone, predictorMedian} {
+		hdr := testHeader(width, height)
+		hdr.Predictor = predictor
+		data := encodeFrames(t, hdr, frames)
+		_, got := decodeFrames(t, data)
+		assertFrames(t, got, frames)
+		sizes[predictor] = len(data)
+	}
+	if sizes[predictorMedian] >= sizes[predictorNone] {
+		t.Errorf("median predictor encoded to %d bytes, not smaller than the %d bytes without it", sizes[predictorMedian], sizes[predictorNone])
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		yuvSize       int
+	}{
+		{"even", 16, 8, 16 * 8 * 3 / 2},
+		// Odd sizes are padded to 16x8 before they're converted, like main does.
+		{"odd", 15, 7, 16 * 8 * 3 / 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const n = 4
+			stats, err := Analyze(testFrames(tt.width, tt.height, n), tt.width, tt.height)
+			if err != nil {
+				t.Fatalf("Analyze: %v", err)
+			}
+			if want := n * tt.width * tt.height * 3; stats.RawSize != want {
+				t.Errorf("RawSize = %d, want %d", stats.RawSize, want)
+			}
+			if want := n * tt.yuvSize; stats.YUVSize != want {
+				t.Errorf("YUVSize = %d, want %d", stats.YUVSize, want)
+			}
+			if stats.DeflateSize == 0 || stats.DeflateSize >= stats.RawSize {
+				t.Errorf("DeflateSize = %d, want between 0 and %d", stats.DeflateSize, stats.RawSize)
+			}
+			if want := ratio(stats.DeflateSize, stats.RawSize); stats.DeflateRatio != want {
+				t.Errorf("DeflateRatio = %v, want %v", stats.DeflateRatio, want)
+			}
+			if stats.KeyframeCount != 1 || stats.PframeCount != n-1 {
+				t.Errorf("got %d keyframes and %d P-frames, want 1 and %d", stats.KeyframeCount, stats.PframeCount, n-1)
+			}
+		})
+	}
+
+	t.Run("wrong frame size", func(t *testing.T) {
+		if _, err := Analyze(testFrames(16, 8, 2), 16, 10); err == nil {
+			t.Error("Analyze succeeded on frames smaller than the dimensions")
+		}
+	})
+}
+
+func TestDitherBanding(t *testing.T) {
+	// A horizontal blue gradient gentle enough that each column of chroma samples has a
+	// fractional U that rounding alone gets wrong by the same amount in every row, which is
+	// what shows up as a band.
+	const width, height = 64, 32
+	frame := make([]byte, width*height*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			frame[3*(y*width+x)+2] = byte(64 + x/2)
+		}
+	}
+
+	// bandError is how far off the average U of each column is from the exact value, averaged
+	// over the columns. Each column is what the eye averages over on this gradient.
+	bandError := func(opts yuvOptions) float64 {
+		yuv := convertToYUV(frame, width, height, opts)
+		u := yuv[width*height:][:width*height/4]
+		var total float64
+		for c := 0; c < width/2; c++ {
+			want, _ := chroma(0, 0, float64(64+c))
+			var sum float64
+			for r := 0; r < height/2; r++ {
+				sum += float64(u[r*width/2+c])
+			}
+			total += math.Abs(sum/(height/2) - want)
+		}
+		return total / (width / 2)
+	}
+	rounded, dithered := bandError(yuvOptions{}), bandError(yuvOptions{dither: true})
+	if dithered >= rounded {
+		t.Errorf("dithering left an average error of %.3f per column, want less than the %.3f without it", dithered, rounded)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	tests := []struct {
+		width, height, frames int
+	}{
+		{16, 8, 3},
+		{32, 16, 2},
+		{8, 8, 1},
+	}
+	var data []byte
+	var want [][]byte
+	for _, tt := range tests {
+		frames := testYUVFrames(tt.width, tt.height, tt.frames)
+		data = append(data, encodeFrames(t, testHeader(tt.width, tt.height), frames)...)
+		want = append(want, frames...)
+	}
+
+	headers, got := decodeFrames(t, data)
+	assertFrames(t, got, want)
+	i := 0
+	for k, tt := range tests {
+		for j := 0; j < tt.frames; j++ {
+			hdr := headers[i]
+			if int(hdr.Width) != tt.width || int(hdr.Height) != tt.height || int(hdr.FrameCount) != tt.frames {
+				t.Errorf("frame %d of segment %d has a header for %d frames of %dx%d, want %d of %dx%d",
+					j, k, hdr.FrameCount, hdr.Width, hdr.Height, tt.frames, tt.width, tt.height)
+			}
+			i++
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 3)
+	hdr := testHeader(width, height)
+	hdr.FrameCount = uint32(len(frames))
+	inflated := storedFrames(t, frames)
+	frameSize := len(frames[0])
+
+	for i := range frames {
+		t.Run(fmt.Sprintf("frame %d", i), func(t *testing.T) {
+			// Each frame is its type, its length, the stored frame and its checksum. We flip a
+			// byte in the middle of frame i.
+			data := rawSegment(t, hdr, inflated)
+			data[rawSegmentOffset+i*(1+4+frameSize+4)+1+4+frameSize/2] ^= 0xff
+
+			_, _, err := Decode(context.Background(), data)
+			if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), fmt.Sprintf("frame %d: checksum mismatch", i)) {
+				t.Fatalf("Decode returned %v, want a checksum mismatch in frame %d", err, i)
+			}
+
+			// With skipCorrupt, the frame is logged and replaced by the one before it, and so is
+			// every P-frame after it, since there's no keyframe to pick up again at.
+			var logs bytes.Buffer
+			_, got, err := decodeAll(context.Background(), data, decodeOptions{skipCorrupt: true, logger: log.New(&logs, "", 0)})
+			if err != nil {
+				t.Fatalf("decodeAll with skipCorrupt: %v", err)
+			}
+			if !strings.Contains(logs.String(), fmt.Sprintf("Frame %d is corrupt", i)) {
+				t.Errorf("logged %q, want frame %d to be corrupt", logs.String(), i)
+			}
+			want := append([][]byte(nil), frames[:i]...)
+			for len(want) < len(frames) {
+				if i == 0 {
+					want = append(want, blackFrame(hdr))
+				} else {
+					want = append(want, frames[i-1])
+				}
+			}
+			assertFrames(t, got, want)
+		})
+	}
+}
+
+// subtractBytes is subtract one byte at a time, the obvious way, to check subtract against.
+func subtractBytes(dst, a, b []byte) {
+	for j := range dst {
+		dst[j] = a[j] - b[j]
+	}
+}
+
+func FuzzSubtract(f *testing.F) {
+	f.Add([]byte{0, 1, 2, 255, 128, 127, 0, 0, 9}, []byte{1, 0, 255, 0, 127, 128, 0, 1, 200})
+	f.Add([]byte{}, []byte{})
+	f.Fuzz(func(t *testing.T, a, b []byte) {
+		if len(b) < len(a) {
+			a = a[:len(b)]
+		}
+		b = b[:len(a)]
+		got, want := make([]byte, len(a)), make([]byte, len(a))
+		subtract(got, a, b)
+		subtractBytes(want, a, b)
+		if !bytes.Equal(got, want) {
+			t.Errorf("subtract(%v, %v) = %v, want %v", a, b, got, want)
+		}
+	})
+}
+
+func BenchmarkSubtract(b *testing.B) {
+	frames := testYUVFrames(384, 216, 2)
+	dst := make([]byte, len(frames[0]))
+	for _, bm := range []struct {
+		name     string
+		subtract func(dst, a, b []byte)
+	}{
+		{"words", subtract},
+		{"bytes", subtractBytes},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(dst)))
+			for i := 0; i < b.N; i++ {
+				bm.subtract(dst, frames[1], frames[0])
+			}
+		})
+	}
+}
+
+func TestPackYUYV(t *testing.T) {
+	// A 4x2 planar frame: 8 Y samples, then 2 U and 2 V samples shared by both rows.
+	planar := []byte{
+		0, 1, 2, 3,
+		4, 5, 6, 7,
+		10, 11,
+		20, 21,
+	}
+	want := []byte{
+		0, 10, 1, 20, 2, 11, 3, 21,
+		4, 10, 5, 20, 6, 11, 7, 21,
+	}
+	packed := packYUYV(planar, 4, 2)
+	if !bytes.Equal(packed, want) {
+		t.Errorf("packYUYV = %v, want %v", packed, want)
+	}
+	if got := unpackYUYV(packed, 4, 2); !bytes.Equal(got, planar) {
+		t.Errorf("unpackYUYV = %v, want %v", got, planar)
+	}
+
+	// The encoder stores the packed frames as they are, and decodes them to packed frames too.
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 3)
+	for i, frame := range frames {
+		frames[i] = packYUYV(frame, width, height)
+	}
+	hdr := testHeader(width, height)
+	hdr.Layout = layoutPacked
+	_, got := decodeFrames(t, encodeFrames(t, hdr, frames))
+	assertFrames(t, got, frames)
+}
+
+func FuzzDecode(f *testing.F) {
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 3)
+	for _, hdr := range []header{
+		testHeader(width, height),
+		{Width: width, Height: height, FramerateNum: 25, FramerateDen: 1, Predictor: predictorMedian},
+		{Width: width, Height: height, FramerateNum: 25, FramerateDen: 1, BlockSkip: true, BlockSize: 8},
+		{Width: width, Height: height, FramerateNum: 25, FramerateDen: 1, ZigZag: true, Reference: referenceAverage},
+	} {
+		f.Add(encodeFrames(f, hdr, frames))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Whatever the stream says, decoding it must either fail cleanly or come up with frames
+		// that can be converted back to RGB.
+		headers, frames, err := decodeAll(context.Background(), data, decodeOptions{maxMemory: 64 << 20})
+		if err != nil {
+			return
+		}
+		for i, frame := range frames {
+			convertToRGB(frame, headers[i])
+		}
+
+		// The same goes for seeking to the last frame, which reconstructs it from the keyframe
+		// before it.
+		d, err := NewDecoder(context.Background(), data)
+		if err != nil || d.FrameCount() == 0 {
+			return
+		}
+		if err := d.Seek(d.FrameCount() - 1); err != nil {
+			return
+		}
+		d.ReadFrame()
+	})
+}
+
+func TestRequestKeyframe(t *testing.T) {
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 4)
+	enc, err := NewEncoder(testHeader(width, height), &Stats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		if i == 2 {
+			enc.RequestKeyframe()
+		}
+		if err := enc.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FrameType{KeyFrame, PFrame, KeyFrame, PFrame}
+	if got := enc.FrameTypes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("FrameTypes() = %v, want %v", got, want)
+	}
+
+	// A viewer joining at frame 2 hasn't seen the frames before it, so we reconstruct it, and
+	// the P-frame after it, without them.
+	seg, err := splitSegment(context.Background(), bytes.NewReader(data), decodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newReconstructor(&seg, false, false)
+	for i := 2; i < len(frames); i++ {
+		if got := r.frame(i); !bytes.Equal(got, frames[i]) {
+			t.Errorf("frame %d doesn't match when decoding from frame 2", i)
+		}
+	}
+}
+
+func TestAlpha(t *testing.T) {
+	// Each frame is opaque on the left half and transparent on the right.
+	const width, height, n = 16, 8, 3
+	rgbFrames := testFrames(width, height, n)
+	frames := make([][]byte, n)
+	for i, rgb := range rgbFrames {
+		frames[i] = make([]byte, 0, width*height*4)
+		for j := 0; j < width*height; j++ {
+			a := byte(255)
+			if j%width >= width/2 {
+				a = 0
+			}
+			frames[i] = append(frames[i], rgb[3*j], rgb[3*j+1], rgb[3*j+2], a)
+		}
+	}
+
+	var data bytes.Buffer
+	hdr := testHeader(width, height)
+	hdr.Alpha = true
+	fw, err := NewFrameWriter(&data, hdr, &Stats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		if err := fw.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The alpha plane is stored losslessly, so it comes back exactly, and the color comes back
+	// close to what it was, like it does without alpha.
+	headers, decoded := decodeFrames(t, data.Bytes())
+	if len(decoded) != n {
+		t.Fatalf("got %d frames, want %d", len(decoded), n)
+	}
+	for i := range decoded {
+		rgba := convertToRGB(decoded[i], headers[i])
+		if len(rgba) != len(frames[i]) {
+			t.Fatalf("frame %d is %d bytes, want %d", i, len(rgba), len(frames[i]))
+		}
+		for j := 3; j < len(rgba); j += 4 {
+			if rgba[j] != frames[i][j] {
+				t.Fatalf("frame %d: pixel %d has alpha %d, want %d", i, j/4, rgba[j], frames[i][j])
+			}
+		}
+		if p := psnr(float64(SSD(rgba, frames[i])) / float64(len(rgba))); p < 30 {
+			t.Errorf("frame %d has a PSNR of %.1f dB, want at least 30", i, p)
+		}
+	}
+}
+
+func TestRunLengthEscapedSize(t *testing.T) {
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSize int
+	}{
+		// Random data has almost no runs, so it's stored as literals with a control byte for
+		// every 128 of them.
+		{"random", random, len(random) + (len(random)+127)/128},
+		// A run of zeros takes 2 bytes for every 130 of them.
+		{"zeros", make([]byte, 13000), 200},
+		{"empty", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n := len(runLengthEncodeEscaped(tt.data)); n > tt.maxSize {
+				t.Errorf("%d bytes encoded to %d bytes, want at most %d", len(tt.data), n, tt.maxSize)
+			}
+		})
+	}
+
+	// The simple encoding, on the other hand, doubles random data.
+	if n := len(runLengthEncode(random, false)); n < len(random)*3/2 {
+		t.Errorf("the simple encoding stored random data in %d bytes, expected it to expand", n)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("can't send an interrupt on Windows")
+	}
+	const width, height = 16, 8
+	frames := testFrames(width, height, 4)
+
+	// The input is a pipe that stays open, like a capture device. We interrupt the codec while
+	// it's waiting for the fourth frame.
+	dir := t.TempDir()
+	cmd := codecCommand(dir, "-width", "16", "-height", "8")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	for _, frame := range frames[:3] {
+		stdin.Write(frame)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	stdin.Write(frames[3])
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("codec: %v\n%s", err, stderr.String())
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("codec didn't finish after being interrupted\n%s", stderr.String())
+	}
+
+	// What it encoded up to then is still a complete video.
+	_, got := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+	if len(got) != len(frames) {
+		t.Errorf("got %d frames, want %d", len(got), len(frames))
+	}
+}
+
+func TestBlockSkip(t *testing.T) {
+	// 64x32 is 4x2 blocks of 16x16. The second frame only changes a few pixels of the second
+	// block in the top row.
+	const width, height = 64, 32
+	first := testYUVFrames(width, height, 1)[0]
+	second := append([]byte(nil), first...)
+	for y := 4; y < 8; y++ {
+		for x := 20; x < 24; x++ {
+			second[y*width+x] += 50
+		}
+	}
+	frames := [][]byte{first, second}
+
+	hdr := testHeader(width, height)
+	hdr.BlockSkip = true
+	var stats Stats
+	data, err := Encode(context.Background(), hdr, frames, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blocks != 8 || stats.SkippedBlocks != 7 {
+		t.Errorf("skipped %d of %d blocks, want 7 of 8", stats.SkippedBlocks, stats.Blocks)
+	}
+	_, got := decodeFrames(t, data)
+	assertFrames(t, got, frames)
+}
+
+func TestOnDelta(t *testing.T) {
+	const width, height = 16, 8
+	frame := testYUVFrames(width, height, 1)[0]
+	enc, err := NewEncoder(testHeader(width, height), &Stats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var yuvFrames, deltas []int
+	enc.OnYUVFrame = func(idx int, yuv []byte) {
+		yuvFrames = append(yuvFrames, idx)
+	}
+	enc.OnDelta = func(idx int, delta []byte) {
+		deltas = append(deltas, idx)
+		for j, d := range delta {
+			if d != 0 {
+				t.Fatalf("delta of frame %d is %d at byte %d, want all zeros for a static frame", idx, d, j)
+			}
+		}
+	}
+	// The same frame three times over: a keyframe, then two P-frames with nothing in them.
+	for i := 0; i < 3; i++ {
+		if err := enc.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 1, 2}; !reflect.DeepEqual(yuvFrames, want) {
+		t.Errorf("OnYUVFrame called for frames %v, want %v", yuvFrames, want)
+	}
+	if want := []int{1, 2}; !reflect.DeepEqual(deltas, want) {
+		t.Errorf("OnDelta called for frames %v, want %v", deltas, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	input := bytes.Join(testFrames(32, 16, 3), nil)
+	tests := []struct {
+		name     string
+		minPSNR  string
+		exitCode int
+	}{
+		{"passes", "25", 0},
+		{"fails", "100", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, stderr, err := runCodec(t, t.TempDir(), input, "-width", "32", "-height", "16", "-verify", "-min-psnr", tt.minPSNR)
+			exitCode := 0
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				exitCode = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if exitCode != tt.exitCode {
+				t.Errorf("exited with status %d, want %d\n%s", exitCode, tt.exitCode, stderr)
+			}
+			if !strings.Contains(stderr, "PSNR: ") {
+				t.Errorf("didn't log the PSNR:\n%s", stderr)
+			}
+		})
+	}
+}
+
+func TestSubsampling411(t *testing.T) {
+	// Each run of 4 pixels in a row gets a color of its own, which is exactly what a 4:1:1 U and V
+	// sample can hold, so the colors should come back out where they went in.
+	const width, height = 16, 4
+	frame := make([]byte, width*height*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := y*width/4 + x/4
+			copy(frame[3*(y*width+x):], []byte{byte(40 + 12*c), byte(200 - 9*c), byte(60 + 5*c)})
+		}
+	}
+	hdr := testHeader(width, height)
+	hdr.Subsampling = subsampling411
+	yuv := convertToYUV(frame, width, height, yuvOptions{subsampling: subsampling411})
+
+	want := []plane{
+		{0, width, height},
+		{width * height, width / 4, height},
+		{width*height + width/4*height, width / 4, height},
+	}
+	if got := yuvPlanes(hdr); !reflect.DeepEqual(got, want) {
+		t.Errorf("yuvPlanes = %v, want %v", got, want)
+	}
+	if len(yuv) != hdr.frameSize() || hdr.frameSize() != width*height*3/2 {
+		t.Errorf("frame is %d bytes and frameSize is %d, want %d", len(yuv), hdr.frameSize(), width*height*3/2)
+	}
+
+	_, got := decodeFrames(t, encodeFrames(t, hdr, [][]byte{yuv}))
+	assertFrames(t, got, [][]byte{yuv})
+
+	// The conversion to YUV and back isn't exact, so each pixel should come out the same as a
+	// frame that's nothing but its color does. A sample taken from the wrong place would come out
+	// as the color of another run.
+	rgb := convertToRGB(got[0], hdr)
+	solidHdr := testHeader(4, 1)
+	solidHdr.Subsampling = subsampling411
+	for j := 0; j < width*height; j++ {
+		solid := bytes.Repeat(frame[3*j:3*j+3], 4)
+		want := convertToRGB(convertToYUV(solid, 4, 1, yuvOptions{subsampling: subsampling411}), solidHdr)[:3]
+		if !bytes.Equal(rgb[3*j:3*j+3], want) {
+			t.Fatalf("pixel %d is %v, want %v", j, rgb[3*j:3*j+3], want)
+		}
+	}
+}
+
+func TestBits(t *testing.T) {
+	t.Run("layout", func(t *testing.T) {
+		// The example from the bitWriter comment.
+		var w bitWriter
+		w.writeBits(0b1, 1)
+		w.writeBits(0b01, 2)
+		w.writeBits(0b11111, 5)
+		w.writeBits(0b1, 1)
+		if got, want := w.bytes(), []byte{0b10111111, 0b10000000}; !bytes.Equal(got, want) {
+			t.Errorf("wrote %08b, want %08b", got, want)
+		}
+	})
+
+	for n := 1; n <= 32; n++ {
+		t.Run(fmt.Sprintf("%d bits", n), func(t *testing.T) {
+			// A 3 bit field first puts every field after it off the byte boundaries. Each
+			// width gets its biggest value, a pattern of alternating bits and zero.
+			ones := uint32(1<<n - 1)
+			fields := []struct {
+				v uint32
+				n int
+			}{{0b101, 3}, {ones, n}, {0xaaaaaaaa & ones, n}, {0, n}, {ones, n}}
+			var w bitWriter
+			bits := 0
+			for _, f := range fields {
+				w.writeBits(f.v, f.n)
+				bits += f.n
+			}
+			buf := w.bytes()
+			if len(buf) != (bits+7)/8 {
+				t.Fatalf("wrote %d bytes for %d bits, want %d", len(buf), bits, (bits+7)/8)
+			}
+
+			r := bitReader{buf: buf}
+			for i, f := range fields {
+				v, err := r.readBits(f.n)
+				if err != nil {
+					t.Fatalf("field %d: %v", i, err)
+				}
+				if v != f.v {
+					t.Errorf("field %d is %#x, want %#x", i, v, f.v)
+				}
+			}
+
+			// The final byte is padded with zeros, and there's nothing after it.
+			pad := 8*len(buf) - bits
+			if pad > 0 {
+				if v, err := r.readBits(pad); err != nil || v != 0 {
+					t.Errorf("padding is %#x, %v, want 0", v, err)
+				}
+			}
+			if _, err := r.readBits(1); err != io.ErrUnexpectedEOF {
+				t.Errorf("reading past the end returned %v, want io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+}
+
+func TestZigZag(t *testing.T) {
+	// Small deltas of either sign come out as small values: 0, -1, 1, -2, 2, ...
+	tests := []struct {
+		delta int8
+		want  byte
+	}{
+		{0, 0}, {-1, 1}, {1, 2}, {-2, 3}, {2, 4}, {127, 254}, {-128, 255},
+	}
+	for _, tt := range tests {
+		b := []byte{byte(tt.delta)}
+		zigzagEncode(b)
+		if b[0] != tt.want {
+			t.Errorf("zigzagEncode(%d) = %d, want %d", tt.delta, b[0], tt.want)
+		}
+	}
+
+	// Every byte maps to a different byte and back again.
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	encoded := append([]byte(nil), all...)
+	zigzagEncode(encoded)
+	seen := map[byte]bool{}
+	for _, z := range encoded {
+		seen[z] = true
+	}
+	if len(seen) != 256 {
+		t.Errorf("zigzagEncode maps 256 bytes to only %d different values", len(seen))
+	}
+	zigzagDecode(encoded)
+	if !bytes.Equal(encoded, all) {
+		t.Errorf("zigzagDecode(zigzagEncode(b)) = %v, want %v", encoded, all)
+	}
+
+	// The encoder and decoder agree on it too.
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 3)
+	hdr := testHeader(width, height)
+	hdr.ZigZag = true
+	_, got := decodeFrames(t, encodeFrames(t, hdr, frames))
+	assertFrames(t, got, frames)
+}
+
+func TestDecodeFormatYUV(t *testing.T) {
+	// Odd dimensions are padded to fit the chroma, and the decoded YUV should be the padded frames
+	// the encoder saw, exactly as they went in.
+	tests := []struct {
+		name          string
+		width, height int
+	}{
+		{"even", 32, 16},
+		{"odd", 31, 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			mustRunCodec(t, dir, bytes.Join(testFrames(tt.width, tt.height, 3), nil),
+				"-width", strconv.Itoa(tt.width), "-height", strconv.Itoa(tt.height), "-decode-format", "yuv")
+			encoded := readFile(t, filepath.Join(dir, "encoded.yuv"))
+			decoded := readFile(t, filepath.Join(dir, "decoded.yuv"))
+			if len(encoded) == 0 || !bytes.Equal(decoded, encoded) {
+				t.Errorf("decoded.yuv (%d bytes) doesn't match encoded.yuv (%d bytes)", len(decoded), len(encoded))
+			}
+			if _, err := os.Stat(filepath.Join(dir, "decoded.rgb24")); !os.IsNotExist(err) {
+				t.Errorf("wrote decoded.rgb24 with -decode-format yuv")
+			}
+		})
+	}
+}
+
+func TestReadSidecar(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"settings", "width=32\nheight = 16\nframerate=30000/1001\n", map[string]string{"width": "32", "height": "16", "framerate": "30000/1001"}, false},
+		{"comments and blank lines", "# clip\n\nwidth=32\n", map[string]string{"width": "32"}, false},
+		{"missing equals", "width 32\n", nil, true},
+		{"duplicate", "width=32\nwidth=16\n", nil, true},
+		{"unknown setting", "depth=8\n", nil, true},
+		{"negative width", "width=-32\n", nil, true},
+		{"invalid framerate", "framerate=fast\n", nil, true},
+		{"pixel aspect ratio", "par=10:11\n", map[string]string{"par": "10:11"}, false},
+		{"invalid pixel aspect ratio", "par=wide\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "video.rgb24.meta")
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readSidecar(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSidecar returned error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readSidecar = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if meta, err := readSidecar(filepath.Join(t.TempDir(), "missing.meta")); meta != nil || err != nil {
+		t.Errorf("readSidecar of a missing file = %v, %v, want no settings", meta, err)
+	}
+}
+
+func TestSidecarPrecedence(t *testing.T) {
+	const width, height = 32, 16
+	input := bytes.Join(testFrames(width, height, 2), nil)
+	tests := []struct {
+		name    string
+		meta    string
+		args    []string
+		warning bool
+	}{
+		{"sidecar", "width=32\nheight=16\nframerate=30\n", nil, false},
+		// The sidecar is wrong, but the flags win.
+		{"flags win", "width=16\nheight=8\nframerate=30\n", []string{"-width", "32", "-height", "16"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "video.rgb24"), input, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "video.rgb24.meta"), []byte(tt.meta), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, stderr := mustRunCodec(t, dir, nil, append([]string{"-input", "video.rgb24"}, tt.args...)...)
+			if got := strings.Contains(stderr, "Warning: -width overrides width=16"); got != tt.warning {
+				t.Errorf("warned about the override: %v, want %v\n%s", got, tt.warning, stderr)
+			}
+
+			headers, frames := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+			hdr := headers[0]
+			if len(frames) != 2 || hdr.Width != width || hdr.Height != height {
+				t.Errorf("encoded %d frames of %dx%d, want 2 of %dx%d", len(frames), hdr.Width, hdr.Height, width, height)
+			}
+			// The framerate comes from the sidecar either way.
+			if hdr.FramerateNum != 30 || hdr.FramerateDen != 1 {
+				t.Errorf("framerate is %d/%d, want 30/1", hdr.FramerateNum, hdr.FramerateDen)
+			}
+		})
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	tests := []struct {
+		name       string
+		frameCount uint32
+		maxMemory  int
+		corrupt    bool
+	}{
+		// Far more frames than could be in the stream, however well they compressed.
+		{"absurd frame count", 4_000_000_000, 0, true},
+		// Few enough frames that they could be in the stream, but too many to hold in memory.
+		{"over the limit", 1000, 64 << 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := testHeader(1920, 1080)
+			hdr.FrameCount = tt.frameCount
+			data := rawSegment(t, hdr, make([]byte, 100))
+
+			// The guard has to trip before the frames are allocated, not after.
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, _, err := decodeAll(context.Background(), data, decodeOptions{maxMemory: tt.maxMemory})
+			runtime.ReadMemStats(&after)
+			if err == nil {
+				t.Fatal("decoded a video that doesn't fit")
+			}
+			if errors.Is(err, ErrCorrupt) != tt.corrupt || !tt.corrupt && !strings.Contains(err.Error(), "bytes of memory") {
+				t.Errorf("Decode returned %v, want ErrCorrupt: %v", err, tt.corrupt)
+			}
+			if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+				t.Errorf("allocated %d bytes before failing", n)
+			}
+		})
+	}
+}
+
+func TestThreads(t *testing.T) {
+	input := bytes.Join(testFrames(64, 32, 6), nil)
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"whole frames", nil},
+		// Tiles are encoded in parallel too.
+		{"tiled", []string{"-tile-size", "16"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputs := map[string][]byte{}
+			for _, threads := range []string{"1", "4"} {
+				dir := t.TempDir()
+				mustRunCodec(t, dir, input, append([]string{"-width", "64", "-height", "32", "-threads", threads}, tt.args...)...)
+				for _, name := range []string{"encoded.bin", "decoded.rgb24"} {
+					data := readFile(t, filepath.Join(dir, name))
+					if prev, ok := outputs[name]; ok && !bytes.Equal(data, prev) {
+						t.Errorf("%s with -threads %s differs from -threads 1", name, threads)
+					}
+					outputs[name] = data
+				}
+			}
+		})
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	quality, err := selfTest()
+	if err != nil {
+		t.Fatalf("selfTest: %v", err)
+	}
+	if quality < 25 {
+		t.Errorf("selfTest PSNR is %.2f dB, want at least the default -min-psnr of 25 dB", quality)
+	}
+
+	// From the command line, it doesn't read any input and passes or fails on -min-psnr.
+	tests := []struct {
+		minPSNR string
+		pass    bool
+	}{
+		{"25", true},
+		{"100", false},
+	}
+	for _, tt := range tests {
+		t.Run("min-psnr "+tt.minPSNR, func(t *testing.T) {
+			_, stderr, err := runCodec(t, t.TempDir(), nil, "-selftest", "-min-psnr", tt.minPSNR)
+			if (err == nil) != tt.pass || strings.Contains(stderr, "self-test passed") != tt.pass {
+				t.Errorf("-selftest returned %v, want it to pass: %v\n%s", err, tt.pass, stderr)
+			}
+		})
+	}
+}
+
+// residualEnergy encodes frames with hdr and returns the sum of the squares of every P-frame
+// delta, taking each delta as the signed value it stands for.
+func residualEnergy(t testing.TB, hdr header, frames [][]byte) int {
+	t.Helper()
+	enc, err := NewEncoder(hdr, &Stats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var energy int
+	enc.OnDelta = func(idx int, delta []byte) {
+		for _, d := range delta {
+			energy += int(int8(d)) * int(int8(d))
+		}
+	}
+	for _, frame := range frames {
+		if err := enc.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return energy
+}
+
+func TestReferenceAverage(t *testing.T) {
+	// A static scene with every pixel flickering a little from frame to frame, like sensor noise.
+	const width, height = 32, 16
+	rng := rand.New(rand.NewSource(1))
+	frames := make([][]byte, 20)
+	for i := range frames {
+		frames[i] = make([]byte, width*height*3/2)
+		for j := range frames[i] {
+			frames[i][j] = byte(100 + j%50 + rng.Intn(9) - 4)
+		}
+	}
+
+	energy := map[uint8]int{}
+	for _, reference := range []uint8{referencePrev, referenceAverage} {
+		hdr := testHeader(width, height)
+		hdr.Reference = reference
+		energy[reference] = residualEnergy(t, hdr, frames)
+		_, got := decodeFrames(t, encodeFrames(t, hdr, frames))
+		assertFrames(t, got, frames)
+	}
+	// The average settles on the scene without the flicker, so each frame only differs from it
+	// by its own flicker, rather than by its flicker and the previous frame's.
+	if energy[referenceAverage] >= energy[referencePrev] {
+		t.Errorf("residual energy against the average is %d, want less than the %d against the previous frame",
+			energy[referenceAverage], energy[referencePrev])
+	}
+}
+
+func TestStoreOnExpand(t *testing.T) {
+	const width, height = 32, 16
+	noise := make([][]byte, 3)
+	rng := rand.New(rand.NewSource(1))
+	for i := range noise {
+		noise[i] = make([]byte, width*height*3/2)
+		rng.Read(noise[i])
+	}
+	tests := []struct {
+		name   string
+		frames [][]byte
+		stored bool
+	}{
+		{"noise", noise, true},
+		{"gradient", testYUVFrames(width, height, 3), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := NewEncoder(testHeader(width, height), &Stats{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			enc.StoreOnExpand = true
+			for _, frame := range tt.frames {
+				if err := enc.WriteFrame(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := enc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers, got := decodeFrames(t, data)
+			assertFrames(t, got, tt.frames)
+			if headers[0].Stored != tt.stored {
+				t.Errorf("Stored = %v, want %v", headers[0].Stored, tt.stored)
+			}
+			if rawSize := size(tt.frames) + binary.Size(header{}); tt.stored && len(data) != rawSize {
+				t.Errorf("stored segment is %d bytes, want %d", len(data), rawSize)
+			}
+		})
+	}
+
+	// Without -store-on-expand, main warns that the video got bigger.
+	input := make([]byte, width*height*3*3)
+	rng.Read(input)
+	_, stderr := mustRunCodec(t, t.TempDir(), input, "-width", "32", "-height", "16")
+	if !strings.Contains(stderr, "Warning: the compressed video is bigger") {
+		t.Errorf("didn't warn about the video getting bigger:\n%s", stderr)
+	}
+}
+
+// failingWriter fails every write with errFailingWriter.
+type failingWriter struct{}
+
+var errFailingWriter = errors.New("disk full")
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errFailingWriter
+}
+
+func TestErrorWrapping(t *testing.T) {
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 2)
+	hdr := testHeader(width, height)
+	encoded := encodeFrames(t, hdr, frames)
+	badVersion := append([]byte{formatVersion + 1}, encoded[1:]...)
+	badDeflate := append(append([]byte(nil), encoded[:binary.Size(header{})]...), 0xff, 0xff, 0xff, 0xff)
+	badChecksum := rawSegment(t, header{Width: width, Height: height, FrameCount: 1, FramerateNum: 25, FramerateDen: 1},
+		append(storedFrames(t, frames[:1])[:len(frames[0])+5], 0, 0, 0, 0))
+
+	tests := []struct {
+		name   string
+		err    func() error
+		prefix string
+		target error
+	}{
+		{"truncated header", func() error { _, _, err := Decode(context.Background(), encoded[:5]); return err }, "read header: ", ErrCorrupt},
+		{"unsupported version", func() error { _, _, err := Decode(context.Background(), badVersion); return err }, "read header: unsupported format version", nil},
+		{"invalid DEFLATE", func() error { _, _, err := Decode(context.Background(), badDeflate); return err }, "inflate: ", ErrCorrupt},
+		{"checksum mismatch", func() error { _, _, err := Decode(context.Background(), badChecksum); return err }, "split frames: ", ErrCorrupt},
+		{"unknown compression", func() error {
+			hdr := hdr
+			hdr.Compression = 99
+			_, err := NewEncoder(hdr, &Stats{})
+			return err
+		}, "create encoder: ", nil},
+		{"wrong frame size", func() error {
+			fw, err := NewFrameWriter(io.Discard, hdr, &Stats{})
+			if err != nil {
+				return err
+			}
+			return fw.WriteFrame(make([]byte, 10))
+		}, "write frame 0: ", nil},
+		{"failed write", func() error {
+			fw, err := NewFrameWriter(failingWriter{}, hdr, &Stats{})
+			if err != nil {
+				return err
+			}
+			return fw.Close()
+		}, "", errFailingWriter},
+		{"canceled", func() error {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, _, err := Decode(ctx, encoded)
+			return err
+		}, "", context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.err()
+			if err == nil {
+				t.Fatal("succeeded, want an error")
+			}
+			if !strings.HasPrefix(err.Error(), tt.prefix) {
+				t.Errorf("error %q doesn't start with %q", err, tt.prefix)
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Errorf("error %q doesn't wrap %q", err, tt.target)
+			}
+		})
+	}
+}
+
+func TestTiles(t *testing.T) {
+	// 40x24 doesn't divide into 16x16 tiles, so the tiles on the right and bottom are cut short.
+	const width, height = 40, 24
+	frames := testYUVFrames(width, height, 4)
+	_, whole := decodeFrames(t, encodeFrames(t, testHeader(width, height), frames))
+	assertFrames(t, whole, frames)
+	for _, tileSize := range []uint16{16, 32, 64} {
+		t.Run(fmt.Sprintf("%d", tileSize), func(t *testing.T) {
+			hdr := testHeader(width, height)
+			hdr.TileSize = tileSize
+			_, tiled := decodeFrames(t, encodeFrames(t, hdr, frames))
+			assertFrames(t, tiled, whole)
+		})
+	}
+}
+
+func TestOddDimensions(t *testing.T) {
+	const width, height, n = 5, 3, 2
+	frames := testFrames(width, height, n)
+	dir := t.TempDir()
+	mustRunCodec(t, dir, bytes.Join(frames, nil), "-width", "5", "-height", "3")
+
+	// The frames are stored padded to 6x4, and the header says by how much.
+	headers, _ := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+	if hdr := headers[0]; hdr.Width != 6 || hdr.Height != 4 || hdr.PadRight != 1 || hdr.PadBottom != 1 {
+		t.Errorf("header is %dx%d padded by %dx%d, want 6x4 padded by 1x1", hdr.Width, hdr.Height, hdr.PadRight, hdr.PadBottom)
+	}
+
+	// The decoder crops them back to exactly 5x3.
+	decoded := readFile(t, filepath.Join(dir, "decoded.rgb24"))
+	if len(decoded) != n*width*height*3 {
+		t.Fatalf("decoded.rgb24 is %d bytes, want %d frames of 5x3 (%d bytes)", len(decoded), n, n*width*height*3)
+	}
+	if p := psnr(float64(SSD(decoded, bytes.Join(frames, nil))) / float64(len(decoded))); p < 30 {
+		t.Errorf("PSNR is %.1f dB, want at least 30", p)
+	}
+}
+
+func TestReadRate(t *testing.T) {
+	// At 20 frames per second, reading 6 frames waits for 6 ticks 50 ms apart.
+	input := bytes.Join(testFrames(16, 8, 6), nil)
+	start := time.Now()
+	mustRunCodec(t, t.TempDir(), input, "-width", "16", "-height", "8", "-read-rate", "20")
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("reading 6 frames at 20 fps took %v, want about 300ms", elapsed)
+	}
+}
+
+func TestDiffFiles(t *testing.T) {
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 3)
+	modified := append([][]byte(nil), frames...)
+	modified[1] = append([]byte(nil), frames[1]...)
+	modified[1][3*width+5] += 7
+
+	dir := t.TempDir()
+	write := func(name string, frames [][]byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, encodeFrames(t, testHeader(width, height), frames), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a, b := write("a.bin", frames), write("b.bin", modified)
+
+	tests := []struct {
+		name string
+		b    string
+		want []string
+	}{
+		{"itself", a, []string{"frame 0: identical\n", "frame 1: identical\n", "frame 2: identical\n", "\nidentical\n"}},
+		{"modified", b, []string{"frame 0: identical\n", "frame 1: PSNR ", "frame 2: identical\n", "1 frames differ, max delta 7, first difference at frame 1, Y (5, 3)\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			if err := diffFiles(&out, a, tt.b, decodeOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestChromaRounding(t *testing.T) {
+	// A gradient in every channel, so the exact U and V of the samples have all sorts of
+	// fractional parts.
+	const width, height = 64, 32
+	frame := testFrames(width, height, 1)[0]
+	yuv := convertToYUV(frame, width, height, yuvOptions{})
+	U := yuv[width*height:][:width*height/4]
+	V := yuv[width*height*5/4:][:width*height/4]
+
+	// Each sample is the exact average rounded to the nearest value, so it's never off by more
+	// than a half, and it's off in either direction about as often, with no bias downward.
+	var bias float64
+	for i := 0; i < height/2; i++ {
+		for j := 0; j < width/2; j++ {
+			var u, v float64
+			for _, p := range [][2]int{{2 * i, 2 * j}, {2 * i, 2*j + 1}, {2*i + 1, 2 * j}, {2*i + 1, 2*j + 1}} {
+				px := frame[3*(p[0]*width+p[1]):]
+				pu, pv := chroma(float64(px[0]), float64(px[1]), float64(px[2]))
+				u += pu / 4
+				v += pv / 4
+			}
+			c := i*width/2 + j
+			for _, d := range []float64{float64(U[c]) - u, float64(V[c]) - v} {
+				if math.Abs(d) > 0.5+1e-9 {
+					t.Fatalf("sample (%d, %d) is off by %.3f, want at most 0.5", j, i, d)
+				}
+				bias += d
+			}
+		}
+	}
+	if bias /= width * height / 2; math.Abs(bias) > 0.1 {
+		t.Errorf("the samples are off by %.3f on average, want about 0", bias)
+	}
+}
+
+func TestYUVInput(t *testing.T) {
+	// yuv420p input skips the conversion from RGB, so with -decode-format yuv, it comes back out
+	// exactly as it went in.
+	input := bytes.Join(testYUVFrames(32, 16, 3), nil)
+	dir := t.TempDir()
+	mustRunCodec(t, dir, input, "-width", "32", "-height", "16", "-input-format", "yuv420p", "-decode-format", "yuv")
+	if decoded := readFile(t, filepath.Join(dir, "decoded.yuv")); !bytes.Equal(decoded, input) {
+		t.Errorf("decoded.yuv (%d bytes) doesn't match the input (%d bytes)", len(decoded), len(input))
+	}
+}
+
+// cancelAfter is a context that's canceled once its Err method has been called n times, which
+// lands the cancellation partway through a call that checks it between frames.
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.n <= 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestCancel(t *testing.T) {
+	const width, height = 64, 32
+	frames := testYUVFrames(width, height, 100)
+	encoded := encodeFrames(t, testHeader(width, height), frames)
+	tests := []struct {
+		name string
+		run  func(ctx context.Context) error
+	}{
+		{"Encode", func(ctx context.Context) error {
+			_, err := Encode(ctx, testHeader(width, height), frames, &Stats{})
+			return err
+		}},
+		{"Decode", func(ctx context.Context) error {
+			_, _, err := Decode(ctx, encoded)
+			return err
+		}},
+		{"NewDecoder", func(ctx context.Context) error {
+			_, err := NewDecoder(ctx, encoded)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &cancelAfter{Context: context.Background(), n: 10}
+			if err := tt.run(ctx); !errors.Is(err, context.Canceled) {
+				t.Errorf("returned %v, want context.Canceled", err)
+			}
+		})
+	}
+}
+
+func TestLinearDownsample(t *testing.T) {
+	// From a distance, a checkerboard of two colors looks like their blend, and what the eye
+	// blends is the light, not the sRGB values. The U and V samples should be those of that
+	// blend, which is what -linear-downsample works out and what the plain average gets wrong.
+	tests := []struct {
+		name string
+		a, b [3]byte
+	}{
+		{"black and white", [3]byte{0, 0, 0}, [3]byte{255, 255, 255}},
+		{"red and green", [3]byte{255, 0, 0}, [3]byte{0, 255, 0}},
+		{"blue and yellow", [3]byte{0, 0, 255}, [3]byte{255, 255, 0}},
+	}
+	const width, height = 16, 16
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := make([]byte, 0, width*height*3)
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					if (x+y)%2 == 0 {
+						frame = append(frame, tt.a[:]...)
+					} else {
+						frame = append(frame, tt.b[:]...)
+					}
+				}
+			}
+			var blend [3]float64
+			for ch := range blend {
+				blend[ch] = linearToSRGB((srgbToLinear(tt.a[ch]) + srgbToLinear(tt.b[ch])) / 2)
+			}
+			wantU, wantV := chroma(blend[0], blend[1], blend[2])
+
+			// chromaError is how far off the U and V samples are from the blend's, at worst.
+			chromaError := func(opts yuvOptions) float64 {
+				yuv := convertToYUV(frame, width, height, opts)
+				var worst float64
+				for c := 0; c < width*height/4; c++ {
+					u, v := float64(yuv[width*height+c]), float64(yuv[width*height*5/4+c])
+					worst = math.Max(worst, math.Max(math.Abs(u-wantU), math.Abs(v-wantV)))
+				}
+				return worst
+			}
+			gamma, linear := chromaError(yuvOptions{}), chromaError(yuvOptions{linear: true})
+			if linear > 0.5+1e-9 || linear >= gamma {
+				t.Errorf("chroma is off by %.2f with -linear-downsample and %.2f without it, want at most 0.5 and less", linear, gamma)
+			}
+		})
+	}
+}
+
+// encodeWithKeyframes encodes YUV frames as a single segment with a keyframe every interval
+// frames.
+func encodeWithKeyframes(t testing.TB, hdr header, frames [][]byte, interval int) []byte {
+	t.Helper()
+	enc, err := NewEncoder(hdr, &Stats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		if i%interval == 0 {
+			enc.RequestKeyframe()
+		}
+		if err := enc.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecoderSeek(t *testing.T) {
+	// Two segments, the first with keyframes every 3 frames and the second with only the first.
+	data := append(encodeWithKeyframes(t, testHeader(16, 8), testYUVFrames(16, 8, 8), 3),
+		encodeFrames(t, testHeader(32, 16), testYUVFrames(32, 16, 4))...)
+	_, want := decodeFrames(t, data)
+
+	d, err := NewDecoder(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.FrameCount() != len(want) {
+		t.Fatalf("FrameCount() = %d, want %d", d.FrameCount(), len(want))
+	}
+	if d.seg != -1 || d.loaded.frames != nil {
+		t.Errorf("NewDecoder held on to segment %d, want none until a frame is read", d.seg)
+	}
+	// Forward within a GOP, back to a keyframe, back to a P-frame, the same frame twice and
+	// across segments.
+	for _, i := range []int{5, 7, 6, 0, 4, 4, 11, 8, 10, 2} {
+		if err := d.Seek(i); err != nil {
+			t.Fatalf("Seek(%d): %v", i, err)
+		}
+		_, frame, err := d.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame after Seek(%d): %v", i, err)
+		}
+		if !bytes.Equal(frame, want[i]) {
+			t.Errorf("frame %d doesn't match the sequential decode", i)
+		}
+		// Only the segment the frame is in is held, inflated.
+		seg, frames := 0, 8
+		if i >= 8 {
+			seg, frames = 1, 4
+		}
+		if d.seg != seg || len(d.loaded.frames) != frames {
+			t.Errorf("after frame %d, holding segment %d with %d frames, want segment %d with %d", i, d.seg, len(d.loaded.frames), seg, frames)
+		}
+	}
+
+	if err := d.Seek(len(want)); err != nil {
+		t.Errorf("Seek to the end: %v", err)
+	}
+	if _, _, err := d.ReadFrame(); err != io.EOF {
+		t.Errorf("ReadFrame at the end returned %v, want io.EOF", err)
+	}
+	if err := d.Seek(len(want) + 1); err == nil {
+		t.Error("Seek past the end succeeded")
+	}
+}
+
+func TestLogFormatJSON(t *testing.T) {
+	stdout, stderr := mustRunCodec(t, t.TempDir(), bytes.Join(testFrames(32, 16, 3), nil), "-width", "32", "-height", "16", "-log-format", "json")
+	if strings.Contains(stderr, "Raw size") {
+		t.Errorf("logged the stats as text too:\n%s", stderr)
+	}
+	var stats map[string]interface{}
+	if err := json.Unmarshal([]byte(stdout), &stats); err != nil {
+		t.Fatalf("stdout isn't a JSON object: %v\n%s", err, stdout)
+	}
+	for _, key := range []string{"rawSize", "yuvSize", "rleSize", "deflateSize", "yuvRatio", "rleRatio", "deflateRatio", "yuvTime", "deflateTime", "decodeTime"} {
+		if _, ok := stats[key]; !ok {
+			t.Errorf("%s is missing", key)
+		}
+	}
+	raw, _ := stats["rawSize"].(float64)
+	if raw != 32*16*3*3 {
+		t.Fatalf("rawSize = %v, want %d", stats["rawSize"], 32*16*3*3)
+	}
+	for _, stage := range []string{"yuv", "rle", "deflate"} {
+		size, _ := stats[stage+"Size"].(float64)
+		ratio, _ := stats[stage+"Ratio"].(float64)
+		if want := size / raw; math.Abs(ratio-want) > 1e-9 || ratio <= 0 {
+			t.Errorf("%sRatio = %v, want %v", stage, ratio, want)
+		}
+	}
+}
+
+func TestSymmetry(t *testing.T) {
+	const width, height = 32, 16
+	hdr := testHeader(width, height)
+	noise := make([]byte, hdr.frameSize())
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	// mirror makes each plane of noise symmetric, top to bottom or left to right.
+	mirror := func(topBottom bool) []byte {
+		frame := append([]byte(nil), noise...)
+		for _, p := range yuvPlanes(hdr) {
+			plane := frame[p.offset : p.offset+p.width*p.height]
+			for i := 0; i < p.height; i++ {
+				for j := 0; j < p.width; j++ {
+					if topBottom {
+						plane[i*p.width+j] = plane[(p.height-1-i)*p.width+j]
+					} else {
+						plane[i*p.width+j] = plane[i*p.width+p.width-1-j]
+					}
+				}
+			}
+		}
+		return frame
+	}
+	tests := []struct {
+		name     string
+		frame    []byte
+		mirrored int
+		size     int
+	}{
+		// A byte for each plane, and then half of each plane.
+		{"top to bottom", mirror(true), 3, 3 + len(noise)/2},
+		{"left to right", mirror(false), 3, 3 + len(noise)/2},
+		{"not symmetric", noise, 0, 3 + len(noise)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, mirrored := foldFrame(tt.frame, hdr)
+			if mirrored != tt.mirrored || len(stored) != tt.size {
+				t.Errorf("stored %d bytes with %d planes mirrored, want %d bytes with %d", len(stored), mirrored, tt.size, tt.mirrored)
+			}
+			if got := unfoldFrame(stored, hdr); !bytes.Equal(got, tt.frame) {
+				t.Error("unfoldFrame doesn't reconstruct the frame")
+			}
+
+			symHdr := hdr
+			symHdr.Symmetry = true
+			var stats Stats
+			data, err := Encode(context.Background(), symHdr, [][]byte{tt.frame}, &stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, got := decodeFrames(t, data)
+			assertFrames(t, got, [][]byte{tt.frame})
+			if stats.MirroredPlanes != tt.mirrored {
+				t.Errorf("MirroredPlanes = %d, want %d", stats.MirroredPlanes, tt.mirrored)
+			}
+		})
+	}
+}
+
+func TestRefDistance(t *testing.T) {
+	// Something that flips back and forth between two states every frame, like a blinking light.
+	const width, height = 32, 16
+	states := testYUVFrames(width, height, 8)
+	frames := make([][]byte, 12)
+	for i := range frames {
+		frames[i] = states[7*(i%2)]
+	}
+
+	energy := map[uint8]int{}
+	for _, distance := range []uint8{1, 2, 3, 4} {
+		hdr := testHeader(width, height)
+		hdr.RefDistance = distance
+		energy[distance] = residualEnergy(t, hdr, frames)
+		_, got := decodeFrames(t, encodeFrames(t, hdr, frames))
+		assertFrames(t, got, frames)
+	}
+	// Going back 2 or 4 frames always lands on the same state, so after the first few frames,
+	// there's nothing left to code, and 2 gets there first.
+	for distance, e := range energy {
+		if distance != 2 && e <= energy[2] {
+			t.Errorf("residual energy at distance %d is %d, want more than the %d at distance 2", distance, e, energy[2])
+		}
+	}
+}
+
+func TestCompareOut(t *testing.T) {
+	tests := []struct {
+		width, height int
+		frame         string
+	}{
+		{32, 16, "0"},
+		{32, 16, "2"},
+		{31, 15, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%dx%d frame %s", tt.width, tt.height, tt.frame), func(t *testing.T) {
+			dir := t.TempDir()
+			mustRunCodec(t, dir, bytes.Join(testFrames(tt.width, tt.height, 3), nil),
+				"-width", strconv.Itoa(tt.width), "-height", strconv.Itoa(tt.height), "-compare-frame", tt.frame, "-compare-out", "diff.png")
+			f, err := os.Open(filepath.Join(dir, "diff.png"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			img, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The original and the decoded frame side by side, and then their difference.
+			if got, want := img.Bounds().Size(), image.Pt(3*tt.width, tt.height); got != want {
+				t.Errorf("comparison is %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFrameWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames int
+	}{
+		{"one frame", 1},
+		{"a GOP", 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const width, height = 32, 16
+			frames := testFrames(width, height, tt.frames)
+			hdr := testHeader(width, height)
+
+			var streamed bytes.Buffer
+			fw, err := NewFrameWriter(&streamed, hdr, &Stats{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, frame := range frames {
+				if err := fw.WriteFrame(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := fw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			yuvFrames := make([][]byte, len(frames))
+			for i, frame := range frames {
+				yuvFrames[i] = convertToYUV(frame, width, height, yuvOptions{})
+			}
+			batch := encodeFrames(t, hdr, yuvFrames)
+			if !bytes.Equal(streamed.Bytes(), batch) {
+				t.Error("FrameWriter and Encode wrote different videos")
+			}
+			_, got := decodeFrames(t, streamed.Bytes())
+			_, want := decodeFrames(t, batch)
+			assertFrames(t, got, want)
+		})
+	}
+}
+
+func TestMixedFrameSizes(t *testing.T) {
+	// Solid frames are 3 bytes and the others are a whole frame, so the decoder can only split
+	// them apart by the length in front of each one.
+	const width, height = 16, 8
+	hdr := testHeader(width, height)
+	gradient := testYUVFrames(width, height, 3)
+	black := solidFrame([]byte{0, 128, 128}, hdr)
+	white := solidFrame([]byte{255, 128, 128}, hdr)
+
+	type frame struct {
+		typ  FrameType
+		data []byte
+	}
+	tests := []struct {
+		name   string
+		frames []frame
+	}{
+		{"solid first", []frame{{SolidFrame, black}, {KeyFrame, gradient[0]}, {PFrame, gradient[1]}}},
+		{"solid between P-frames", []frame{{KeyFrame, gradient[0]}, {PFrame, gradient[1]}, {SolidFrame, white}, {PFrame, gradient[2]}}},
+		{"only solid", []frame{{SolidFrame, black}, {SolidFrame, white}, {PFrame, black}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inflated bytes.Buffer
+			var want [][]byte
+			for i, f := range tt.frames {
+				stored := f.data
+				switch f.typ {
+				case SolidFrame:
+					stored = []byte{f.data[0], f.data[width*height], f.data[len(f.data)-1]}
+				case PFrame:
+					stored = make([]byte, len(f.data))
+					subtract(stored, f.data, want[i-1])
+				}
+				if err := writeFrame(&inflated, f.typ, stored); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, f.data)
+			}
+			segHdr := hdr
+			segHdr.FrameCount = uint32(len(want))
+			_, got := decodeFrames(t, rawSegment(t, segHdr, inflated.Bytes()))
+			assertFrames(t, got, want)
+
+			// And the encoder, which picks the frame types for itself.
+			var stats Stats
+			data, err := Encode(context.Background(), hdr, want, &stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.SolidSize == 0 {
+				t.Error("the encoder didn't store any solid frames")
+			}
+			_, got = decodeFrames(t, data)
+			assertFrames(t, got, want)
+		})
+	}
+}
+
+func TestSkipRLEStats(t *testing.T) {
+	input := bytes.Join(testFrames(32, 16, 5), nil)
+	encoded := map[bool][]byte{}
+	for _, skip := range []bool{false, true} {
+		dir := t.TempDir()
+		_, stderr := mustRunCodec(t, dir, input, "-width", "32", "-height", "16", "-skip-rle-stats="+strconv.FormatBool(skip))
+		if got := strings.Contains(stderr, "RLE size"); got == skip {
+			t.Errorf("with -skip-rle-stats=%v, logged the RLE size: %v\n%s", skip, got, stderr)
+		}
+		encoded[skip] = readFile(t, filepath.Join(dir, "encoded.bin"))
+	}
+	if !bytes.Equal(encoded[false], encoded[true]) {
+		t.Error("-skip-rle-stats changed encoded.bin")
+	}
+}
+
+func TestDeltasMatch(t *testing.T) {
+	// The RLE stats and the encoder both take the delta of each P-frame with frameDelta. If
+	// either of them ever starts computing it some other way, the RLE size stops meaning anything.
+	const width, height = 32, 16
+	frames := testYUVFrames(width, height, 6)
+	for _, zigzag := range []bool{false, true} {
+		t.Run(fmt.Sprintf("zigzag=%v", zigzag), func(t *testing.T) {
+			hdr := testHeader(width, height)
+			hdr.ZigZag = zigzag
+			enc, err := NewEncoder(hdr, &Stats{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			deltas := map[int][]byte{}
+			enc.OnDelta = func(idx int, delta []byte) {
+				deltas[idx] = append([]byte(nil), delta...)
+			}
+			for _, frame := range frames {
+				if err := enc.WriteFrame(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := enc.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			rle := runLengthEncodeFrames(frames, rleOptions{zigzag: zigzag})
+			for i := 1; i < len(frames); i++ {
+				delta, err := runLengthDecode(rle[i], false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(delta, deltas[i]) {
+					t.Errorf("frame %d: the RLE stage and the encoder have different deltas", i)
+				}
+			}
+		})
+	}
+}
+
+func TestColorRange(t *testing.T) {
+	const width, height = 4, 2
+	tests := []struct {
+		name       string
+		colorRange uint8
+		rgb, y     byte
+	}{
+		{"full black", rangeFull, 0, 0},
+		{"full white", rangeFull, 255, 255},
+		{"limited black", rangeLimited, 0, 16},
+		{"limited white", rangeLimited, 255, 235},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := bytes.Repeat([]byte{tt.rgb}, 3*width*height)
+			hdr := testHeader(width, height)
+			hdr.Range = tt.colorRange
+			yuv := convertToYUV(frame, width, height, yuvOptions{colorRange: tt.colorRange})
+			if yuv[0] != tt.y {
+				t.Errorf("Y = %d, want %d", yuv[0], tt.y)
+			}
+
+			headers, got := decodeFrames(t, encodeFrames(t, hdr, [][]byte{yuv}))
+			if headers[0].Range != tt.colorRange {
+				t.Errorf("decoded range %d, want %d", headers[0].Range, tt.colorRange)
+			}
+			// The conversion to YUV and back isn't exact even in full range, so the limited range
+			// should come back as close to the input as the full range does.
+			fullHdr := testHeader(width, height)
+			want := convertToRGB(convertToYUV(frame, width, height, yuvOptions{}), fullHdr)
+			for j, v := range convertToRGB(got[0], headers[0]) {
+				if d := int(v) - int(want[j]); d < -1 || d > 1 {
+					t.Fatalf("byte %d is %d after the round trip, want %d", j, v, want[j])
+				}
+			}
+		})
+	}
+}
+
+func TestCrop(t *testing.T) {
+	const width, height, frameCount = 32, 16, 3
+	frames := testFrames(width, height, frameCount)
+	tests := []struct {
+		crop   string
+		region image.Rectangle
+	}{
+		{"0,0,32,16", image.Rect(0, 0, 32, 16)},
+		{"4,2,16,8", image.Rect(4, 2, 20, 10)},
+		{"16,8,16,8", image.Rect(16, 8, 32, 16)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.crop, func(t *testing.T) {
+			region, err := parseCrop(tt.crop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if region != tt.region {
+				t.Fatalf("parseCrop(%q) = %v, want %v", tt.crop, region, tt.region)
+			}
+			var want []byte
+			for _, frame := range frames {
+				cropped := cropRegion(frame, width, 3, region)
+				for y := region.Min.Y; y < region.Max.Y; y++ {
+					row := frame[3*(y*width+region.Min.X) : 3*(y*width+region.Max.X)]
+					if got := cropped[3*(y-region.Min.Y)*region.Dx():][:len(row)]; !bytes.Equal(got, row) {
+						t.Fatalf("row %d of the crop isn't row %d of the frame", y-region.Min.Y, y)
+					}
+				}
+				want = append(want, cropped...)
+			}
+
+			dir := t.TempDir()
+			mustRunCodec(t, dir, bytes.Join(frames, nil), "-width", strconv.Itoa(width), "-height", strconv.Itoa(height), "-crop", tt.crop)
+			headers, _ := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+			if got := image.Pt(int(headers[0].Width), int(headers[0].Height)); got != region.Size() {
+				t.Errorf("encoded a %v video, want %v", got, region.Size())
+			}
+			decoded := readFile(t, filepath.Join(dir, "decoded.rgb24"))
+			if len(decoded) != len(want) {
+				t.Fatalf("decoded %d bytes, want %d", len(decoded), len(want))
+			}
+			// The decoded region went through YUV420, so it's only close to the crop.
+			if p := psnr(float64(SSD(decoded, want)) / float64(len(want))); p < 30 {
+				t.Errorf("decoded region has a PSNR of %.2f dB against the crop, want at least 30", p)
+			}
+		})
+	}
+
+	for _, crop := range []string{"1,2,3", "-1,0,4,4", "0,0,0,4", "a,0,4,4"} {
+		if _, err := parseCrop(crop); err == nil {
+			t.Errorf("parseCrop(%q) succeeded, want an error", crop)
+		}
+	}
+}
+
+func TestTemporalFactor(t *testing.T) {
+	const width, height = 16, 8
+	frames := testFrames(width, height, 8)
+	tests := []struct {
+		factor, framerate string
+		frames            int
+		num, den          uint16
+	}{
+		{"1", "25", 8, 25, 1},
+		{"2", "30", 4, 15, 1},
+		{"2", "25", 4, 25, 2},
+		{"3", "24", 3, 8, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.factor+" at "+tt.framerate, func(t *testing.T) {
+			dir := t.TempDir()
+			mustRunCodec(t, dir, bytes.Join(frames, nil), "-width", "16", "-height", "8", "-framerate", tt.framerate, "-temporal-factor", tt.factor)
+			headers, got := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+			if len(got) != tt.frames {
+				t.Errorf("encoded %d frames, want %d", len(got), tt.frames)
+			}
+			if hdr := headers[0]; hdr.FramerateNum != tt.num || hdr.FramerateDen != tt.den {
+				t.Errorf("framerate is %d/%d, want %d/%d", hdr.FramerateNum, hdr.FramerateDen, tt.num, tt.den)
+			}
+		})
+	}
+}
+
+func TestDumpDeltas(t *testing.T) {
+	// A white square on black that stays put for a frame and then moves 2 pixels to the right.
+	const width, height = 32, 16
+	square := func(x0 int) []byte {
+		frame := make([]byte, 3*width*height)
+		for y := 4; y < 12; y++ {
+			for x := x0; x < x0+8; x++ {
+				copy(frame[3*(y*width+x):], []byte{255, 255, 255})
+			}
+		}
+		return frame
+	}
+	dir := t.TempDir()
+	mustRunCodec(t, dir, bytes.Join([][]byte{square(8), square(8), square(10)}, nil), "-width", "32", "-height", "16", "-dump-deltas", "deltas.yuv")
+	deltas := readFile(t, filepath.Join(dir, "deltas.yuv"))
+	frameSize := width * height * 3 / 2
+	if len(deltas) != 2*frameSize {
+		t.Fatalf("dumped %d bytes, want the deltas of 2 P-frames (%d bytes)", len(deltas), 2*frameSize)
+	}
+
+	tests := []struct {
+		name  string
+		delta []byte
+		edge  func(x, y int) bool
+	}{
+		{"static", deltas[:frameSize], func(x, y int) bool { return false }},
+		{"shifted", deltas[frameSize:], func(x, y int) bool {
+			// The square's left edge uncovers 2 columns and its right edge covers 2 more.
+			return y >= 4 && y < 12 && (x == 8 || x == 9 || x == 16 || x == 17)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					if d := tt.delta[y*width+x]; (d != 0) != tt.edge(x, y) {
+						t.Errorf("Y delta at (%d, %d) is %d", x, y, d)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestSubtract checks the trick every P-frame relies on. A delta can be anywhere from -255 to
+// 255, which doesn't fit in a byte, but we store it in one anyway and let it wrap around. That
+// works because the decoder's addition wraps around too: for any bytes a and b, (a - b) + b is a
+// again. It's easy to take for granted and easy to break, say by making subtract faster, so we
+// check it for every pair of bytes in every position of the 8 byte words subtract works on, with
+// and without zig-zag encoding.
+func TestSubtract(t *testing.T) {
+	for offset := 0; offset < 8; offset++ {
+		a := make([]byte, offset, offset+256*256)
+		b := make([]byte, offset, offset+256*256)
+		for i := 0; i < 256*256; i++ {
+			a = append(a, byte(i>>8))
+			b = append(b, byte(i))
+		}
+		for _, zigzag := range []bool{false, true} {
+			delta := frameDelta(nil, a, b, zigzag)
+			if zigzag {
+				zigzagDecode(delta)
+			}
+			add(delta, b)
+			for j := offset; j < len(a); j++ {
+				if delta[j] != a[j] {
+					t.Fatalf("offset %d, zig-zag %v: (%d - %d) + %d = %d", offset, zigzag, a[j], b[j], b[j], delta[j])
+				}
+			}
+		}
+	}
+}
+
+func TestFrameDelta(t *testing.T) {
+	// Random frames change every byte by anything from -255 to 255, which is as hard as the
+	// wraparound gets. Taking the delta of each frame against the one before it and adding them
+	// back up again should get every frame back exactly.
+	rng := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name   string
+		size   int
+		zigzag bool
+	}{
+		{"whole words", 64, false},
+		{"leftover bytes", 61, false},
+		{"zig-zag", 61, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := make([][]byte, 10)
+			for i := range frames {
+				frames[i] = make([]byte, tt.size)
+				rng.Read(frames[i])
+			}
+			var deltas [][]byte
+			for i := 1; i < len(frames); i++ {
+				deltas = append(deltas, frameDelta(nil, frames[i], frames[i-1], tt.zigzag))
+			}
+			got := append([]byte(nil), frames[0]...)
+			for i, delta := range deltas {
+				if tt.zigzag {
+					zigzagDecode(delta)
+				}
+				add(got, delta)
+				if !bytes.Equal(got, frames[i+1]) {
+					t.Fatalf("frame %d doesn't add back up from its delta", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"zeros", make([]byte, 100000)},
+		{"random", random},
+		{"frame", testYUVFrames(64, 32, 1)[0]},
+	}
+	trailer := []byte("next segment")
+	for name, id := range compressionIDs {
+		for _, level := range []int{flate.BestSpeed, flate.BestCompression} {
+			for _, in := range inputs {
+				t.Run(fmt.Sprintf("%s level %d %s", name, level, in.name), func(t *testing.T) {
+					codec := codecs[id]
+					var buf bytes.Buffer
+					w, err := codec.NewWriter(&buf, level)
+					if err != nil {
+						t.Fatal(err)
+					}
+					// Like the encoder, flush partway through, where the frame type would change.
+					half := len(in.data) / 2
+					if _, err := w.Write(in.data[:half]); err != nil {
+						t.Fatal(err)
+					}
+					if err := w.Flush(); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := w.Write(in.data[half:]); err != nil {
+						t.Fatal(err)
+					}
+					if err := w.Close(); err != nil {
+						t.Fatal(err)
+					}
+
+					// The next segment starts right after the stream, so the reader mustn't read into it.
+					stream := bytes.NewReader(append(buf.Bytes(), trailer...))
+					r, err := codec.NewReader(stream)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, err := io.ReadAll(r)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := r.Close(); err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got, in.data) {
+						t.Errorf("decompressed %d different bytes from %d", len(got), len(in.data))
+					}
+					if rest, _ := io.ReadAll(stream); !bytes.Equal(rest, trailer) {
+						t.Errorf("left %q after the stream, want %q", rest, trailer)
+					}
+				})
+			}
+		}
+
+		// Compress and Decompress are the same streams, all at once.
+		for _, in := range inputs {
+			t.Run(fmt.Sprintf("%s Compress %s", name, in.name), func(t *testing.T) {
+				codec := codecs[id]
+				compressed, err := codec.Compress(in.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := codec.Decompress(compressed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, in.data) {
+					t.Errorf("decompressed %d different bytes from %d", len(got), len(in.data))
+				}
+				r, err := codec.NewReader(bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+				if streamed, err := io.ReadAll(r); err != nil || !bytes.Equal(streamed, in.data) {
+					t.Errorf("NewReader read %d bytes and %v from what Compress wrote, want the %d bytes in", len(streamed), err, len(in.data))
+				}
+				if _, err := codec.Decompress(compressed[:len(compressed)/2]); err == nil && len(in.data) > 0 {
+					t.Error("Decompress succeeded on half of the stream")
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	frames := bytes.Join(testYUVFrames(384, 216, 4), nil)
+	for name, id := range compressionIDs {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(frames)))
+			for i := 0; i < b.N; i++ {
+				w, err := codecs[id].NewWriter(io.Discard, flate.BestSpeed)
+				if err != nil {
+					b.Fatal(err)
+				}
+				w.Write(frames)
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSADSSD(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     []byte
+		sad, ssd int
+	}{
+		{"empty", nil, nil, 0, 0},
+		{"equal", []byte{1, 2, 3, 255}, []byte{1, 2, 3, 255}, 0, 0},
+		{"maximally different", []byte{0, 255, 0, 255}, []byte{255, 0, 255, 0}, 4 * 255, 4 * 255 * 255},
+		{"either sign", []byte{10, 20}, []byte{13, 16}, 3 + 4, 9 + 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SAD(tt.a, tt.b); got != tt.sad {
+				t.Errorf("SAD = %d, want %d", got, tt.sad)
+			}
+			if got := SSD(tt.a, tt.b); got != tt.ssd {
+				t.Errorf("SSD = %d, want %d", got, tt.ssd)
+			}
+			if SAD(tt.a, tt.b) != SAD(tt.b, tt.a) || SSD(tt.a, tt.b) != SSD(tt.b, tt.a) {
+				t.Error("not symmetric")
+			}
+		})
+	}
+}
+
+func TestExtractBlock(t *testing.T) {
+	// A 6x4 plane where each byte is 10*row + column, in rows 8 bytes apart.
+	const stride = 8
+	plane := make([]byte, 4*stride)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 6; x++ {
+			plane[y*stride+x] = byte(10*y + x)
+		}
+	}
+	tests := []struct {
+		name       string
+		x, y, w, h int
+		want       []byte
+	}{
+		{"top left", 0, 0, 2, 2, []byte{0, 1, 10, 11}},
+		{"bottom right", 4, 2, 2, 2, []byte{24, 25, 34, 35}},
+		{"a whole row", 0, 3, 6, 1, []byte{30, 31, 32, 33, 34, 35}},
+		{"a column", 5, 0, 1, 4, []byte{5, 15, 25, 35}},
+		{"the whole plane", 0, 0, 6, 4, []byte{0, 1, 2, 3, 4, 5, 10, 11, 12, 13, 14, 15, 20, 21, 22, 23, 24, 25, 30, 31, 32, 33, 34, 35}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractBlock(plane, stride, tt.x, tt.y, tt.w, tt.h); !bytes.Equal(got, tt.want) {
+				t.Errorf("extractBlock(%d, %d, %d, %d) = %v, want %v", tt.x, tt.y, tt.w, tt.h, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoop(t *testing.T) {
+	const width, height = 16, 8
+	frames := testFrames(width, height, 2)
+	for _, loop := range []int{1, 3} {
+		t.Run(fmt.Sprintf("loop %d", loop), func(t *testing.T) {
+			dir := t.TempDir()
+			mustRunCodec(t, dir, bytes.Join(frames, nil), "-width", "16", "-height", "8", "-loop", strconv.Itoa(loop))
+			_, got := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+			if len(got) != len(frames)*loop {
+				t.Fatalf("encoded %d frames, want %d", len(got), len(frames)*loop)
+			}
+			// Every pass over the clip decodes to the same frames, whichever way the seam is coded.
+			for i := range got {
+				if !bytes.Equal(got[i], got[i%len(frames)]) {
+					t.Errorf("frame %d doesn't match frame %d", i, i%len(frames))
+				}
+			}
+			decoded := readFile(t, filepath.Join(dir, "decoded.rgb24"))
+			want := bytes.Repeat(bytes.Join(frames, nil), loop)
+			if len(decoded) != len(want) {
+				t.Fatalf("decoded %d bytes, want %d", len(decoded), len(want))
+			}
+			if p := psnr(float64(SSD(decoded, want)) / float64(len(want))); p < 30 {
+				t.Errorf("PSNR is %.2f dB, want at least 30", p)
+			}
+		})
+	}
+}
+
+func TestSolidFrame(t *testing.T) {
+	const width, height = 64, 32
+	hdr := testHeader(width, height)
+	gray := solidFrame([]byte{128, 128, 128}, hdr)
+	speck := append([]byte(nil), gray...)
+	speck[width*height/2] = 129
+	tests := []struct {
+		name  string
+		frame []byte
+		typ   FrameType
+	}{
+		{"gray", gray, SolidFrame},
+		{"black", solidFrame([]byte{0, 128, 128}, hdr), SolidFrame},
+		{"a colored background", solidFrame([]byte{81, 90, 240}, hdr), SolidFrame},
+		{"one pixel off", speck, KeyFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stats Stats
+			enc, err := NewEncoder(hdr, &stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := enc.WriteFrame(tt.frame); err != nil {
+				t.Fatal(err)
+			}
+			data, err := enc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if types := enc.FrameTypes(); len(types) != 1 || types[0] != tt.typ {
+				t.Errorf("stored as %v, want %v", types, []FrameType{tt.typ})
+			}
+			if tt.typ == SolidFrame {
+				// The header, the 3 byte color, and a little bit of framing.
+				if limit := binary.Size(header{}) + 32; len(data) > limit {
+					t.Errorf("encoded to %d bytes, want at most %d", len(data), limit)
+				}
+			}
+			_, got := decodeFrames(t, data)
+			assertFrames(t, got, [][]byte{tt.frame})
+		})
+	}
+}
+
+func TestLumaQuant(t *testing.T) {
+	// Y runs through every value 4 times over.
+	const width, height = 64, 16
+	frame := testYUVFrames(width, height, 1)[0]
+	for j := 0; j < width*height; j++ {
+		frame[j] = byte(j)
+	}
+	for _, step := range []int{1, 2, 4, 8, 16, 64} {
+		t.Run(fmt.Sprintf("step %d", step), func(t *testing.T) {
+			hdr := testHeader(width, height)
+			hdr.LumaStep = uint8(step)
+			_, got := decodeFrames(t, encodeFrames(t, hdr, [][]byte{frame}))
+			distinct := map[byte]bool{}
+			for j, y := range got[0][:width*height] {
+				distinct[y] = true
+				if d := int(y) - int(frame[j]); d < -step/2 || d > step/2 {
+					t.Fatalf("Y %d decoded to %d, more than half a step off", frame[j], y)
+				}
+			}
+			// Rounding to the nearest step can add one more value at the top.
+			if n, want := len(distinct), 256/step; n < want || n > want+1 {
+				t.Errorf("%d distinct Y values, want about %d", n, want)
+			}
+			if !bytes.Equal(got[0][width*height:], frame[width*height:]) {
+				t.Error("U or V changed")
+			}
+		})
+	}
+}
+
+func TestLumaOnly(t *testing.T) {
+	const width, height = 32, 16
+	frames := testYUVFrames(width, height, 5)
+	tests := []struct {
+		name string
+		edit func(*header)
+	}{
+		{"plain", func(*header) {}},
+		{"median predictor", func(hdr *header) { hdr.Predictor = predictorMedian }},
+		{"zig-zag", func(hdr *header) { hdr.ZigZag = true }},
+		{"block skip", func(hdr *header) { hdr.BlockSkip = true }},
+		{"alpha", func(hdr *header) { hdr.Alpha = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := testHeader(width, height)
+			tt.edit(&hdr)
+			input := frames
+			if hdr.Alpha {
+				input = make([][]byte, len(frames))
+				for i, frame := range frames {
+					input[i] = append(append([]byte(nil), frame...), bytes.Repeat([]byte{200}, width*height)...)
+				}
+			}
+			data := encodeFrames(t, hdr, input)
+			_, full := decodeFrames(t, data)
+			_, luma, err := decodeAll(context.Background(), data, decodeOptions{lumaOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(luma) != len(full) {
+				t.Fatalf("decoded %d frames of luma, want %d", len(luma), len(full))
+			}
+			for i := range luma {
+				if !bytes.Equal(luma[i], full[i][:width*height]) {
+					t.Errorf("frame %d: luma doesn't match the Y plane of the full decode", i)
+				}
+			}
+		})
+	}
+
+	// From the command line, it writes the Y planes to decoded.gray.
+	dir := t.TempDir()
+	mustRunCodec(t, dir, bytes.Join(testFrames(width, height, 3), nil), "-width", "32", "-height", "16")
+	_, full := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+	mustRunCodec(t, dir, bytes.Join(testFrames(width, height, 3), nil), "-width", "32", "-height", "16", "-luma-only")
+	var want []byte
+	for _, frame := range full {
+		want = append(want, frame[:width*height]...)
+	}
+	if got := readFile(t, filepath.Join(dir, "decoded.gray")); !bytes.Equal(got, want) {
+		t.Errorf("decoded.gray is %d bytes that don't match the %d bytes of Y planes", len(got), len(want))
+	}
+}
+
+func TestAdaptiveSceneCut(t *testing.T) {
+	// A noisy scene that holds still for 3 frames, then a cut to a smooth gradient that slides.
+	// Across the cut, the delta is as noisy as the first scene, but the gradient on its own is
+	// cheap, so that's the frame to store whole.
+	const width, height = 64, 32
+	noise := make([]byte, width*height*3/2)
+	rand.New(rand.NewSource(1)).Read(noise)
+	frames := [][]byte{noise, noise, noise}
+	frames = append(frames, testYUVFrames(width, height, 3)...)
+
+	tests := []struct {
+		adaptive bool
+		want     []FrameType
+	}{
+		{false, []FrameType{KeyFrame, PFrame, PFrame, PFrame, PFrame, PFrame}},
+		{true, []FrameType{KeyFrame, PFrame, PFrame, KeyFrame, PFrame, PFrame}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("adaptive=%v", tt.adaptive), func(t *testing.T) {
+			enc, err := NewEncoder(testHeader(width, height), &Stats{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			enc.Adaptive = tt.adaptive
+			for _, frame := range frames {
+				if err := enc.WriteFrame(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := enc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := enc.FrameTypes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("frame types %v, want %v", got, tt.want)
+			}
+			_, got := decodeFrames(t, data)
+			assertFrames(t, got, frames)
+		})
+	}
+}
+
+func TestDecoderNext(t *testing.T) {
+	tests := []struct {
+		width, height int
+		args          []string
+	}{
+		{32, 16, nil},
+		{31, 15, nil},
+		{32, 16, []string{"-keyframe-interval", "2"}},
+		{32, 16, []string{"-alpha"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%dx%d %s", tt.width, tt.height, strings.Join(tt.args, " ")), func(t *testing.T) {
+			bytesPerPixel, decodedName := 3, "decoded.rgb24"
+			if len(tt.args) > 0 && tt.args[0] == "-alpha" {
+				bytesPerPixel, decodedName = 4, "decoded.rgba"
+			}
+			input := make([]byte, 5*tt.width*tt.height*bytesPerPixel)
+			for j := range input {
+				input[j] = byte(j / bytesPerPixel / 3)
+			}
+			dir := t.TempDir()
+			mustRunCodec(t, dir, input, append([]string{"-width", strconv.Itoa(tt.width), "-height", strconv.Itoa(tt.height)}, tt.args...)...)
+
+			d, err := NewDecoder(context.Background(), readFile(t, filepath.Join(dir, "encoded.bin")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []byte
+			for {
+				frame, err := d.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, frame...)
+			}
+			// decoded.rgb24 comes from decoding the whole video at once.
+			if want := readFile(t, filepath.Join(dir, decodedName)); !bytes.Equal(got, want) {
+				t.Errorf("Next returned %d bytes that don't match the %d bytes of the batch decode", len(got), len(want))
+			}
+		})
+	}
+}
+
+// floatToRGB converts a pixel from YUV to RGB the slow way, with floats, for checking the
+// tables in rgbTables against.
+func floatToRGB(y, u, v byte, colorRange uint8) (r, g, b byte) {
+	fy, fu, fv := float64(y), float64(u)-128, float64(v)-128
+	if colorRange == rangeLimited {
+		fy = (fy - 16) * 255 / 219
+		fu, fv = fu*255/224, fv*255/224
+	}
+	toByte := func(x float64) byte {
+		return byte(clamp(math.Floor(x), 0, 255))
+	}
+	return toByte(fy + 1.402*fv), toByte(fy - 0.344*fu - 0.714*fv), toByte(fy + 1.772*fu)
+}
+
+// convertToRGBFloat is convertToRGB for a planar YUV420 frame, with floatToRGB.
+func convertToRGBFloat(frame []byte, width, height int) []byte {
+	rgb := make([]byte, 0, width*height*3)
+	U, V := frame[width*height:], frame[width*height*5/4:]
+	for j := 0; j < height; j++ {
+		for k := 0; k < width; k++ {
+			c := j/2*(width/2) + k/2
+			r, g, b := floatToRGB(frame[j*width+k], U[c], V[c], rangeFull)
+			rgb = append(rgb, r, g, b)
+		}
+	}
+	return rgb
+}
+
+func TestRGBTables(t *testing.T) {
+	for _, colorRange := range []uint8{rangeFull, rangeLimited} {
+		t.Run(fmt.Sprintf("range %d", colorRange), func(t *testing.T) {
+			tbl := &rgbTables[colorRange]
+			off := 0
+			for y := 0; y < 256; y++ {
+				for u := 0; u < 256; u++ {
+					for v := 0; v < 256; v++ {
+						r, g, b := floatToRGB(byte(y), byte(u), byte(v), colorRange)
+						got := [3]byte{
+							fixedToByte(tbl.y[y] + tbl.rv[v]),
+							fixedToByte(tbl.y[y] + tbl.gu[u] + tbl.gv[v]),
+							fixedToByte(tbl.y[y] + tbl.bu[u]),
+						}
+						for c, want := range [3]byte{r, g, b} {
+							if d := int(got[c]) - int(want); d < -1 || d > 1 {
+								t.Fatalf("YUV %d, %d, %d: channel %d is %d, want %d", y, u, v, c, got[c], want)
+							} else if d != 0 {
+								off++
+							}
+						}
+					}
+				}
+			}
+			// Only values that land within a rounding error of a whole number should be off.
+			if total := 3 * 256 * 256 * 256; off > total/1000 {
+				t.Errorf("%d of %d channels are one off, want at most %d", off, total, total/1000)
+			}
+		})
+	}
+
+	// And through convertToRGB.
+	const width, height = 32, 16
+	frame := testYUVFrames(width, height, 1)[0]
+	got, want := convertToRGB(frame, testHeader(width, height)), convertToRGBFloat(frame, width, height)
+	for j := range got {
+		if d := int(got[j]) - int(want[j]); d < -1 || d > 1 {
+			t.Fatalf("byte %d is %d, want %d", j, got[j], want[j])
+		}
+	}
+}
+
+func BenchmarkConvertToRGB(b *testing.B) {
+	const width, height = 384, 216
+	frame := testYUVFrames(width, height, 1)[0]
+	hdr := testHeader(width, height)
+	b.Run("tables", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			convertToRGB(frame, hdr)
+		}
+	})
+	b.Run("floats", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			convertToRGBFloat(frame, width, height)
+		}
+	})
+}
+
+func TestHugeFrameCount(t *testing.T) {
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 2)
+	tests := []struct {
+		name       string
+		frameCount uint32
+		stored     bool
+	}{
+		{"a million frames", 1 << 20, false},
+		{"the most a header can claim", math.MaxUint32, false},
+		{"stored", 1000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := testHeader(width, height)
+			hdr.FrameCount = tt.frameCount
+			var data []byte
+			if tt.stored {
+				hdr.Stored = true
+				hdr.Version = formatVersion
+				var buf bytes.Buffer
+				if err := binary.Write(&buf, binary.BigEndian, hdr); err != nil {
+					t.Fatal(err)
+				}
+				data = append(buf.Bytes(), bytes.Join(frames, nil)...)
+			} else {
+				data = rawSegment(t, hdr, storedFrames(t, frames))
+			}
+			_, _, err := Decode(context.Background(), data)
+			if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "can't fit") {
+				t.Errorf("Decode returned %v, want an ErrCorrupt saying the frames can't fit", err)
+			}
+			if _, err := NewDecoder(context.Background(), data); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("NewDecoder returned %v, want ErrCorrupt", err)
+			}
+		})
+	}
+}
+
+func TestPSNRCSV(t *testing.T) {
+	tests := []struct {
+		frames int
+		args   []string
+		types  []string
+	}{
+		{1, nil, []string{"key"}},
+		{4, nil, []string{"key", "P", "P", "P"}},
+		{4, []string{"-keyframe-interval", "2"}, []string{"key", "P", "key", "P"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d frames %s", tt.frames, strings.Join(tt.args, " ")), func(t *testing.T) {
+			dir := t.TempDir()
+			mustRunCodec(t, dir, bytes.Join(testFrames(32, 16, tt.frames), nil), append([]string{"-width", "32", "-height", "16", "-psnr-csv", "psnr.csv"}, tt.args...)...)
+			f, err := os.Open(filepath.Join(dir, "psnr.csv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			records, err := csv.NewReader(f).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"frame_index", "frame_type", "psnr", "ssim"}; !reflect.DeepEqual(records[0], want) {
+				t.Errorf("header is %v, want %v", records[0], want)
+			}
+			rows := records[1:]
+			if len(rows) != tt.frames {
+				t.Fatalf("%d rows, want one for each of the %d frames", len(rows), tt.frames)
+			}
+			for i, row := range rows {
+				if row[0] != strconv.Itoa(i) || row[1] != tt.types[i] {
+					t.Errorf("row %d is frame %s of type %s, want frame %d of type %s", i, row[0], row[1], i, tt.types[i])
+				}
+				if p, err := strconv.ParseFloat(row[2], 64); err != nil || math.IsNaN(p) || p < 25 {
+					t.Errorf("row %d has PSNR %q, want a number of at least 25", i, row[2])
+				}
+				if s, err := strconv.ParseFloat(row[3], 64); err != nil || s < 0.9 || s > 1 {
+					t.Errorf("row %d has SSIM %q, want a number between 0.9 and 1", i, row[3])
+				}
+			}
+		})
+	}
+}
+
+func TestRunLength(t *testing.T) {
+	modes := []struct {
+		name   string
+		encode func([]byte) []byte
+		decode func([]byte) ([]byte, error)
+	}{
+		{"plain", func(data []byte) []byte { return runLengthEncode(data, false) }, func(rle []byte) ([]byte, error) { return runLengthDecode(rle, false) }},
+		{"varint", func(data []byte) []byte { return runLengthEncode(data, true) }, func(rle []byte) ([]byte, error) { return runLengthDecode(rle, true) }},
+		{"escaped", runLengthEncodeEscaped, runLengthDecodeEscaped},
+	}
+
+	// A static frame, a run just either side of every count that takes another byte or another
+	// control byte, and values that never repeat.
+	inputs := map[string][]byte{"empty": nil, "static": make([]byte, 100000)}
+	for _, n := range []int{2, 3, 127, 128, 129, 130, 131, 255, 256, 16383, 16384} {
+		inputs[fmt.Sprintf("run of %d", n)] = append(bytes.Repeat([]byte{7}, n), 1)
+	}
+	noise := make([]byte, 1000)
+	for i := range noise {
+		noise[i] = byte(i * 131)
+	}
+	inputs["noise"] = noise
+
+	for _, mode := range modes {
+		for name, data := range inputs {
+			t.Run(mode.name+" "+name, func(t *testing.T) {
+				got, err := mode.decode(mode.encode(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("%d bytes decoded to %d different bytes", len(data), len(got))
+				}
+			})
+		}
+	}
+
+	// With varint, a static frame is a single count and value.
+	if n := len(runLengthEncode(inputs["static"], true)); n > 4 {
+		t.Errorf("varint encoded a static frame in %d bytes, want at most 4", n)
+	}
+
+	corrupt := []struct {
+		name string
+		mode int
+		rle  []byte
+	}{
+		{"plain count without a value", 0, []byte{3}},
+		{"plain zero count", 0, []byte{0, 1}},
+		{"varint unfinished count", 1, []byte{0x80}},
+		{"escaped repeat without a value", 2, []byte{130}},
+		{"escaped literals cut short", 2, []byte{3, 1, 2}},
+	}
+	for _, tt := range corrupt {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := modes[tt.mode].decode(tt.rle); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("decoding %v returned %v, want ErrCorrupt", tt.rle, err)
+			}
+		})
+	}
+}
+
+func TestPixelAspect(t *testing.T) {
+	// Through the header on its own.
+	hdr := testHeader(16, 8)
+	hdr.ParNum, hdr.ParDen = 40, 33
+	headers, _ := decodeFrames(t, encodeFrames(t, hdr, testYUVFrames(16, 8, 1)))
+	if got := headers[0]; got.ParNum != 40 || got.ParDen != 33 {
+		t.Errorf("pixel aspect ratio is %d:%d after the round trip, want 40:33", got.ParNum, got.ParDen)
+	}
+
+	// And from the command line.
+	tests := []struct {
+		name     string
+		meta     string
+		args     []string
+		num, den uint16
+	}{
+		{"default", "", nil, 1, 1},
+		{"flag", "", []string{"-par", "10:11"}, 10, 11},
+		{"sidecar", "par=40:33\n", nil, 40, 33},
+		{"flag over sidecar", "par=40:33\n", []string{"-par", "10:11"}, 10, 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "video.rgb24"), bytes.Join(testFrames(16, 8, 2), nil), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.meta != "" {
+				if err := os.WriteFile(filepath.Join(dir, "video.rgb24.meta"), []byte(tt.meta), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mustRunCodec(t, dir, nil, append([]string{"-input", "video.rgb24", "-width", "16", "-height", "8"}, tt.args...)...)
+			headers, _ := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+			if got := headers[0]; got.ParNum != tt.num || got.ParDen != tt.den {
+				t.Errorf("pixel aspect ratio is %d:%d, want %d:%d", got.ParNum, got.ParDen, tt.num, tt.den)
+			}
+		})
+	}
+}
+
+// writePNGs writes rgb24 frames to dir as 000.png, 001.png and so on.
+func writePNGs(t testing.TB, dir string, frames [][]byte, width, height int) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, rgbImage(frame, width, height, 3)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%03d.png", i)), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInputGlob(t *testing.T) {
+	tests := []struct {
+		width, height, frames int
+	}{
+		{32, 16, 1},
+		{32, 16, 4},
+		{31, 15, 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d frames of %dx%d", tt.frames, tt.width, tt.height), func(t *testing.T) {
+			dir := t.TempDir()
+			frames := testFrames(tt.width, tt.height, tt.frames)
+			writePNGs(t, filepath.Join(dir, "frames"), frames, tt.width, tt.height)
+			// The size comes from the images, not the flags.
+			mustRunCodec(t, dir, nil, "-input-glob", "frames/*.png")
+			decoded := readFile(t, filepath.Join(dir, "decoded.rgb24"))
+			want := bytes.Join(frames, nil)
+			if len(decoded) != len(want) {
+				t.Fatalf("decoded %d bytes, want %d", len(decoded), len(want))
+			}
+			if p := psnr(float64(SSD(decoded, want)) / float64(len(want))); p < 30 {
+				t.Errorf("PSNR is %.2f dB, want at least 30", p)
+			}
+		})
+	}
+
+	t.Run("different sizes", func(t *testing.T) {
+		dir := t.TempDir()
+		writePNGs(t, filepath.Join(dir, "frames"), testFrames(32, 16, 1), 32, 16)
+		writePNGs(t, filepath.Join(dir, "frames", "more"), testFrames(16, 8, 1), 16, 8)
+		if err := os.Rename(filepath.Join(dir, "frames", "more", "000.png"), filepath.Join(dir, "frames", "001.png")); err != nil {
+			t.Fatal(err)
+		}
+		if _, stderr, err := runCodec(t, dir, nil, "-input-glob", "frames/*.png"); err == nil {
+			t.Errorf("encoded frames of different sizes:\n%s", stderr)
+		}
+	})
+}
+
+func TestOutputGlob(t *testing.T) {
+	tests := []struct {
+		width, height, frames int
+	}{
+		{32, 16, 1},
+		{32, 16, 4},
+		{31, 15, 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d frames of %dx%d", tt.frames, tt.width, tt.height), func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "out"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			mustRunCodec(t, dir, bytes.Join(testFrames(tt.width, tt.height, tt.frames), nil),
+				"-width", strconv.Itoa(tt.width), "-height", strconv.Itoa(tt.height), "-output-glob", "out/frame_%04d.png")
+			names, err := filepath.Glob(filepath.Join(dir, "out", "*.png"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != tt.frames {
+				t.Fatalf("wrote %d PNGs, want %d", len(names), tt.frames)
+			}
+
+			decoded := readFile(t, filepath.Join(dir, "decoded.rgb24"))
+			frameSize := 3 * tt.width * tt.height
+			for i := 0; i < tt.frames; i++ {
+				f, err := os.Open(filepath.Join(dir, "out", fmt.Sprintf("frame_%04d.png", i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				img, err := png.Decode(f)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := img.Bounds().Size(), image.Pt(tt.width, tt.height); got != want {
+					t.Fatalf("frame %d is %v, want %v", i, got, want)
+				}
+				want := decoded[i*frameSize : (i+1)*frameSize]
+				for y := 0; y < tt.height; y++ {
+					for x := 0; x < tt.width; x++ {
+						r, g, b, _ := img.At(x, y).RGBA()
+						p := want[3*(y*tt.width+x):]
+						if byte(r>>8) != p[0] || byte(g>>8) != p[1] || byte(b>>8) != p[2] {
+							t.Fatalf("frame %d, pixel (%d, %d) is %d, %d, %d in the PNG and %v in decoded.rgb24", i, x, y, r>>8, g>>8, b>>8, p[:3])
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// convertToYUVFloat is convertToYUV for rgb24 and YUV420 the way it used to be done, with the U
+// and V of every pixel in full-size float64 planes that are then averaged down.
+func convertToYUVFloat(frame []byte, width, height int) []byte {
+	Y := make([]byte, width*height)
+	U := make([]float64, width*height)
+	V := make([]float64, width*height)
+	for j := 0; j < width*height; j++ {
+		r, g, b := float64(frame[3*j]), float64(frame[3*j+1]), float64(frame[3*j+2])
+		Y[j] = uint8(+0.299*r + 0.587*g + 0.114*b)
+		U[j], V[j] = chroma(r, g, b)
+	}
+	u := make([]byte, 0, width*height/4)
+	v := make([]byte, 0, width*height/4)
+	for x := 0; x < height; x += 2 {
+		for y := 0; y < width; y += 2 {
+			var su, sv float64
+			for _, j := range []int{x*width + y, x*width + y + 1, (x+1)*width + y, (x+1)*width + y + 1} {
+				su += U[j]
+				sv += V[j]
+			}
+			u = append(u, uint8(math.Round(su/4)))
+			v = append(v, uint8(math.Round(sv/4)))
+		}
+	}
+	return append(append(Y, u...), v...)
+}
+
+func TestConvertToYUVFloat(t *testing.T) {
+	random := make([]byte, 3*32*16)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"gradient", testFrames(32, 16, 1)[0]},
+		{"random", random},
+		{"black", make([]byte, 3*32*16)},
+		{"white", bytes.Repeat([]byte{255}, 3*32*16)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Equal(convertToYUV(tt.frame, 32, 16, yuvOptions{}), convertToYUVFloat(tt.frame, 32, 16)) {
+				t.Error("convertToYUV doesn't match the full-size float64 planes")
+			}
+		})
+	}
+}
+
+func BenchmarkConvertToYUV(b *testing.B) {
+	const width, height = 384, 216
+	frame := testFrames(width, height, 1)[0]
+	b.Run("on the fly", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			convertToYUV(frame, width, height, yuvOptions{})
+		}
+	})
+	b.Run("float64 planes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			convertToYUVFloat(frame, width, height)
+		}
+	})
+}
+
+func TestTolerant(t *testing.T) {
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 4)
+	hdr := testHeader(width, height)
+	hdr.FrameCount = uint32(len(frames))
+	data := rawSegment(t, hdr, storedFrames(t, frames))
+	frameSize := len(frames[0])
+	last := rawSegmentOffset + 3*(1+4+frameSize+4)
+
+	tests := []struct {
+		name string
+		cut  int
+	}{
+		{"in the length", last + 2},
+		{"in the frame", last + 1 + 4 + frameSize/2},
+		{"in the checksum", last + 1 + 4 + frameSize + 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			truncated := data[:tt.cut]
+			if _, _, err := Decode(context.Background(), truncated); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Decode returned %v, want ErrCorrupt", err)
+			}
+
+			var logs bytes.Buffer
+			_, got, err := decodeAll(context.Background(), truncated, decodeOptions{tolerant: true, logger: log.New(&logs, "", 0)})
+			if err != nil {
+				t.Fatalf("decodeAll with tolerant: %v", err)
+			}
+			assertFrames(t, got, frames[:3])
+			if logs.Len() == 0 {
+				t.Error("didn't warn about the cut-off frame")
+			}
+		})
+	}
+}
+
+func TestSkipCorruptKeyframe(t *testing.T) {
+	// Keyframes at frames 0, 3 and 6.
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 8)
+	hdr := testHeader(width, height)
+	hdr.FrameCount = uint32(len(frames))
+	var inflated bytes.Buffer
+	for i, frame := range frames {
+		typ, stored := KeyFrame, frame
+		if i%3 != 0 {
+			typ, stored = PFrame, make([]byte, len(frame))
+			subtract(stored, frame, frames[i-1])
+		}
+		if err := writeFrame(&inflated, typ, stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frameSize := len(frames[0])
+
+	tests := []struct {
+		corrupt int
+		// shown is the frame that's shown for each frame.
+		shown []int
+	}{
+		{1, []int{0, 0, 0, 3, 4, 5, 6, 7}},
+		{4, []int{0, 1, 2, 3, 3, 3, 6, 7}},
+		// A corrupt keyframe takes its GOP with it.
+		{3, []int{0, 1, 2, 2, 2, 2, 6, 7}},
+		// With no keyframe after it, the rest of the video is the last good frame.
+		{7, []int{0, 1, 2, 3, 4, 5, 6, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("frame %d", tt.corrupt), func(t *testing.T) {
+			data := rawSegment(t, hdr, inflated.Bytes())
+			data[rawSegmentOffset+tt.corrupt*(1+4+frameSize+4)+1+4+frameSize/2] ^= 0xff
+
+			var logs bytes.Buffer
+			_, got, err := decodeAll(context.Background(), data, decodeOptions{skipCorrupt: true, logger: log.New(&logs, "", 0)})
+			if err != nil {
+				t.Fatalf("decodeAll with skipCorrupt: %v", err)
+			}
+			if next := tt.corrupt + 1; next < len(frames) && next%3 != 0 && !strings.Contains(logs.String(), fmt.Sprintf("Frames %d to", next)) {
+				t.Errorf("logged %q, want the frames after %d to be skipped", logs.String(), tt.corrupt)
+			}
+			want := make([][]byte, len(tt.shown))
+			for i, j := range tt.shown {
+				want[i] = frames[j]
+			}
+			assertFrames(t, got, want)
+		})
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	// The second frame changes a 4x4 patch of Y that falls inside a single block at every size.
+	const width, height = 96, 64
+	first := testYUVFrames(width, height, 1)[0]
+	second := append([]byte(nil), first...)
+	for y := 4; y < 8; y++ {
+		for x := 20; x < 24; x++ {
+			second[y*width+x] += 50
+		}
+	}
+	moving := testYUVFrames(width, height, 5)
+
+	for _, size := range []int{8, 16, 32} {
+		t.Run(fmt.Sprintf("%dx%d", size, size), func(t *testing.T) {
+			hdr := testHeader(width, height)
+			hdr.BlockSkip = true
+			hdr.BlockSize = uint8(size)
+			var stats Stats
+			data, err := Encode(context.Background(), hdr, [][]byte{first, second}, &stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blocks := (width / size) * (height / size); stats.Blocks != blocks || stats.SkippedBlocks != blocks-1 {
+				t.Errorf("skipped %d of %d blocks, want %d of %d", stats.SkippedBlocks, stats.Blocks, blocks-1, blocks)
+			}
+			headers, got := decodeFrames(t, data)
+			assertFrames(t, got, [][]byte{first, second})
+			if headers[0].BlockSize != uint8(size) {
+				t.Errorf("BlockSize is %d after the round trip, want %d", headers[0].BlockSize, size)
+			}
+
+			// And where every block changes.
+			_, got = decodeFrames(t, encodeFrames(t, hdr, moving))
+			assertFrames(t, got, moving)
+		})
+	}
+}
+
+func TestGzipYUV(t *testing.T) {
+	input := bytes.Join(testFrames(32, 16, 3), nil)
+	dir := t.TempDir()
+	mustRunCodec(t, dir, input, "-width", "32", "-height", "16")
+	want := readFile(t, filepath.Join(dir, "encoded.yuv"))
+	if len(want) != 3*32*16*3/2 {
+		t.Fatalf("encoded.yuv is %d bytes, want 3 planar YUV420 frames", len(want))
+	}
+
+	gzDir := t.TempDir()
+	mustRunCodec(t, gzDir, input, "-width", "32", "-height", "16", "-gzip-yuv")
+	if _, err := os.Stat(filepath.Join(gzDir, "encoded.yuv")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("wrote encoded.yuv as well as encoded.yuv.gz: %v", err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(readFile(t, filepath.Join(gzDir, "encoded.yuv.gz"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("encoded.yuv.gz decompresses to %d bytes that don't match the %d bytes of encoded.yuv", len(got), len(want))
+	}
+}
+
+func TestAutoLevel(t *testing.T) {
+	tests := []struct {
+		name string
+		// size is the size at each level.
+		size func(level int) int
+		// want is the level it has to pick, or 0 for any of them.
+		want int
+	}{
+		{"only the slowest is small enough", func(level int) int { return 1000 - 10*level }, flate.BestCompression},
+		{"only one is small enough", func(level int) int {
+			if level == 4 {
+				return 500
+			}
+			return 1000
+		}, 4},
+		{"all the same", func(int) int { return 1000 }, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tried []int
+			level, err := autoLevel(func(level int) (int, error) {
+				tried = append(tried, level)
+				return tt.size(level), nil
+			}, 0.01, t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tried) != flate.BestCompression-flate.BestSpeed+1 {
+				t.Errorf("tried levels %v, want every level", tried)
+			}
+			if level < flate.BestSpeed || level > flate.BestCompression || tt.want != 0 && level != tt.want {
+				t.Errorf("picked level %d, want %d", level, tt.want)
+			}
+		})
+	}
+
+	if _, err := autoLevel(func(level int) (int, error) { return 0, errFailingWriter }, 0.01, t.Logf); !errors.Is(err, errFailingWriter) {
+		t.Errorf("autoLevel returned %v, want the error from encode", err)
+	}
+
+	// From the command line, it logs the level it picked, and the video still decodes.
+	input := bytes.Join(testFrames(32, 16, 5), nil)
+	dir := t.TempDir()
+	_, stderr := mustRunCodec(t, dir, input, "-width", "32", "-height", "16", "-auto-level")
+	var level, frames int
+	i := strings.Index(stderr, "Auto level: using level ")
+	if i < 0 {
+		t.Fatalf("didn't log the level it picked:\n%s", stderr)
+	}
+	if _, err := fmt.Sscanf(stderr[i:], "Auto level: using level %d, measured on the first %d frames", &level, &frames); err != nil {
+		t.Fatal(err)
+	}
+	if level < flate.BestSpeed || level > flate.BestCompression {
+		t.Errorf("picked level %d", level)
+	}
+	// The level only changes how hard DEFLATE tries, so the frames come out the same as ever.
+	defaultDir := t.TempDir()
+	mustRunCodec(t, defaultDir, input, "-width", "32", "-height", "16")
+	_, got := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+	_, want := decodeFrames(t, readFile(t, filepath.Join(defaultDir, "encoded.bin")))
+	assertFrames(t, got, want)
+}
+
+func TestInterlaced(t *testing.T) {
+	// A bar sliding right, caught by an interlaced camera: the bottom field is captured half a
+	// frame after the top one, so on the odd rows, the bar has already moved 2 pixels further.
+	const width, height = 64, 16
+	frames := make([][]byte, 8)
+	for i := range frames {
+		frame := make([]byte, width*height*3/2)
+		for j := range frame {
+			frame[j] = 128
+		}
+		for y := 0; y < height; y++ {
+			x0 := 4*i + 2*(y%2)
+			for x := 0; x < width; x++ {
+				frame[y*width+x] = 50
+				if x >= x0 && x < x0+8 {
+					frame[y*width+x] = 150
+				}
+			}
+		}
+		frames[i] = frame
+	}
+
+	progressive := testHeader(width, height)
+	interlaced := testHeader(width, height)
+	interlaced.Interlaced = true
+	frameEnergy, fieldEnergy := residualEnergy(t, progressive, frames), residualEnergy(t, interlaced, frames)
+	if fieldEnergy >= frameEnergy {
+		t.Errorf("residual energy is %d coding fields, want less than the %d coding frames", fieldEnergy, frameEnergy)
+	}
+
+	headers, got := decodeFrames(t, encodeFrames(t, interlaced, frames))
+	assertFrames(t, got, frames)
+	if !headers[0].Interlaced || headers[0].Height != height {
+		t.Errorf("decoded a %dx%d video with Interlaced %v, want %dx%d with Interlaced set", headers[0].Width, headers[0].Height, headers[0].Interlaced, width, height)
+	}
+}
+
+func TestNV12(t *testing.T) {
+	// A 4x2 frame has 2 U and 2 V samples.
+	frame := []byte{
+		0, 1, 2, 3,
+		4, 5, 6, 7,
+		10, 11, // U
+		20, 21, // V
+	}
+	want := []byte{
+		0, 1, 2, 3,
+		4, 5, 6, 7,
+		10, 20, 11, 21, // U and V, interleaved
+	}
+	nv12 := packNV12(frame, 4, 2)
+	if !bytes.Equal(nv12, want) {
+		t.Errorf("packNV12 = %v, want %v", nv12, want)
+	}
+	if got := unpackNV12(nv12, 4, 2); !bytes.Equal(got, frame) {
+		t.Errorf("unpackNV12 = %v, want %v", got, frame)
+	}
+
+	// Through the encoder, with the layout in the header.
+	const width, height = 32, 16
+	frames := testYUVFrames(width, height, 4)
+	packed := make([][]byte, len(frames))
+	for i, frame := range frames {
+		packed[i] = packFrame(frame, layoutNV12, width, height)
+	}
+	hdr := testHeader(width, height)
+	hdr.Layout = layoutNV12
+	headers, got := decodeFrames(t, encodeFrames(t, hdr, packed))
+	if headers[0].Layout != layoutNV12 {
+		t.Errorf("decoded layout %d, want NV12", headers[0].Layout)
+	}
+	assertFrames(t, got, packed)
+	for i := range got {
+		if !bytes.Equal(unpackFrame(got[i], headers[0]), frames[i]) {
+			t.Errorf("frame %d doesn't unpack to the planar frame", i)
+		}
+	}
+
+	// The layout only moves the chroma samples around, so the decoded video is the same.
+	decoded := map[string][]byte{}
+	for _, layout := range []string{"planar", "nv12"} {
+		dir := t.TempDir()
+		mustRunCodec(t, dir, bytes.Join(testFrames(width, height, 3), nil), "-width", "32", "-height", "16", "-yuv-layout", layout)
+		decoded[layout] = readFile(t, filepath.Join(dir, "decoded.rgb24"))
+	}
+	if !bytes.Equal(decoded["planar"], decoded["nv12"]) {
+		t.Error("-yuv-layout nv12 decoded to a different video than planar")
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	const limit = 256 << 20
+	tests := []struct {
+		name          string
+		width, height int
+		err           string
+	}{
+		{"the default video", 384, 216, ""},
+		{"4K", 3840, 2160, ""},
+		{"an extra zero", 38400, 21600, "more than the limit of 256 MiB"},
+		{"overflows an int", math.MaxInt32, math.MaxInt32, "more than the limit of 256 MiB"},
+		{"zero width", 0, 216, "must be positive"},
+		{"negative height", 384, -216, "must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkFrameSize(tt.width, tt.height, 3, limit)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("checkFrameSize(%d, %d) = %v, want an error containing %q", tt.width, tt.height, err, tt.err)
+			}
+		})
+	}
+
+	if err := checkFrameSize(38400, 21600, 3, 0); err != nil {
+		t.Errorf("with no limit, checkFrameSize = %v", err)
+	}
+
+	// From the command line, it fails cleanly before reading anything rather than running out of
+	// memory.
+	_, stderr, err := runCodec(t, t.TempDir(), nil, "-width", "100000", "-height", "100000")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 || !strings.Contains(stderr, "invalid frame size: 100000x100000") {
+		t.Errorf("returned %v, want exit status 1 with an invalid frame size error:\n%s", err, stderr)
+	}
+}
+
+func TestRenditions(t *testing.T) {
+	const width, height = 32, 16
+	frames := testFrames(width, height, 4)
+	dir := t.TempDir()
+	mustRunCodec(t, dir, bytes.Join(frames, nil), "-width", "32", "-height", "16", "-renditions", "hi:level=9 lo:luma-quant=8,subsampling=411")
+
+	primary := readFile(t, filepath.Join(dir, "encoded.bin"))
+	hi := readFile(t, filepath.Join(dir, "encoded-hi.bin"))
+	lo := readFile(t, filepath.Join(dir, "encoded-lo.bin"))
+	if len(lo) >= len(hi) {
+		t.Errorf("the lo rendition is %d bytes, want smaller than the %d bytes of hi", len(lo), len(hi))
+	}
+	// hi has the same settings as the main video.
+	if !bytes.Equal(hi, primary) {
+		t.Error("the hi rendition isn't the same as encoded.bin")
+	}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		lumaStep    uint8
+		subsampling uint8
+	}{
+		{"hi", hi, 1, subsampling420},
+		{"lo", lo, 8, subsampling411},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers, got := decodeFrames(t, tt.data)
+			if len(got) != len(frames) {
+				t.Fatalf("decoded %d frames, want %d", len(got), len(frames))
+			}
+			if hdr := headers[0]; hdr.LumaStep != tt.lumaStep || hdr.Subsampling != tt.subsampling {
+				t.Errorf("luma step %d and subsampling %d, want %d and %d", hdr.LumaStep, hdr.Subsampling, tt.lumaStep, tt.subsampling)
+			}
+			var squaredErr float64
+			for i, frame := range got {
+				squaredErr += squaredError(frames[i], convertToRGB(frame, headers[i]))
+			}
+			if p := psnr(squaredErr / float64(len(frames)*width*height*3)); p < 25 {
+				t.Errorf("PSNR is %.2f dB, want at least 25", p)
+			}
+		})
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	input := bytes.Join(testFrames(64, 32, 6), nil)
+	tests := [][]string{
+		nil,
+		{"-threads", "4"},
+		{"-mode", "adaptive", "-keyframe-interval", "3"},
+	}
+	for _, args := range tests {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			var runs [2][]byte
+			for i := range runs {
+				dir := t.TempDir()
+				mustRunCodec(t, dir, input, append([]string{"-width", "64", "-height", "32", "-deterministic"}, args...)...)
+				runs[i] = readFile(t, filepath.Join(dir, "encoded.bin"))
+			}
+			if !bytes.Equal(runs[0], runs[1]) {
+				t.Error("two runs with -deterministic wrote different videos")
+			}
+			_, got := decodeFrames(t, runs[0])
+			if len(got) != 6 {
+				t.Errorf("decoded %d frames, want 6", len(got))
+			}
+		})
+	}
+}
+
+func TestPreviewScale(t *testing.T) {
+	// Each 2x2 block is averaged, and a block cut off by the edge is averaged over what's there.
+	frame := []byte{
+		0, 0, 0, 4, 4, 4, 9, 9, 9,
+		8, 8, 8, 12, 12, 12, 1, 1, 1,
+	}
+	if got, want := downscale(frame, 3, 2, 3, 2), []byte{6, 6, 6, 5, 5, 5}; !bytes.Equal(got, want) {
+		t.Errorf("downscale = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		width, height, scale int
+	}{
+		{64, 32, 2},
+		{64, 32, 4},
+		{62, 30, 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%dx%d by %d", tt.width, tt.height, tt.scale), func(t *testing.T) {
+			frames := testFrames(tt.width, tt.height, 3)
+			dir := t.TempDir()
+			mustRunCodec(t, dir, bytes.Join(frames, nil), "-width", strconv.Itoa(tt.width), "-height", strconv.Itoa(tt.height), "-preview-scale", strconv.Itoa(tt.scale))
+			w, h := tt.width/tt.scale, tt.height/tt.scale
+			headers, _ := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+			if got := image.Pt(int(headers[0].Width-uint32(headers[0].PadRight)), int(headers[0].Height-uint32(headers[0].PadBottom))); got != image.Pt(w, h) {
+				t.Errorf("encoded a %v video, want %v", got, image.Pt(w, h))
+			}
+
+			var want []byte
+			for _, frame := range frames {
+				want = append(want, downscale(frame, tt.width, tt.height, 3, tt.scale)...)
+			}
+			decoded := readFile(t, filepath.Join(dir, "decoded.rgb24"))
+			if len(decoded) != len(want) {
+				t.Fatalf("decoded %d bytes, want %d", len(decoded), len(want))
+			}
+			if p := psnr(float64(SSD(decoded, want)) / float64(len(want))); p < 25 {
+				t.Errorf("PSNR against the downscaled input is %.2f dB, want at least 25", p)
+			}
+			// It's the same as if the input had been that small to begin with.
+			smallDir := t.TempDir()
+			mustRunCodec(t, smallDir, want, "-width", strconv.Itoa(w), "-height", strconv.Itoa(h))
+			if !bytes.Equal(decoded, readFile(t, filepath.Join(smallDir, "decoded.rgb24"))) {
+				t.Error("decoded a different video than encoding the downscaled input")
+			}
+		})
+	}
+}
+
+func TestFrameTypes(t *testing.T) {
+	const width, height = 32, 16
+	hdr := testHeader(width, height)
+	moving := testYUVFrames(width, height, 4)
+	black := solidFrame([]byte{0, 128, 128}, hdr)
+
+	tests := []struct {
+		name string
+		edit func(*header)
+		// keyframes are the frames to request a keyframe at.
+		keyframes []int
+		frames    [][]byte
+		want      []FrameType
+	}{
+		{"P-frames", nil, nil, moving, []FrameType{KeyFrame, PFrame, PFrame, PFrame}},
+		{"requested keyframe", nil, []int{2}, moving, []FrameType{KeyFrame, PFrame, KeyFrame, PFrame}},
+		{"fade to black", nil, nil, [][]byte{moving[0], moving[1], black, black}, []FrameType{KeyFrame, PFrame, SolidFrame, SolidFrame}},
+		{"still tail", func(hdr *header) { hdr.Repeats = true }, nil, [][]byte{moving[0], moving[1], moving[1], moving[1]}, []FrameType{KeyFrame, PFrame, RepeatFrame, RepeatFrame}},
+		{"tiles", func(hdr *header) { hdr.TileSize = 16 }, nil, moving, []FrameType{KeyFrame, PFrame, PFrame, PFrame}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := hdr
+			if tt.edit != nil {
+				tt.edit(&hdr)
+			}
+			enc, err := NewEncoder(hdr, &Stats{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, frame := range tt.frames {
+				for _, k := range tt.keyframes {
+					if i == k {
+						enc.RequestKeyframe()
+					}
+				}
+				if err := enc.WriteFrame(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := enc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := enc.FrameTypes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FrameTypes() = %v, want %v", got, tt.want)
+			}
+			_, got := decodeFrames(t, data)
+			assertFrames(t, got, tt.frames)
+		})
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	// Nothing encodes a 384x216 frame in a millisecond, let alone twice over in adaptive mode, so
+	// the encoder has to keep lowering its effort.
+	const width, height, frameCount = 384, 216, 20
+	frames := testFrames(width, height, frameCount)
+	dir := t.TempDir()
+	_, stderr := mustRunCodec(t, dir, bytes.Join(frames, nil), "-width", "384", "-height", "216", "-mode", "adaptive", "-deadline-ms", "1")
+	for _, want := range []string{
+		"no longer trying each frame as a keyframe",
+		"starting a new segment at level",
+		"frames encoded at reduced effort",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("didn't log %q:\n%s", want, stderr)
+		}
+	}
+
+	headers, got := decodeFrames(t, readFile(t, filepath.Join(dir, "encoded.bin")))
+	if len(got) != frameCount {
+		t.Fatalf("decoded %d frames, want %d", len(got), frameCount)
+	}
+	// A coarser luma step loses some detail, but it's still the same video.
+	var squaredErr float64
+	for i, frame := range got {
+		squaredErr += squaredError(frames[i], convertToRGB(frame, headers[i]))
+	}
+	if p := psnr(squaredErr / float64(frameCount*width*height*3)); p < 25 {
+		t.Errorf("PSNR is %.2f dB, want at least 25", p)
+	}
+}
+
+func TestDumpPlanes(t *testing.T) {
+	tests := []struct {
+		width, height int
+		args          []string
+		planes        map[string]image.Point
+	}{
+		{32, 16, nil, map[string]image.Point{"y-32x16.png": {32, 16}, "u-16x8.png": {16, 8}, "v-16x8.png": {16, 8}}},
+		{32, 16, []string{"-subsampling", "411"}, map[string]image.Point{"y-32x16.png": {32, 16}, "u-8x16.png": {8, 16}, "v-8x16.png": {8, 16}}},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(append([]string{"420"}, tt.args...), " "), func(t *testing.T) {
+			dir := t.TempDir()
+			frames := testFrames(tt.width, tt.height, 3)
+			mustRunCodec(t, dir, bytes.Join(frames, nil), append([]string{"-width", strconv.Itoa(tt.width), "-height", strconv.Itoa(tt.height), "-compare-frame", "1", "-dump-planes", "planes"}, tt.args...)...)
+			names, err := filepath.Glob(filepath.Join(dir, "planes", "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != len(tt.planes) {
+				t.Errorf("wrote %v, want %d planes", names, len(tt.planes))
+			}
+			for name, size := range tt.planes {
+				f, err := os.Open(filepath.Join(dir, "planes", name))
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				img, err := png.Decode(f)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := img.Bounds().Size(); got != size {
+					t.Errorf("%s is %v, want %v", name, got, size)
+				}
+				gray, ok := img.(*image.Gray)
+				if !ok {
+					t.Errorf("%s is a %T, want grayscale", name, img)
+					continue
+				}
+				// The Y plane is the first thing in frame 1 of encoded.yuv.
+				if strings.HasPrefix(name, "y-") {
+					yuv := readFile(t, filepath.Join(dir, "encoded.yuv"))
+					n := tt.width * tt.height
+					if !bytes.Equal(gray.Pix, yuv[n*3/2:][:n]) {
+						t.Errorf("%s isn't the Y plane of frame 1", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+// record is a frame as it's stored in the inflated stream.
+type record struct {
+	typ  FrameType
+	data []byte
+}
+
+// readRecords inflates a segment compressed with DEFLATE and splits it into its records.
+func readRecords(t testing.TB, segment []byte) []record {
+	t.Helper()
+	r := flate.NewReader(bytes.NewReader(segment[binary.Size(header{}):]))
+	inflated, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []record
+	for len(inflated) > 0 {
+		n := int(binary.BigEndian.Uint32(inflated[1:5]))
+		records = append(records, record{FrameType(inflated[0]), inflated[5 : 5+n]})
+		inflated = inflated[5+n+4:]
+	}
+	return records
+}
+
+func TestRepeats(t *testing.T) {
+	const width, height = 16, 8
+	states := testYUVFrames(width, height, 3)
+	a, b, c := states[0], states[1], states[2]
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		records []FrameType
+		counts  []uint32
+	}{
+		{"no repeats", [][]byte{a, b, c}, []FrameType{KeyFrame, PFrame, PFrame}, nil},
+		{"one repeat", [][]byte{a, b, b}, []FrameType{KeyFrame, PFrame, RepeatFrame}, []uint32{1}},
+		{"long still tail", append([][]byte{a, b}, repeatFrame(c, 1000)...), []FrameType{KeyFrame, PFrame, PFrame, RepeatFrame}, []uint32{999}},
+		{"a pause in the middle", append(append([][]byte{a}, repeatFrame(b, 5)...), c, c), []FrameType{KeyFrame, PFrame, RepeatFrame, PFrame, RepeatFrame}, []uint32{4, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := testHeader(width, height)
+			hdr.Repeats = true
+			var stats Stats
+			data, err := Encode(context.Background(), hdr, tt.frames, &stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var types []FrameType
+			var counts []uint32
+			for _, rec := range readRecords(t, data) {
+				types = append(types, rec.typ)
+				if rec.typ == RepeatFrame {
+					counts = append(counts, binary.BigEndian.Uint32(rec.data))
+				}
+			}
+			if !reflect.DeepEqual(types, tt.records) || !reflect.DeepEqual(counts, tt.counts) {
+				t.Errorf("stored %v with repeat counts %v, want %v with %v", types, counts, tt.records, tt.counts)
+			}
+			headers, got := decodeFrames(t, data)
+			assertFrames(t, got, tt.frames)
+			if !headers[0].Repeats {
+				t.Error("Repeats isn't set after the round trip")
+			}
+		})
+	}
+}
+
+// repeatFrame returns a slice of n copies of frame.
+func repeatFrame(frame []byte, n int) [][]byte {
+	frames := make([][]byte, n)
+	for i := range frames {
+		frames[i] = frame
+	}
+	return frames
+}
+
+func TestLogger(t *testing.T) {
+	const width, height = 16, 8
+	frames := testYUVFrames(width, height, 3)
+	hdr := testHeader(width, height)
+	hdr.FrameCount = uint32(len(frames))
+	data := rawSegment(t, hdr, storedFrames(t, frames))
+	frameSize := len(frames[0])
+	corrupt := append([]byte(nil), data...)
+	corrupt[rawSegmentOffset+(1+4+frameSize+4)+1+4] ^= 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+		opts decodeOptions
+		want []string
+	}{
+		{"cut off", data[:len(data)-frameSize/2], decodeOptions{tolerant: true}, []string{"The stream ends partway through frame 2 of 3"}},
+		{"corrupt", corrupt, decodeOptions{skipCorrupt: true}, []string{"Frame 1 is corrupt", "Frames 2 to 2 depend on a corrupt frame"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Nothing should reach the global logger either way.
+			var global bytes.Buffer
+			log.SetOutput(&global)
+			defer log.SetOutput(os.Stderr)
+
+			var logs bytes.Buffer
+			opts := tt.opts
+			opts.logger = log.New(&logs, "", 0)
+			if _, _, err := decodeAll(context.Background(), tt.data, opts); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("logged %q, want %q", logs.String(), want)
+				}
+			}
+
+			// Without a logger, it's quiet.
+			if _, _, err := decodeAll(context.Background(), tt.data, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if global.Len() > 0 {
+				t.Errorf("logged %q to the global logger", global.String())
+			}
+		})
+	}
+
+	// From the command line, the stats go to the default logger, on stderr.
+	_, stderr := mustRunCodec(t, t.TempDir(), bytes.Join(testFrames(32, 16, 3), nil), "-width", "32", "-height", "16")
+	for _, want := range []string{"Raw size: 4608 bytes", "YUV420P size: 2304 bytes (50.00% original size)", "RLE size: ", "DEFLATE size: "} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("didn't log %q:\n%s", want, stderr)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	// Long enough to take a while to encode, so it can be killed partway through.
+	const frameCount = 20
+	input := bytes.Join(testFrames(192, 108, frameCount), nil)
+	args := []string{"-input", "video.rgb24", "-width", "192", "-height", "108", "-mode", "adaptive", "-checkpoint", "4"}
+
+	want := t.TempDir()
+	if err := os.WriteFile(filepath.Join(want, "video.rgb24"), input, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mustRunCodec(t, want, nil, args...)
+	if _, err := os.Stat(filepath.Join(want, checkpointPath)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("left the checkpoint behind after finishing: %v", err)
+	}
+
+	// Kill the encode as soon as it's made its first checkpoint, as if the machine went down.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "video.rgb24"), input, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := codecCommand(dir, args...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	killed := false
+	for !killed {
+		select {
+		case <-done:
+			t.Skip("the encode finished before it could be killed")
+		case <-time.After(time.Millisecond):
+		}
+		if _, err := os.Stat(filepath.Join(dir, checkpointPath)); err == nil {
+			cmd.Process.Kill()
+			<-done
+			killed = true
+		}
+	}
+	cp, err := readCheckpoint(filepath.Join(dir, checkpointPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Frame <= 0 || cp.Frame >= frameCount {
+		t.Fatalf("checkpoint is at frame %d", cp.Frame)
+	}
+
+	_, stderr := mustRunCodec(t, dir, nil, append(args, "-resume")...)
+	if !strings.Contains(stderr, "Resuming from frame") {
+		t.Errorf("didn't resume:\n%s", stderr)
+	}
+	if !bytes.Equal(readFile(t, filepath.Join(dir, "encoded.bin")), readFile(t, filepath.Join(want, "encoded.bin"))) {
+		t.Errorf("resuming from frame %d wrote a different encoded.bin than encoding it in one go", cp.Frame)
+	}
+}
+
+func TestParsePSNRWeights(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    [3]float64
+		wantErr bool
+	}{
+		{"", [3]float64{1, 1, 1}, false},
+		{"6,1,1", [3]float64{6, 1, 1}, false},
+		{" 0, 1 ,0.5", [3]float64{0, 1, 0.5}, false},
+		{"1,1", [3]float64{}, true},
+		{"1,1,1,1", [3]float64{}, true},
+		{"a,1,1", [3]float64{}, true},
+		{"-1,1,1", [3]float64{}, true},
+		{"NaN,1,1", [3]float64{}, true},
+		{"0,0,0", [3]float64{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePSNRWeights(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePSNRWeights(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parsePSNRWeights(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPSNRWeights(t *testing.T) {
+	// Every pixel of b is shifted from a's gray by +20 red and -10 green, which leaves the Y all
+	// but unchanged (0.299*20 - 0.587*10 = 0.11) and moves V by about 14. So nearly all of the
+	// error is in the chroma.
+	const pixels = 64
+	a := bytes.Repeat([]byte{128, 128, 128}, pixels)
+	b := bytes.Repeat([]byte{148, 118, 128}, pixels)
+	weighted := func(weights [3]float64) float64 {
+		return psnr(weightedSquaredError(a, b, 3, weights) / (pixels * (weights[0] + weights[1] + weights[2])))
+	}
+	tests := []struct {
+		name    string
+		weights [3]float64
+		lo      float64
+		hi      float64
+	}{
+		{"luma only", [3]float64{1, 0, 0}, 60, math.Inf(1)},
+		{"chroma only", [3]float64{0, 1, 1}, 20, 30},
+		{"equal", [3]float64{1, 1, 1}, 20, 30},
+	}
+	got := map[string]float64{}
+	for _, tt := range tests {
+		p := weighted(tt.weights)
+		got[tt.name] = p
+		if p < tt.lo || p > tt.hi {
+			t.Errorf("%s: PSNR %0.2f dB, want between %0.2f and %0.2f", tt.name, p, tt.lo, tt.hi)
+		}
+	}
+	// Giving luma more of the weight should count the chroma error less.
+	if lumaHeavy := weighted([3]float64{6, 1, 1}); lumaHeavy <= got["equal"] {
+		t.Errorf("weights 6,1,1 give %0.2f dB, want more than the %0.2f dB of equal weights", lumaHeavy, got["equal"])
+	}
+	// And identical frames have no error whatever the weights.
+	if e := weightedSquaredError(a, a, 3, [3]float64{6, 1, 1}); e != 0 {
+		t.Errorf("error between identical frames is %v, want 0", e)
+	}
+}
+
+// letterboxFrames returns testFrames of width by height pixels with solid black bars of the
+// given thickness painted over each edge, converted to planar YUV 4:2:0.
+func letterboxFrames(width, height, n, top, bottom, left, right int) [][]byte {
+	frames := testFrames(width, height, n)
+	for i, frame := range frames {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if y < top || y >= height-bottom || x < left || x >= width-right {
+					copy(frame[3*(y*width+x):], []byte{0, 0, 0})
+				}
+			}
+		}
+		frames[i] = convertToYUV(frame, width, height, yuvOptions{})
+	}
+	return frames
+}
+
+func TestLetterbox(t *testing.T) {
+	const width, height = 64, 80
+	black := convertToYUV([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 2, 2, yuvOptions{})
+	tests := []struct {
+		name                     string
+		top, bottom, left, right int
+	}{
+		{"letterbox", 20, 20, 0, 0},
+		{"pillarbox", 0, 0, 8, 8},
+		{"windowbox", 20, 20, 8, 8},
+		{"uneven", 20, 6, 0, 2},
+		{"no bars", 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := letterboxFrames(width, height, 4, tt.top, tt.bottom, tt.left, tt.right)
+			hdr := testHeader(width, height)
+			lb := detectLetterbox(frames, hdr)
+			got := [4]int{int(lb.top), int(lb.bottom), int(lb.left), int(lb.right)}
+			if want := [4]int{tt.top, tt.bottom, tt.left, tt.right}; got != want {
+				t.Fatalf("found bars %v (top, bottom, left, right), want %v", got, want)
+			}
+			if lb != (letterbox{}) && (lb.y != black[0] || lb.u != black[4] || lb.v != black[5]) {
+				t.Errorf("found bars of color Y %d U %d V %d, want black, Y %d U %d V %d", lb.y, lb.u, lb.v, black[0], black[4], black[5])
+			}
+
+			hdr.BarTop, hdr.BarBottom, hdr.BarLeft, hdr.BarRight = lb.top, lb.bottom, lb.left, lb.right
+			hdr.BarY, hdr.BarU, hdr.BarV = lb.y, lb.u, lb.v
+			data := encodeFrames(t, hdr, frames)
+
+			// The bars are only in the header: the keyframe is just the picture between them.
+			picture := (width - tt.left - tt.right) * (height - tt.top - tt.bottom) * 3 / 2
+			if records := readRecords(t, data); len(records[0].data) != picture {
+				t.Errorf("keyframe is %d bytes, want the %d of the picture between the bars", len(records[0].data), picture)
+			}
+			headers, decoded := decodeFrames(t, data)
+			assertFrames(t, decoded, frames)
+			if headers[0].Width != width || headers[0].Height != height {
+				t.Errorf("decoded frames are %dx%d, want %dx%d", headers[0].Width, headers[0].Height, width, height)
+			}
+			if headers[0].BarTop != lb.top || headers[0].BarBottom != lb.bottom || headers[0].BarLeft != lb.left || headers[0].BarRight != lb.right {
+				t.Errorf("decoded header has bars %d, %d, %d, %d, want %d, %d, %d, %d",
+					headers[0].BarTop, headers[0].BarBottom, headers[0].BarLeft, headers[0].BarRight, lb.top, lb.bottom, lb.left, lb.right)
+			}
+		})
+	}
+
+	t.Run("solid frames", func(t *testing.T) {
+		frames := letterboxFrames(width, height, 2, height, 0, 0, 0)
+		if lb := detectLetterbox(frames, testHeader(width, height)); lb != (letterbox{}) {
+			t.Errorf("found bars %+v in frames that are all black, want none", lb)
+		}
+	})
+	t.Run("frame without the bars", func(t *testing.T) {
+		hdr := testHeader(width, height)
+		hdr.BarTop, hdr.BarBottom = 20, 20
+		hdr.BarY, hdr.BarU, hdr.BarV = black[0], black[4], black[5]
+		if _, err := Encode(context.Background(), hdr, testYUVFrames(width, height, 1), &Stats{}); err == nil {
+			t.Error("encoded a frame that doesn't have the bars in the header")
+		}
+	})
+}
+
+func TestInputTCP(t *testing.T) {
+	const width, height = 32, 16
+	frames := testFrames(width, height, 4)
+	video := bytes.Join(frames, nil)
+	tests := []struct {
+		name   string
+		send   []byte
+		frames int
+	}{
+		{"whole video", video, 4},
+		{"one frame", frames[0], 1},
+		{"cut off mid-frame", video[:len(video)-len(frames[0])/2], 3},
+		{"nothing", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			sent := make(chan error, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					sent <- err
+					return
+				}
+				_, err = conn.Write(tt.send)
+				if closeErr := conn.Close(); err == nil {
+					err = closeErr
+				}
+				sent <- err
+			}()
+
+			dir := t.TempDir()
+			args := []string{"-width", strconv.Itoa(width), "-height", strconv.Itoa(height)}
+			mustRunCodec(t, dir, nil, append(args, "-input", "tcp://"+ln.Addr().String())...)
+			if err := <-sent; err != nil {
+				t.Fatalf("sending the video: %v", err)
+			}
+			decoded := readFile(t, filepath.Join(dir, "decoded.rgb24"))
+			if got := len(decoded) / (width * height * 3); got != tt.frames {
+				t.Fatalf("decoded %d frames, want %d", got, tt.frames)
+			}
+
+			// Closing the connection ends the video just like the end of stdin, so the encoded
+			// video is the same as the frames read from stdin.
+			stdinDir := t.TempDir()
+			mustRunCodec(t, stdinDir, bytes.Join(frames[:tt.frames], nil), args...)
+			if !bytes.Equal(readFile(t, filepath.Join(dir, "encoded.bin")), readFile(t, filepath.Join(stdinDir, "encoded.bin"))) {
+				t.Error("encoded.bin differs from encoding the same frames from stdin")
+			}
+		})
+	}
+
+	t.Run("nobody listening", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+		_, stderr, err := runCodec(t, t.TempDir(), nil, "-width", "32", "-height", "16", "-input", "tcp://"+addr)
+		if err == nil || !strings.Contains(stderr, "can't read the video from") {
+			t.Errorf("codec exited with %v and logged %q, want it to fail to connect", err, stderr)
+		}
+	})
+}
+
+// freeAddr returns a local TCP address that nothing is listening on.
+func freeAddr(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// dialViewer connects to the codec's -output listener at addr, retrying until the codec has
+// started listening.
+func dialViewer(t testing.TB, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the codec never listened on %s: %v", addr, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOutputTCP(t *testing.T) {
+	const width, height = 32, 16
+	tests := []struct {
+		name    string
+		args    []string
+		pixel   int
+		outName string
+	}{
+		{"rgb", nil, 3, "decoded.rgb24"},
+		{"alpha", []string{"-alpha"}, 4, "decoded.rgba"},
+		{"several segments", []string{"-checkpoint", "2"}, 3, "decoded.rgb24"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input []byte
+			for _, frame := range testFrames(width, height, 5) {
+				for i := 0; i < len(frame); i += 3 {
+					input = append(input, frame[i:i+3]...)
+					if tt.pixel == 4 {
+						input = append(input, byte(i))
+					}
+				}
+			}
+			dir := t.TempDir()
+			addr := freeAddr(t)
+			args := append([]string{"-width", strconv.Itoa(width), "-height", strconv.Itoa(height), "-output", "tcp://" + addr}, tt.args...)
+			cmd := codecCommand(dir, args...)
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The viewer connects before the codec has read a single frame, so it's sure to be
+			// there when the frames are decoded.
+			conn := dialViewer(t, addr)
+			defer conn.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				data, _ := io.ReadAll(conn)
+				received <- data
+			}()
+			if _, err := stdin.Write(input); err != nil {
+				t.Fatal(err)
+			}
+			stdin.Close()
+			if err := cmd.Wait(); err != nil {
+				t.Fatalf("codec: %v\n%s", err, stderr.String())
+			}
+
+			got := <-received
+			want := readFile(t, filepath.Join(dir, tt.outName))
+			if len(want) != 5*width*height*tt.pixel {
+				t.Fatalf("%s is %d bytes, want 5 frames of %d", tt.outName, len(want), width*height*tt.pixel)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("the viewer received %d bytes that aren't the %d of %s", len(got), len(want), tt.outName)
+			}
+			if !strings.Contains(stderr.String(), "Sent 5 frames to the viewer") {
+				t.Errorf("codec didn't log sending the frames:\n%s", stderr.String())
+			}
+		})
+	}
+
+	t.Run("viewer hangs up", func(t *testing.T) {
+		dir := t.TempDir()
+		addr := freeAddr(t)
+		cmd := codecCommand(dir, "-width", "384", "-height", "216", "-output", "tcp://"+addr)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		conn := dialViewer(t, addr)
+		go func() {
+			io.ReadFull(conn, make([]byte, 384*216*3))
+			conn.Close()
+		}()
+		stdin.Write(bytes.Join(testFrames(384, 216, 20), nil))
+		stdin.Close()
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("codec failed when the viewer hung up: %v\n%s", err, stderr.String())
+		}
+		if decoded := readFile(t, filepath.Join(dir, "decoded.rgb24")); len(decoded) != 20*384*216*3 {
+			t.Errorf("decoded.rgb24 is %d bytes, want all 20 frames", len(decoded))
+		}
+	})
+
+	t.Run("no viewer", func(t *testing.T) {
+		dir := t.TempDir()
+		cmd := codecCommand(dir, "-width", "32", "-height", "16", "-output", "tcp://"+freeAddr(t))
+		cmd.Stdin = bytes.NewReader(bytes.Join(testFrames(width, height, 3), nil))
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("codec: %v\n%s", err, stderr.String())
+			}
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+			t.Fatal("codec is still waiting for a viewer that never connected")
+		}
+		if !strings.Contains(stderr.String(), "No viewer connected") {
+			t.Errorf("codec didn't log that nobody connected:\n%s", stderr.String())
+		}
+		if decoded := readFile(t, filepath.Join(dir, "decoded.rgb24")); len(decoded) != 3*width*height*3 {
+			t.Errorf("decoded.rgb24 is %d bytes, want all 3 frames", len(decoded))
+		}
+	})
+
+	t.Run("no RGB frames to send", func(t *testing.T) {
+		for _, args := range [][]string{{"-luma-only"}, {"-decode-format", "yuv"}} {
+			_, stderr, err := runCodec(t, t.TempDir(), nil, append([]string{"-width", "32", "-height", "16", "-output", "tcp://" + freeAddr(t)}, args...)...)
+			if err == nil || !strings.Contains(stderr, "-output can't be used with") {
+				t.Errorf("codec %v exited with %v and logged %q, want it to refuse", args, err, stderr)
+			}
+		}
+	})
+}
+
+func TestLumaOnlyRepeats(t *testing.T) {
+	const width, height = 16, 8
+	states := testYUVFrames(width, height, 2)
+	a, b := states[0], states[1]
+	black := solidFrame([]byte{0, 128, 128}, testHeader(width, height))
+	tests := []struct {
+		name    string
+		repeats bool
+		frames  [][]byte
+	}{
+		{"long still tail", true, append([][]byte{a, b}, repeatFrame(b, 500)...)},
+		{"pause in the middle", true, append(append([][]byte{a}, repeatFrame(b, 5)...), a)},
+		{"solid frames", false, [][]byte{a, black, black, b}},
+		{"repeated solid frames", true, append(append([][]byte{a}, repeatFrame(black, 10)...), b)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := testHeader(width, height)
+			hdr.Repeats = tt.repeats
+			data := encodeFrames(t, hdr, tt.frames)
+			_, got, _, err := decodeSegment(context.Background(), bytes.NewReader(data), decodeOptions{lumaOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, full := decodeFrames(t, data)
+			want := make([][]byte, len(full))
+			for i, frame := range full {
+				want[i] = frame[:width*height]
+			}
+			assertFrames(t, got, want)
+		})
+	}
+}
+
+func TestFitLumaStep(t *testing.T) {
+	// sizes stand in for encoding a video at each luma step: 1000 bytes at step 1, shrinking by
+	// 20 bytes a step.
+	size := func(step int) int { return 1020 - 20*step }
+	tests := []struct {
+		name    string
+		target  int
+		lo, hi  int
+		want    int
+		encodes int
+	}{
+		{"lossless fits", 1000, 1, 32, 1, 1},
+		{"needs a coarser step", 900, 1, 32, 6, 7},
+		{"exactly the coarsest", 380, 1, 32, 32, 7},
+		{"nothing fits", 100, 1, 32, 32, 2},
+		{"starting from -luma-quant", 900, 8, 32, 8, 1},
+		{"lo is hi", 100, 32, 32, 32, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var encodes int
+			got, err := fitLumaStep(func(step int) (int, error) {
+				encodes++
+				if step < tt.lo || step > tt.hi {
+					t.Errorf("tried step %d, outside of %d to %d", step, tt.lo, tt.hi)
+				}
+				return size(step), nil
+			}, tt.target, tt.lo, tt.hi, t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("fitLumaStep(target %d) = %d, want %d", tt.target, got, tt.want)
+			}
+			if encodes > tt.encodes {
+				t.Errorf("encoded %d times, want at most %d", encodes, tt.encodes)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		want := errors.New("encode failed")
+		if _, err := fitLumaStep(func(int) (int, error) { return 0, want }, 100, 1, 32, t.Logf); !errors.Is(err, want) {
+			t.Errorf("got error %v, want %v", err, want)
+		}
+	})
+}
+
+func TestTwoPassTargetSize(t *testing.T) {
+	const width, height = 64, 32
+	input := bytes.Join(testFrames(width, height, 8), nil)
+	args := []string{"-width", strconv.Itoa(width), "-height", strconv.Itoa(height), "-two-pass"}
+	encodedSize := func(extra ...string) (int, header) {
+		dir := t.TempDir()
+		mustRunCodec(t, dir, input, append(args, extra...)...)
+		data := readFile(t, filepath.Join(dir, "encoded.bin"))
+		headers, _ := decodeFrames(t, data)
+		return len(data), headers[0]
+	}
+	lossless, _ := encodedSize()
+	coarsest, _ := encodedSize("-luma-quant", strconv.Itoa(maxTargetLumaQuant))
+	if coarsest >= lossless {
+		t.Fatalf("a luma step of %d is %d bytes, no smaller than the %d of step 1", maxTargetLumaQuant, coarsest, lossless)
+	}
+
+	tests := []struct {
+		name   string
+		target int
+		step   func(uint8) bool
+	}{
+		{"lossless fits", lossless, func(step uint8) bool { return step == 1 }},
+		{"halfway", (lossless + coarsest) / 2, func(step uint8) bool { return step > 1 && step <= maxTargetLumaQuant }},
+		{"unreachable", coarsest / 2, func(step uint8) bool { return step == maxTargetLumaQuant }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, hdr := encodedSize("-target-size", strconv.Itoa(tt.target))
+			if !tt.step(hdr.LumaStep) {
+				t.Errorf("encoded at a luma step of %d", hdr.LumaStep)
+			}
+			if hdr.LumaStep < maxTargetLumaQuant && size > tt.target {
+				t.Errorf("encoded to %d bytes, over the target of %d", size, tt.target)
+			}
+		})
+	}
+
+	for _, bad := range [][]string{
+		{"-target-size", "1000"},
+		{"-two-pass", "-target-size", "-1"},
+		{"-two-pass", "-target-size", "1000", "-yuv-layout", "packed"},
+	} {
+		if _, stderr, err := runCodec(t, t.TempDir(), input, append([]string{"-width", "64", "-height", "32"}, bad...)...); err == nil {
+			t.Errorf("codec %v succeeded, want it to refuse:\n%s", bad, stderr)
+		}
+	}
+}